@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/erikh/termproxy/server"
+	"github.com/erikh/termproxy/termproxy"
+	"github.com/jawher/mow.cli"
+)
+
+// authorizedKeys are the keys given with -a. They are read when the server
+// starts and refreshed from then on, and reloads reuse them.
+var authorizedKeys *server.AuthorizedKeys
+
+// authServer is a server whose authentication changes when it is reloaded.
+type authServer interface {
+	SetAuth(server.Auth)
+}
+
+var authServers []authServer
+
+// loadAuth reads the authentication given by the flags and the files they
+// name.
+func loadAuth() (server.Auth, error) {
+	auth := server.Auth{
+		Username: *usernameFlag,
+		Password: *passwordFlag,
+		Role:     server.RoleReadWrite,
+		Invites:  invites,
+	}
+
+	if *readOnly {
+		auth.Role = server.RoleReadOnly
+	}
+
+	if *userCAFlag != "" {
+		cas, err := server.ReadAuthorizedKeys(*userCAFlag)
+		if err != nil {
+			return auth, err
+		}
+		auth.UserCAs = cas
+	}
+
+	if len(*authorizedKeysFlag) > 0 {
+		if authorizedKeys == nil {
+			// a source which cannot be read lets nobody in until it can be,
+			// and the rest are used meanwhile.
+			keys, err := server.NewAuthorizedKeys(*authorizedKeysFlag, filepath.Join(stateDir(), "keys"))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+
+			interval, _ := time.ParseDuration(*keysRefreshFlag)
+			keys.Refresh(interval, func(err error) {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			})
+			authorizedKeys = keys
+		} else if err := authorizedKeys.Reload(); err != nil {
+			// the rest are reloaded without the keys which could not be read,
+			// so that the clients who used them can be disconnected.
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+
+		auth.AuthorizedKeys = authorizedKeys
+	}
+
+	if *usersFlag != "" {
+		users, err := server.LoadUsers(*usersFlag)
+		if err != nil {
+			return auth, err
+		}
+		auth.Users = users
+	}
+
+	return auth, nil
+}
+
+// serverAuth builds the SSH server's authentication from the flags.
+func serverAuth() server.Auth {
+	auth, err := loadAuth()
+	if err != nil {
+		termproxy.ErrorOut("Could not load the logins", err, termproxy.ErrUsage)
+	}
+
+	return auth
+}
+
+// reloadAuth reads the authentication again and gives it to the servers, for
+// the connections they make from now on. With disconnect, clients who could
+// no longer log in as they did, as the same user with the same role, are
+// disconnected; it returns how many. If the users file or certificate
+// authorities cannot be read, nothing changes; authorized keys which cannot
+// be read, and have no recent copy, are dropped.
+func reloadAuth(disconnect bool) (int, error) {
+	auth, err := loadAuth()
+	if err != nil {
+		events.emit(event{Type: "reload", Error: err.Error()})
+		return 0, err
+	}
+
+	for _, s := range authServers {
+		s.SetAuth(auth)
+	}
+
+	disconnected := 0
+
+	if disconnect {
+		for _, sess := range sessions.list() {
+			for _, c := range sess.clients.list() {
+				if conn, ok := c.conn.(*server.Conn); ok && !auth.Permits(conn) {
+					sess.kick(conn)
+					disconnected++
+				}
+			}
+		}
+	}
+
+	events.emit(event{Type: "reload"})
+
+	return disconnected, nil
+}
+
+// hostTerminalGone reports whether the terminal termproxy was started in has
+// hung up, which it is told about with SIGHUP too.
+var hostTerminalGone = func() bool {
+	_, err := termproxy.GetWinsize(0)
+	return err != nil
+}
+
+// handleReload reloads the authentication when termproxy is sent SIGHUP. In
+// the foreground SIGHUP also comes when the terminal has gone, and then
+// termproxy is left to die of it as it always has.
+func handleReload() {
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGHUP)
+
+	go func() {
+		for range sigchan {
+			if !*daemonFlag && hostTerminalGone() {
+				signal.Reset(syscall.SIGHUP)
+				syscall.Kill(os.Getpid(), syscall.SIGHUP)
+				return
+			}
+
+			if _, err := reloadAuth(*reloadDisconnectFlag); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not reload the logins: %v\n", err)
+			}
+		}
+	}()
+}
+
+func reloadCommand(cmd *cli.Cmd) {
+	disconnect := cmd.BoolOpt("disconnect", false, "Disconnect clients whose logins no longer work")
+	socket := cmd.StringOpt("control-socket", "", "Control socket of the termproxy to reload; by default NAME.sock in termproxy's runtime directory")
+
+	cmd.Action = func() {
+		var result struct {
+			Disconnected int `json:"disconnected"`
+		}
+
+		if err := callControl(controlSocket(*socket), "reload", map[string]bool{"disconnect": *disconnect}, &result); err != nil {
+			termproxy.ErrorOut("Could not reload the logins", err, termproxy.ErrUsage)
+		}
+
+		fmt.Printf("reloaded; %d clients disconnected\n", result.Disconnected)
+	}
+}
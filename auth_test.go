@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/erikh/termproxy/server"
+)
+
+// authRecorder is a server which keeps the authentication it was last given.
+type authRecorder struct {
+	auth  server.Auth
+	mutex sync.Mutex
+}
+
+func (r *authRecorder) SetAuth(auth server.Auth) {
+	r.mutex.Lock()
+	r.auth = auth
+	r.mutex.Unlock()
+}
+
+func (r *authRecorder) get() server.Auth {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.auth
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "termproxy-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	usersFile := filepath.Join(dir, "users")
+	if err := ioutil.WriteFile(usersFile, []byte("sam read-write password hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		username, password, userCA, refresh = "scott", "", "", "5m"
+		keys                                []string
+		readOnlyLogin, disconnect, daemon   bool
+	)
+	usernameFlag, passwordFlag, userCAFlag, keysRefreshFlag = &username, &password, &userCA, &refresh
+	authorizedKeysFlag, usersFlag = &keys, &usersFile
+	readOnly, reloadDisconnectFlag, daemonFlag = &readOnlyLogin, &disconnect, &daemon
+
+	// the test's own terminal, if it has one, is not the host's.
+	oldGone := hostTerminalGone
+	hostTerminalGone = func() bool { return false }
+	defer func() { hostTerminalGone = oldGone }()
+
+	recorder := &authRecorder{}
+	oldServers := authServers
+	authServers = []authServer{recorder}
+	defer func() { authServers = oldServers }()
+
+	reloads := events.subscribe(eventBufferSize)
+	defer events.unsubscribe(reloads)
+
+	// hup sends termproxy, running in the foreground, SIGHUP and returns the
+	// reload event which follows.
+	hup := func() event {
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case e := <-reloads:
+				if e.Type == "reload" {
+					return e
+				}
+			case <-timeout:
+				t.Fatal("SIGHUP did not reload the logins")
+			}
+		}
+	}
+
+	handleReload()
+
+	if err := ioutil.WriteFile(usersFile, []byte("sam read-only password swordfish\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := hup(); e.Error != "" {
+		t.Fatalf("the reload failed: %s", e.Error)
+	}
+
+	users := recorder.get().Users
+	if users == nil {
+		t.Fatal("the server was not given the users")
+	}
+
+	if _, ok := users.Password("sam", "hunter2"); ok {
+		t.Fatal("the old password still works after the reload")
+	}
+
+	if user, ok := users.Password("sam", "swordfish"); !ok || user.Role != server.RoleReadOnly {
+		t.Fatalf("the new password and role were not loaded: %v, %v", user, ok)
+	}
+
+	// a users file which cannot be read leaves the server as it was.
+	if err := ioutil.WriteFile(usersFile, []byte("sam read-only\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := hup(); e.Error == "" {
+		t.Fatal("a broken users file was reloaded")
+	}
+
+	if recorder.get().Users != users {
+		t.Fatal("the server's logins changed although the users file could not be read")
+	}
+}
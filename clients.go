@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/erikh/termproxy/server"
+	"github.com/erikh/termproxy/termproxy"
+)
+
+// client is a connection watching the session.
+type client struct {
+	conn  net.Conn
+	sub   *termproxy.Subscriber
+	since time.Time
+	// size is the size of its terminal, once known, and told what it was
+	// last told about fitting the session into it.
+	size termproxy.Winch
+	told string
+}
+
+// clientList keeps track of who is connected so the host can see and manage
+// them, and holds back their output while broadcasting is paused.
+type clientList struct {
+	hub     *termproxy.Hub
+	clients []*client
+	paused  bool
+	mutex   sync.Mutex
+}
+
+func newClientList(hub *termproxy.Hub) *clientList {
+	return &clientList{hub: hub}
+}
+
+// add subscribes conn to the session's output, unless broadcasting is paused,
+// in which case it is subscribed on resume.
+func (l *clientList) add(conn net.Conn) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	c := &client{conn: conn, since: time.Now()}
+	if !l.paused {
+		c.sub = l.hub.Subscribe(conn)
+	}
+
+	l.clients = append(l.clients, c)
+}
+
+func (l *clientList) remove(conn net.Conn) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for i, c := range l.clients {
+		if c.conn == conn {
+			if c.sub != nil {
+				l.hub.Unsubscribe(c.sub)
+			}
+			l.clients = append(l.clients[:i], l.clients[i+1:]...)
+			return
+		}
+	}
+}
+
+// setSize records the size of conn's terminal, so that it is painted a view
+// of the screen which fits it, and tells it the size of the screen, shared,
+// when either changes. A terminal which fits the screen when it connects is
+// not told anything.
+func (l *clientList) setSize(conn net.Conn, ws, shared termproxy.Winch) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, c := range l.clients {
+		if c.conn != conn {
+			continue
+		}
+
+		c.size = ws
+		if c.sub != nil {
+			l.hub.SetSize(c.sub, int(ws.Width), int(ws.Height))
+		}
+
+		fits := ws.Width == shared.Width && ws.Height == shared.Height
+		told := fmt.Sprintf("%dx%d %dx%d", ws.Width, ws.Height, shared.Width, shared.Height)
+		if told == c.told || (c.told == "" && fits) {
+			c.told = told
+			return
+		}
+		c.told = told
+
+		if sc, ok := conn.(*server.Conn); ok && sc.TellSize(shared) {
+			return
+		}
+
+		if c.sub == nil {
+			return
+		}
+
+		if fits {
+			termproxy.WriteTop(c.sub.Overlay(), fmt.Sprintf("The session is %dx%d, which fits your terminal\n", shared.Width, shared.Height))
+		} else {
+			termproxy.WriteTop(c.sub.Overlay(), fmt.Sprintf("The session is %dx%d; your %dx%d terminal shows %s\n", shared.Width, shared.Height, ws.Width, ws.Height, fitting(ws, shared)))
+		}
+		return
+	}
+}
+
+// fit tells every client whose terminal's size is known, from winsizes, how
+// the screen, now of size shared, fits it.
+func (l *clientList) fit(winsizes map[string]termproxy.Winch, shared termproxy.Winch) {
+	for _, c := range l.list() {
+		if ws, ok := winsizes[winsizeKey(c.conn)]; ok {
+			l.setSize(c.conn, ws, shared)
+		}
+	}
+}
+
+// fitting describes how the screen, of size shared, is shown on a terminal of
+// size ws.
+func fitting(ws, shared termproxy.Winch) string {
+	switch {
+	case ws.Width <= shared.Width && ws.Height <= shared.Height:
+		return "the part of it around the cursor"
+	case ws.Width >= shared.Width && ws.Height >= shared.Height:
+		return "it framed in the middle"
+	}
+
+	return "it framed, following the cursor"
+}
+
+// list returns the clients in the order they connected.
+func (l *clientList) list() []*client {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]*client{}, l.clients...)
+}
+
+func (l *clientList) isPaused() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.paused
+}
+
+// setPaused stops or restarts output to every client. Clients are painted the
+// current screen when output restarts.
+func (l *clientList) setPaused(paused bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if paused == l.paused {
+		return
+	}
+	l.paused = paused
+
+	for _, c := range l.clients {
+		switch {
+		case paused && c.sub != nil:
+			l.hub.Pause(c.sub)
+		case !paused && c.sub == nil:
+			c.sub = l.hub.Subscribe(c.conn)
+			if c.size.Width != 0 {
+				l.hub.SetSize(c.sub, int(c.size.Width), int(c.size.Height))
+			}
+		case !paused:
+			l.hub.Resume(c.sub)
+		}
+	}
+}
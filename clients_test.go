@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erikh/termproxy/termproxy"
+)
+
+// testConn is a client connection which records what it is sent, and
+// whether it was closed.
+type testConn struct {
+	net.Conn
+	addr   *net.TCPAddr
+	buf    bytes.Buffer
+	closed bool
+	mutex  sync.Mutex
+}
+
+func newTestConn(port int) *testConn {
+	return &testConn{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}}
+}
+
+func (c *testConn) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.buf.Write(p)
+}
+
+func (c *testConn) String() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.buf.String()
+}
+
+func (c *testConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *testConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *testConn) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestClientsFitNegotiatedSize(t *testing.T) {
+	hub := termproxy.NewHub()
+	hub.Screen = termproxy.NewScreen(100, 40)
+
+	clients := newClientList(hub)
+	large, small, unknown := newTestConn(1), newTestConn(2), newTestConn(3)
+	clients.add(large)
+	clients.add(small)
+	clients.add(unknown)
+
+	winsizes := map[string]termproxy.Winch{
+		winsizeKey(large): {Width: 100, Height: 40},
+		winsizeKey(small): {Width: 100, Height: 40},
+	}
+
+	// terminals which fit the session from the start are not told anything.
+	clients.fit(winsizes, termproxy.ResizeSmallest.Size(winsizes, ""))
+
+	// the smaller terminal shrinks, and the session with it.
+	winsizes[winsizeKey(small)] = termproxy.Winch{Width: 60, Height: 20}
+	size := termproxy.ResizeSmallest.Size(winsizes, "")
+	hub.Screen.Resize(int(size.Width), int(size.Height))
+	clients.fit(winsizes, size)
+
+	waitFor(t, "the larger terminal to be told the session's size", func() bool {
+		return strings.Contains(large.String(), "The session is 60x20; your 100x40 terminal shows it framed in the middle")
+	})
+	waitFor(t, "the smaller terminal to be told it fits", func() bool {
+		return strings.Contains(small.String(), "The session is 60x20, which fits your terminal")
+	})
+
+	// the smaller terminal grows back, and the session with it.
+	winsizes[winsizeKey(small)] = termproxy.Winch{Width: 100, Height: 40}
+	size = termproxy.ResizeSmallest.Size(winsizes, "")
+	hub.Screen.Resize(int(size.Width), int(size.Height))
+	clients.fit(winsizes, size)
+
+	waitFor(t, "the larger terminal to be told it fits again", func() bool {
+		return strings.Contains(large.String(), "The session is 100x40, which fits your terminal")
+	})
+	waitFor(t, "the smaller terminal to be told it fits again", func() bool {
+		return strings.Contains(small.String(), "The session is 100x40, which fits your terminal")
+	})
+
+	for _, c := range []*testConn{large, small} {
+		if output := c.String(); strings.Contains(output, "your 60x20") {
+			t.Fatalf("a terminal was told the size which triggered the resize: %q", output)
+		}
+	}
+
+	// a terminal whose size is unknown is told nothing.
+	if output := unknown.String(); strings.Contains(output, "The session is") {
+		t.Fatalf("a terminal of unknown size was told the session's size: %q", output)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/erikh/termproxy/termproxy"
+	"github.com/jawher/mow.cli"
+)
+
+// options declares termproxy's options. Each takes its default from the
+// configuration file, with the chosen profile laid over it, and then from a
+// TERMPROXY_<NAME> environment variable, before the command line has its say.
+type options struct {
+	app      *cli.Cli
+	filename string
+	settings map[string]termproxy.ConfigValue
+	used     map[string]bool
+}
+
+// defaultConfigFile is the configuration file read without --config.
+func defaultConfigFile() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "termproxy", "config")
+	}
+
+	return filepath.Join(os.Getenv("HOME"), ".config", "termproxy", "config")
+}
+
+// loadOptions reads the configuration file and profile named in args or the
+// environment. They are needed before the options can be declared, so they
+// are picked out of args by hand.
+func loadOptions(app *cli.Cli, args []string) *options {
+	filename := argValue(args, "config", "TERMPROXY_CONFIG")
+	explicit := filename != ""
+	if !explicit {
+		filename = defaultConfigFile()
+	}
+
+	config, err := termproxy.LoadConfig(filename)
+	if os.IsNotExist(err) && !explicit {
+		config, err = &termproxy.Config{}, nil
+	}
+	if err != nil {
+		termproxy.ErrorOut("Could not read the configuration file", err, termproxy.ErrUsage)
+	}
+
+	settings, err := config.Profile(argValue(args, "profile", "TERMPROXY_PROFILE"))
+	if err != nil {
+		termproxy.ErrorOut("Invalid profile", fmt.Errorf("%s: %v", filename, err), termproxy.ErrUsage)
+	}
+
+	app.String(cli.StringOpt{
+		Name:   "config",
+		Value:  filename,
+		EnvVar: "TERMPROXY_CONFIG",
+		Desc:   "Configuration file giving defaults for these options",
+	})
+	app.String(cli.StringOpt{
+		Name:   "profile",
+		EnvVar: "TERMPROXY_PROFILE",
+		Desc:   "Profile in the configuration file to use",
+	})
+
+	return &options{app: app, filename: filename, settings: settings, used: map[string]bool{}}
+}
+
+// argValue finds the value of the option --name in args, falling back to the
+// environment variable env.
+func argValue(args []string, name, env string) string {
+	for i, arg := range args {
+		switch {
+		case arg == "--":
+			return os.Getenv(env)
+		case arg == "--"+name && i+1 < len(args):
+			return args[i+1]
+		case strings.HasPrefix(arg, "--"+name+"="):
+			return strings.TrimPrefix(arg, "--"+name+"=")
+		}
+	}
+
+	return os.Getenv(env)
+}
+
+// setting returns the configured value of the option called name, whose long
+// name is its key in the configuration file, along with the environment
+// variable which overrides it.
+func (o *options) setting(name string) (string, *termproxy.ConfigValue, string) {
+	names := strings.Fields(name)
+	key := names[len(names)-1]
+	env := "TERMPROXY_" + strings.ToUpper(strings.Replace(key, "-", "_", -1))
+
+	value, ok := o.settings[key]
+	if !ok {
+		return key, nil, env
+	}
+
+	o.used[key] = true
+	return key, &value, env
+}
+
+func (o *options) invalid(key, want string) {
+	termproxy.ErrorOut("Invalid configuration", fmt.Errorf("%s: %s should be %s", o.filename, key, want), termproxy.ErrUsage)
+}
+
+// StringOpt declares a string option, like cli.Cli's.
+func (o *options) StringOpt(name, value, desc string) *string {
+	return o.string(name, value, desc, false)
+}
+
+// PasswordOpt is StringOpt for options whose values are kept out of --help.
+func (o *options) PasswordOpt(name, value, desc string) *string {
+	return o.string(name, value, desc, true)
+}
+
+func (o *options) string(name, value, desc string, hide bool) *string {
+	key, setting, env := o.setting(name)
+	if setting != nil {
+		if setting.List {
+			o.invalid(key, "a string")
+		}
+		value = setting.Values[0]
+	}
+
+	return o.app.String(cli.StringOpt{Name: name, Value: value, Desc: desc, EnvVar: env, HideValue: hide})
+}
+
+// BoolOpt declares a boolean option, like cli.Cli's.
+func (o *options) BoolOpt(name string, value bool, desc string) *bool {
+	key, setting, env := o.setting(name)
+	if setting != nil {
+		if setting.List || (setting.Values[0] != "true" && setting.Values[0] != "false") {
+			o.invalid(key, "true or false")
+		}
+		value = setting.Values[0] == "true"
+	}
+
+	return o.app.Bool(cli.BoolOpt{Name: name, Value: value, Desc: desc, EnvVar: env})
+}
+
+// IntOpt declares an integer option, like cli.Cli's.
+func (o *options) IntOpt(name string, value int, desc string) *int {
+	key, setting, env := o.setting(name)
+	if setting != nil {
+		var err error
+		if setting.List {
+			o.invalid(key, "a number")
+		}
+		if value, err = strconv.Atoi(setting.Values[0]); err != nil {
+			o.invalid(key, "a number")
+		}
+	}
+
+	return o.app.Int(cli.IntOpt{Name: name, Value: value, Desc: desc, EnvVar: env})
+}
+
+// StringsOpt declares an option which may be repeated, like cli.Cli's. It
+// may be configured with a list or a single string, and is given to the
+// environment separated by commas. Values given on the command line are added
+// to those.
+func (o *options) StringsOpt(name string, value []string, desc string) *[]string {
+	_, setting, env := o.setting(name)
+	if setting != nil {
+		value = setting.Values
+	}
+
+	return o.app.Strings(cli.StringsOpt{Name: name, Value: value, Desc: desc, EnvVar: env})
+}
+
+// check fails if the configuration has settings no option was declared for.
+func (o *options) check() {
+	unknown := []string{}
+	for key := range o.settings {
+		if !o.used[key] {
+			unknown = append(unknown, key)
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		termproxy.ErrorOut("Invalid configuration", fmt.Errorf("%s: unknown settings %s", o.filename, strings.Join(unknown, ", ")), termproxy.ErrUsage)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/erikh/termproxy/server"
+	"github.com/erikh/termproxy/termproxy"
+)
+
+// controlKey starts a control command on the input path when --control is
+// set: Ctrl-] followed by
+//
+//	c  ask for control, or take it straight away if you are a host
+//	g  grant control to whoever has waited longest (hosts only)
+//	r  hand control back to the host
+const controlKey = 0x1d
+
+// isHost reports whether owner may grant and take control: the terminal
+// termproxy was started from, and users with the host role.
+func isHost(owner interface{}) bool {
+	if c, ok := owner.(*server.Conn); ok {
+		return c.Role() == server.RoleHost
+	}
+
+	return owner == os.Stdin
+}
+
+func ownerName(owner interface{}) string {
+	if conn, ok := owner.(net.Conn); ok {
+		return clientName(conn)
+	}
+
+	return "the host"
+}
+
+func controlHandler(sess *session) func(interface{}, byte) {
+	control := sess.control
+	announce := func(format string, owner interface{}) {
+		termproxy.WriteTop(sess.hub.Overlay(), fmt.Sprintf(format+"\n", ownerName(owner)))
+	}
+
+	// control events name the new driver; without an address, it is the host.
+	changed := func(driver interface{}) {
+		conn, _ := driver.(net.Conn)
+		events.emit(clientEvent("control", sess, conn))
+		sess.controlChanged()
+	}
+
+	return func(owner interface{}, command byte) {
+		switch command {
+		case 'c':
+			if isHost(owner) {
+				if !control.IsDriver(owner) {
+					control.Give(owner)
+					announce("%s took control", owner)
+					changed(owner)
+				}
+			} else if canWrite(sess, owner) && control.Request(owner) {
+				announce("%s asks for control (host: Ctrl-] g to grant)", owner)
+			}
+		case 'g':
+			if !isHost(owner) {
+				return
+			}
+
+			if driver, ok := control.Grant(); ok {
+				announce("%s has control", driver)
+				changed(driver)
+			}
+		case 'r':
+			if control.Release(owner) {
+				announce("%s handed control back to the host", owner)
+				changed(control.Driver())
+			}
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/erikh/termproxy/termproxy"
+	"github.com/jawher/mow.cli"
+)
+
+// daemonEnv is set in the environment of the background process started by
+// --daemon, so that it knows not to start another.
+const daemonEnv = "TERMPROXY_DAEMON_CHILD"
+
+// runtimeDir is where termproxy's sockets go by default: a directory only
+// accessible to its owner, under $XDG_RUNTIME_DIR or the temporary directory.
+func runtimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "termproxy")
+	}
+
+	return filepath.Join(os.TempDir(), fmt.Sprintf("termproxy-%d", os.Getuid()))
+}
+
+// defaultSocket is where a daemon listens, and attach connects, without
+// --socket.
+func defaultSocket() string {
+	return filepath.Join(runtimeDir(), "attach.sock")
+}
+
+// socketInUse reports whether a daemon is listening on path.
+func socketInUse(path string) bool {
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		return false
+	}
+
+	c.Close()
+	return true
+}
+
+// startDaemon starts termproxy again in the background, without a terminal,
+// and returns once it is listening on its socket. The daemon's own errors go
+// to a log file next to the socket.
+func startDaemon(socket string) {
+	if socketInUse(socket) {
+		termproxy.ErrorOut(fmt.Sprintf("A termproxy daemon is already running at %s", socket), nil, termproxy.ErrUsage)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		termproxy.ErrorOut("Could not create the socket directory", err, termproxy.ErrUsage)
+	}
+	if err := checkOwner(filepath.Dir(socket)); err != nil {
+		termproxy.ErrorOut("Refusing to put the socket there", err, termproxy.ErrUsage)
+	}
+	os.Remove(socket)
+
+	logname := socket + ".log"
+	logfile, err := os.OpenFile(logname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		termproxy.ErrorOut("Could not create the daemon's log", err, termproxy.ErrUsage)
+	}
+	defer logfile.Close()
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = logfile
+	cmd.Stderr = logfile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if daemonHostKey != nil {
+		r, w, err := os.Pipe()
+		if err != nil {
+			termproxy.ErrorOut("Could not hand the host key to the daemon", err, termproxy.ErrCommand)
+		}
+		defer r.Close()
+
+		// the key is far smaller than the pipe's buffer, so it can be written
+		// before anyone reads it.
+		cmd.ExtraFiles = []*os.File{r}
+		w.Write(daemonHostKey)
+		w.Close()
+	}
+
+	if err := cmd.Start(); err != nil {
+		termproxy.ErrorOut("Could not start the daemon", err, termproxy.ErrCommand)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	timeout := time.After(10 * time.Second)
+
+	for {
+		select {
+		case <-exited:
+			termproxy.ErrorOut(fmt.Sprintf("The daemon exited; see %s", logname), nil, termproxy.ErrCommand)
+		case <-timeout:
+			termproxy.ErrorOut(fmt.Sprintf("The daemon did not start listening; see %s", logname), nil, termproxy.ErrCommand)
+		case <-time.After(100 * time.Millisecond):
+			if _, err := os.Stat(socket); err == nil {
+				fmt.Printf("termproxy is running in the background (pid %d)\n", cmd.Process.Pid)
+				fmt.Printf("attach with: %s attach -S %s\n", os.Args[0], socket)
+				return
+			}
+		}
+	}
+}
+
+// checkOwner fails unless dir belongs to the user termproxy runs as, so that
+// nobody else can swap the socket in it for their own.
+func checkOwner(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s belongs to another user", dir)
+	}
+
+	return nil
+}
+
+// listenUnix listens on the Unix socket path, replacing a stale one, and
+// removes it when termproxy exits.
+func listenUnix(path string) net.Listener {
+	if socketInUse(path) {
+		termproxy.ErrorOut(fmt.Sprintf("Another termproxy is already listening on %s", path), nil, termproxy.ErrUsage)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		termproxy.ErrorOut("Could not create the socket directory", err, termproxy.ErrUsage)
+	}
+	if err := checkOwner(filepath.Dir(path)); err != nil {
+		termproxy.ErrorOut("Refusing to put the socket there", err, termproxy.ErrUsage)
+	}
+	os.Remove(path)
+
+	// whoever can connect can type into the sessions, so nobody else may,
+	// even before the socket's mode is set.
+	mask := syscall.Umask(0177)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+	if err != nil {
+		termproxy.ErrorOut(fmt.Sprintf("Could not listen on %s", path), err, termproxy.ErrNetwork)
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		termproxy.ErrorOut(fmt.Sprintf("Could not restrict access to %s", path), err, termproxy.ErrNetwork)
+	}
+
+	errorOut := termproxy.ErrorOut
+	termproxy.ErrorOut = func(msg string, err error, exitcode int) {
+		os.Remove(path)
+		errorOut(msg, err, exitcode)
+	}
+
+	return l
+}
+
+// listenAttach listens on socket for terminals attaching to the daemon.
+func listenAttach(socket string, programColors termproxy.ColorSupport) {
+	l := listenUnix(socket)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				continue
+			}
+
+			go hostTerm.serveAttached(c, programColors)
+		}
+	}()
+}
+
+func attachCommand(cmd *cli.Cmd) {
+	socket := cmd.StringOpt("S socket", defaultSocket(), "Unix socket the daemon listens on")
+
+	cmd.Action = func() {
+		attach(*socket)
+	}
+}
+
+// attach connects this terminal to a daemon, until the daemon exits or the
+// host menu detaches it.
+func attach(socket string) {
+	c, err := net.Dial("unix", socket)
+	if err != nil {
+		termproxy.ErrorOut(fmt.Sprintf("Could not attach to %s", socket), err, termproxy.ErrNetwork)
+	}
+
+	termproxy.MakeRaw(0)
+
+	ws, err := termproxy.GetWinsize(0)
+	if err != nil {
+		termproxy.ErrorOut("Could not retrieve the terminal dimensions", err, termproxy.ErrTerminal)
+	}
+
+	termproxy.WriteFrame(c, termproxy.FrameHello, termproxy.HelloPayload(os.Getenv("TERM"), os.Getenv("COLORTERM")))
+	termproxy.WriteFrame(c, termproxy.FrameWinch, termproxy.WinchPayload(ws))
+
+	go func() {
+		sigchan := make(chan os.Signal, 1)
+		signal.Notify(sigchan, syscall.SIGWINCH)
+
+		for range sigchan {
+			if ws, err := termproxy.GetWinsize(0); err == nil {
+				termproxy.WriteFrame(c, termproxy.FrameWinch, termproxy.WinchPayload(ws))
+			}
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, 256)
+
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				c.Close()
+				return
+			}
+
+			if err := termproxy.WriteFrame(c, termproxy.FrameInput, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			break
+		}
+		os.Stdout.Write(buf[:n])
+	}
+
+	termproxy.ErrorOut("Detached from termproxy", nil, 0)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/erikh/termproxy/server"
+)
+
+// event is something that happened to a session, as told to the control
+// socket's subscribers. Fields which do not apply to the type are left out.
+type event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Session string    `json:"session,omitempty"`
+	Address string    `json:"address,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Role    string    `json:"role,omitempty"`
+	Width   uint      `json:"width,omitempty"`
+	Height  uint      `json:"height,omitempty"`
+	Enabled *bool     `json:"enabled,omitempty"`
+	Policy  string    `json:"policy,omitempty"`
+	Status  *int      `json:"status,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// eventBufferSize is how many events a control socket subscriber may fall
+// behind before it misses some.
+const eventBufferSize = 64
+
+// eventBus hands events out to everyone subscribed.
+type eventBus struct {
+	subscribers map[chan event]struct{}
+	queues      map[*eventQueue]struct{}
+	mutex       sync.Mutex
+}
+
+var events = &eventBus{subscribers: map[chan event]struct{}{}, queues: map[*eventQueue]struct{}{}}
+
+// subscribe returns a channel receiving events, which holds up to size of them
+// until they are read.
+func (b *eventBus) subscribe(size int) chan event {
+	ch := make(chan event, size)
+
+	b.mutex.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mutex.Unlock()
+
+	return ch
+}
+
+// unsubscribe stops sending events to ch and closes it.
+func (b *eventBus) unsubscribe(ch chan event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// subscribeQueue returns a queue receiving every event, however far behind
+// its reader falls.
+func (b *eventBus) subscribeQueue() *eventQueue {
+	q := &eventQueue{cond: sync.NewCond(new(sync.Mutex))}
+
+	b.mutex.Lock()
+	b.queues[q] = struct{}{}
+	b.mutex.Unlock()
+
+	return q
+}
+
+// unsubscribeQueue stops adding events to q and closes it.
+func (b *eventBus) unsubscribeQueue(q *eventQueue) {
+	b.mutex.Lock()
+	delete(b.queues, q)
+	b.mutex.Unlock()
+
+	q.close()
+}
+
+// emit sends e to every subscriber. Channel subscribers which are not keeping
+// up miss it rather than holding up the session; queues never do.
+func (b *eventBus) emit(e event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+
+	for q := range b.queues {
+		q.push(e)
+	}
+}
+
+// eventQueue holds the events for a sink until it gets to them.
+type eventQueue struct {
+	events []event
+	closed bool
+	cond   *sync.Cond
+}
+
+func (q *eventQueue) push(e event) {
+	q.cond.L.Lock()
+	q.events = append(q.events, e)
+	q.cond.L.Unlock()
+	q.cond.Signal()
+}
+
+func (q *eventQueue) close() {
+	q.cond.L.Lock()
+	q.closed = true
+	q.cond.L.Unlock()
+	q.cond.Signal()
+}
+
+// pop waits for the next event. It returns false once the queue has been
+// closed and emptied.
+func (q *eventQueue) pop() (event, bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	for len(q.events) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+
+	if len(q.events) == 0 {
+		return event{}, false
+	}
+
+	e := q.events[0]
+	q.events = q.events[1:]
+	return e, true
+}
+
+// clientEvent is an event about conn, a client of sess.
+func clientEvent(kind string, sess *session, conn net.Conn) event {
+	e := event{Type: kind, Session: sess.name}
+
+	if conn != nil {
+		e.Address = conn.RemoteAddr().String()
+	}
+
+	if c, ok := conn.(*server.Conn); ok {
+		e.User = c.User()
+		e.Role = c.Role().String()
+	}
+
+	return e
+}
+
+// toggleEvent is an event about a setting of sess being turned on or off.
+func toggleEvent(kind string, sess *session, on bool) event {
+	return event{Type: kind, Session: sess.name, Enabled: &on}
+}
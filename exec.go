@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/erikh/termproxy/server"
+)
+
+const execHelp = `termproxy commands:
+  sessions  list the running sessions
+  who       list the clients watching the session
+  status    show the program, its size and uptime, and session settings
+  size      print the size of the program's terminal as COLSxROWS
+  uptime    print how long the session has been running
+  snapshot  print the text on the program's screen
+  help      show this message
+`
+
+// execHandler answers exec requests, such as "ssh -p 1234 host who", with
+// information about a running session. Clients name the session with their
+// login, as "user+session"; otherwise they are told about the first one.
+func execHandler(sessions *sessionList) func(net.Conn, string) int {
+	return func(c net.Conn, line string) int {
+		var out io.Writer = c
+
+		list := sessions.list()
+		if len(list) == 0 {
+			return 1
+		}
+		sess := list[0]
+
+		if conn, ok := c.(*server.Conn); ok {
+			if conn.PTYRequest().Term != "" {
+				// the client's terminal is in raw mode when it asked for one.
+				out = crlfWriter{c}
+			}
+
+			if named := sessions.get(conn.Session()); named != nil {
+				sess = named
+			}
+		}
+
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			args = []string{"help"}
+		}
+
+		hub, clients, control := sess.hub, sess.clients, sess.control
+
+		switch args[0] {
+		case "sessions":
+			for _, other := range list {
+				fmt.Fprintf(out, "%s\t%s\t%d watching\t%s\n", other.name, other.command.String(), len(other.clients.list()), time.Since(other.started)/time.Second*time.Second)
+			}
+		case "who":
+			for _, client := range clients.list() {
+				fmt.Fprintf(out, "%s\t%s", clientName(client.conn), time.Since(client.since)/time.Second*time.Second)
+				if control != nil && control.IsDriver(client.conn) {
+					fmt.Fprint(out, "\tdriving")
+				}
+				fmt.Fprintln(out)
+			}
+		case "status":
+			width, height := hub.Screen.Size()
+			stats := hub.Stats()
+
+			fmt.Fprintf(out, "session:        %s\n", sess.name)
+			fmt.Fprintf(out, "program:        %s\n", sess.command.String())
+			fmt.Fprintf(out, "size:           %dx%d\n", width, height)
+			fmt.Fprintf(out, "uptime:         %s\n", time.Since(sess.started)/time.Second*time.Second)
+			fmt.Fprintf(out, "clients:        %d\n", len(clients.list()))
+			fmt.Fprintf(out, "read-only:      %v\n", sess.locked.Get())
+			fmt.Fprintf(out, "paused:         %v\n", clients.isPaused())
+			fmt.Fprintf(out, "resize policy:  %s\n", sess.getResizePolicy())
+			if control != nil {
+				fmt.Fprintf(out, "driver:         %s\n", ownerName(control.Driver()))
+			}
+			fmt.Fprintf(out, "fell behind:    %d times, %d resynced, %d disconnected\n", stats.Overflows, stats.Resyncs, stats.Disconnects)
+			fmt.Fprintf(out, "host key:       %s\n", hostKeyDescription())
+		case "size":
+			width, height := hub.Screen.Size()
+			fmt.Fprintf(out, "%dx%d\n", width, height)
+		case "uptime":
+			fmt.Fprintln(out, time.Since(sess.started)/time.Second*time.Second)
+		case "snapshot":
+			lines := hub.Screen.Text()
+			for len(lines) > 0 && lines[len(lines)-1] == "" {
+				lines = lines[:len(lines)-1]
+			}
+
+			for _, line := range lines {
+				fmt.Fprintln(out, line)
+			}
+		case "help":
+			fmt.Fprint(out, execHelp)
+		default:
+			fmt.Fprintf(out, "termproxy: unknown command %q; try \"help\"\n", args[0])
+			return 127
+		}
+
+		return 0
+	}
+}
+
+// crlfWriter turns newlines into the carriage return and newline a raw
+// terminal needs.
+type crlfWriter struct {
+	io.Writer
+}
+
+func (w crlfWriter) Write(buf []byte) (int, error) {
+	if _, err := w.Writer.Write([]byte(strings.Replace(string(buf), "\n", "\r\n", -1))); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
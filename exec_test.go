@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/erikh/termproxy/termproxy"
+)
+
+// newTestSession makes a session named name, without a program.
+func newTestSession(name string, width, height int) *session {
+	hub := termproxy.NewHub()
+	hub.Screen = termproxy.NewScreen(width, height)
+
+	sess := &session{
+		name:     name,
+		hub:      hub,
+		command:  termproxy.NewCommand("/bin/cat"),
+		clients:  newClientList(hub),
+		winsizes: map[string]termproxy.Winch{},
+		started:  time.Now(),
+	}
+
+	return sess
+}
+
+func TestExecHandler(t *testing.T) {
+	list := &sessionList{joined: map[net.Conn]*session{}}
+	first, second := newTestSession("first", 80, 24), newTestSession("second", 100, 30)
+	list.add(first)
+	list.add(second)
+
+	first.hub.Write([]byte("$ make\r\nok\r\n"))
+	waitFor(t, "the screen to be written", func() bool { return first.hub.Screen.Text()[1] == "ok" })
+
+	watcher := newTestConn(4242)
+	first.clients.add(watcher)
+	defer first.clients.remove(watcher)
+
+	run := func(command string) (string, int) {
+		out := newTestConn(1)
+		status := execHandler(list)(out, command)
+		return out.String(), status
+	}
+
+	for _, test := range []struct {
+		command, output string
+		status          int
+	}{
+		{"size", "80x24\n", 0},
+		{"snapshot", "$ make\nok\n", 0},
+		{"who", "127.0.0.1:4242\t0s\n", 0},
+		{"", execHelp, 0},
+		{"explode", "termproxy: unknown command \"explode\"; try \"help\"\n", 127},
+	} {
+		if output, status := run(test.command); output != test.output || status != test.status {
+			t.Fatalf("%q: expected %q and %d, got %q and %d", test.command, test.output, test.status, output, status)
+		}
+	}
+
+	output, _ := run("sessions")
+	lines := bytes.Split([]byte(output), []byte("\n"))
+	if len(lines) != 3 || !bytes.HasPrefix(lines[0], []byte("first\t/bin/cat\t1 watching")) || !bytes.HasPrefix(lines[1], []byte("second\t/bin/cat\t0 watching")) {
+		t.Fatalf("expected both sessions, got %q", output)
+	}
+}
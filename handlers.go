@@ -1,43 +1,117 @@
 package main
 
 import (
+	"fmt"
 	"net"
+	"os"
 
 	"github.com/erikh/termproxy/server"
 	"github.com/erikh/termproxy/termproxy"
 )
 
-func closeHandler(s *server.SSHServer) func(*termproxy.Command) {
+func closeHandler(sess *session) func(*termproxy.Command) {
 	return func(command *termproxy.Command) {
-		s.Iterate(func(s *server.SSHServer, conn net.Conn, i int) error {
-			conn.Close()
-			return nil
-		})
+		for _, c := range sess.clients.list() {
+			c.conn.Close()
+		}
 	}
 }
 
-func setPTYTerminal(s *server.SSHServer) func(*termproxy.Command) {
+func setPTYTerminal(sess *session) func(*termproxy.Command) {
 	return func(command *termproxy.Command) {
+		if *daemonFlag {
+			// nobody is attached yet, so the program starts at the size of its
+			// screen.
+			width, height := sess.hub.Screen.Size()
+			if err := command.Resize(termproxy.Winch{Width: uint(width), Height: uint(height)}); err != nil {
+				termproxy.ErrorOut("Could not set the terminal size of the PTY", err, termproxy.ErrTerminal)
+			}
+			return
+		}
+
 		ws, err := termproxy.GetWinsize(0)
 		if err != nil {
 			termproxy.ErrorOut("Could not retrieve the terminal dimensions", err, termproxy.ErrTerminal)
 		}
 
-		compareAndSetWinsize("localhost", ws, command, s)
+		sess.setWinsize("localhost", ws)
 
-		if err := termproxy.SetWinsize(command.PTY().Fd(), ws); err != nil {
+		if err := command.Resize(ws); err != nil {
 			termproxy.ErrorOut("Could not set the terminal size of the PTY", err, termproxy.ErrTerminal)
 		}
 	}
 }
 
-func handleWinch(s *server.SSHServer) func(*termproxy.Command) {
+func handleWinch(sess *session) func(*termproxy.Command) {
 	return func(command *termproxy.Command) {
 		ws, err := termproxy.GetWinsize(0)
 		if err != nil {
 			termproxy.ErrorOut("Could not retrieve the terminal size: %v", err, termproxy.ErrTerminal)
 		}
 
-		compareAndSetWinsize("localhost", ws, command, s)
+		sess.setWinsize("localhost", ws)
+	}
+}
+
+func overflowHandler(hub *termproxy.Hub) func(*termproxy.Subscriber, termproxy.OverflowPolicy) {
+	return func(sub *termproxy.Subscriber, policy termproxy.OverflowPolicy) {
+		conn, ok := sub.Writer().(net.Conn)
+		if !ok || !notify.Get() {
+			return
+		}
+
+		var action string
+		switch policy {
+		case termproxy.OverflowDisconnect:
+			action = "disconnected"
+		default:
+			action = "resynced"
+		}
+
+		stats := hub.Stats()
+		termproxy.WriteTop(hub.Overlay(), fmt.Sprintf("%s fell behind and was %s (%d times so far)\n", clientName(conn), action, stats.Overflows))
+	}
+}
+
+func resizeHandler(sess *session) func(*termproxy.Command, termproxy.Winch) {
+	return func(command *termproxy.Command, ws termproxy.Winch) {
+		width, height := sess.hub.Screen.Size()
+		changed := width != int(ws.Width) || height != int(ws.Height)
+
+		sess.hub.Screen.Resize(int(ws.Width), int(ws.Height))
+		sess.hub.Refit()
+
+		if sess.recorder != nil {
+			sess.recorder.Resize(int(ws.Width), int(ws.Height))
+		}
+
+		if changed {
+			events.emit(event{Type: "resize", Session: sess.name, Width: ws.Width, Height: ws.Height})
+		}
+	}
+}
+
+// clientName describes a connection in notifications: the user it logged in
+// as, and where from.
+func clientName(conn net.Conn) string {
+	if c, ok := conn.(*server.Conn); ok && c.User() != "" {
+		return fmt.Sprintf("%s (%s, %s)", c.User(), c.Role(), conn.RemoteAddr())
 	}
+
+	return conn.RemoteAddr().String()
+}
+
+// canWrite reports whether input from owner should reach the session's
+// program. The host's own terminal can always write.
+func canWrite(sess *session, owner interface{}) bool {
+	c, ok := owner.(*server.Conn)
+	if !ok {
+		return owner == os.Stdin || (!*readOnly && !sess.locked.Get())
+	}
+
+	if c.Role() == server.RoleHost {
+		return true
+	}
+
+	return c.Role().CanWrite() && !sess.locked.Get()
 }
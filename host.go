@@ -0,0 +1,181 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/erikh/termproxy/termproxy"
+)
+
+// host is the terminal termproxy was started from, or in daemon mode the one
+// attached over its socket. It watches, and types into, one session at a
+// time.
+type host struct {
+	writer   io.Writer
+	menu     *hostMenu
+	current  *session
+	out      *termproxy.Subscriber
+	attached net.Conn
+	mutex    sync.Mutex
+}
+
+var hostTerm = &host{writer: os.Stdout}
+
+func (h *host) session() *session {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.current
+}
+
+// output is the host's subscription to its session's output.
+func (h *host) output() *termproxy.Subscriber {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.out
+}
+
+// watching returns the host's subscription to sess, or nil if the host is
+// watching another session.
+func (h *host) watching(sess *session) *termproxy.Subscriber {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.current != sess {
+		return nil
+	}
+	return h.out
+}
+
+// attach switches the host's terminal to sess, which is painted straight away.
+func (h *host) attach(sess *session) {
+	h.mutex.Lock()
+	if h.current != nil {
+		h.current.hub.Unsubscribe(h.out)
+	}
+
+	h.current = sess
+	h.out = sess.hub.SubscribePolicy(h.writer, termproxy.OverflowResync)
+	h.mutex.Unlock()
+
+	sess.winsizeMutex.Lock()
+	sess.fitHost()
+	sess.winsizeMutex.Unlock()
+}
+
+// setWriter moves the host's view of its session to w.
+func (h *host) setWriter(w io.Writer) {
+	h.mutex.Lock()
+	h.writer = w
+	h.mutex.Unlock()
+
+	if h.menu != nil {
+		// a menu left open by the previous terminal goes with it.
+		h.menu.reset()
+	}
+
+	if sess := h.session(); sess != nil {
+		h.attach(sess)
+	}
+}
+
+// readInput passes the keys typed at the host's terminal to input.
+func (h *host) readInput() {
+	buf := make([]byte, 256)
+
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+
+		h.input(buf[:n])
+	}
+}
+
+// input passes the host's keys to the menu, and the rest to the program of
+// the session it is watching. Until it watches one they are dropped.
+func (h *host) input(buf []byte) {
+	sess := h.session()
+	if sess == nil {
+		return
+	}
+
+	if h.menu != nil {
+		buf = h.menu.Filter(buf)
+	}
+
+	sess.input.Write(sess.command.PTY(), os.Stdin, buf)
+}
+
+// serveAttached makes c, a terminal attached to the daemon's socket, the
+// host's terminal until it detaches. Whoever was attached before is detached.
+func (h *host) serveAttached(c net.Conn, programColors termproxy.ColorSupport) {
+	defer c.Close()
+
+	kind, payload, err := termproxy.ReadFrame(c)
+	if err != nil || kind != termproxy.FrameHello {
+		return
+	}
+
+	var w io.Writer = c
+	if colors := termproxy.TermColors(termproxy.ParseHello(payload)); colors < programColors {
+		w = termproxy.NewColorFilter(c, colors)
+	}
+
+	h.mutex.Lock()
+	previous := h.attached
+	h.attached = c
+	h.mutex.Unlock()
+
+	if previous != nil {
+		previous.Close()
+	}
+
+	h.setWriter(w)
+
+	for {
+		kind, payload, err := termproxy.ReadFrame(c)
+		if err != nil {
+			break
+		}
+
+		switch kind {
+		case termproxy.FrameInput:
+			h.input(payload)
+		case termproxy.FrameWinch:
+			if ws, err := termproxy.ParseWinch(payload); err == nil && ws.Width != 0 {
+				for _, sess := range sessions.list() {
+					sess.setWinsize("localhost", ws)
+				}
+			}
+		}
+	}
+
+	h.mutex.Lock()
+	current := h.attached == c
+	if current {
+		h.attached = nil
+	}
+	h.mutex.Unlock()
+
+	if current {
+		h.setWriter(ioutil.Discard)
+
+		for _, sess := range sessions.list() {
+			sess.forgetWinsize("localhost")
+		}
+	}
+}
+
+// detach disconnects the terminal attached to the daemon, if any.
+func (h *host) detach() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.attached != nil {
+		h.attached.Close()
+	}
+}
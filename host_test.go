@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erikh/termproxy/server"
+	"github.com/erikh/termproxy/termproxy"
+)
+
+func TestAttachBeforeSession(t *testing.T) {
+	h := &host{menu: &hostMenu{key: 2}}
+	h.menu.host = h
+
+	client, daemon := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		h.serveAttached(daemon, termproxy.Colors16)
+		close(done)
+	}()
+
+	// keys typed before there is a session, the menu's included, are
+	// dropped rather than sent nowhere.
+	termproxy.WriteFrame(client, termproxy.FrameHello, termproxy.HelloPayload("xterm", ""))
+	termproxy.WriteFrame(client, termproxy.FrameInput, []byte("ls\r"))
+	termproxy.WriteFrame(client, termproxy.FrameInput, []byte{2, 'q'})
+	client.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the attached terminal was not let go")
+	}
+}
+
+func TestMenuFitsHostTerminal(t *testing.T) {
+	key, _, err := server.GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cachedHostKey = key
+	defer func() { cachedHostKey = nil }()
+
+	daemon := false
+	daemonFlag = &daemon
+
+	// the session follows a larger terminal than the host's.
+	terminal := newTestConn(1)
+	h := &host{writer: terminal, menu: &hostMenu{key: 2}}
+	h.menu.host = h
+
+	sess := newTestSession("main", 120, 40)
+	h.attach(sess)
+	sess.hub.SetSize(h.output(), 30, 6)
+
+	h.menu.Filter([]byte{2})
+	defer h.menu.Filter([]byte{'q'})
+
+	line := regexp.MustCompile(`\x1b\[(\d+);1H\x1b\[0;7m\x1b\[2K(.*?)\x1b\[0m`)
+
+	var lines [][]string
+	waitFor(t, "the menu to be drawn", func() bool {
+		lines = line.FindAllStringSubmatch(terminal.String(), -1)
+		return len(lines) > 0
+	})
+
+	if lines[0][2] != "termproxy: main  (C-b to send " {
+		t.Fatalf("the menu's title was not cut to the host's terminal: %q", lines[0][2])
+	}
+
+	if lines[1][2] != "l  list clients" {
+		t.Fatalf("the menu's second line is %q", lines[1][2])
+	}
+
+	for _, l := range lines {
+		if row, _ := strconv.Atoi(l[1]); row > 6 {
+			t.Fatalf("the menu was drawn on row %d of a 6 row terminal: %q", row, l[2])
+		}
+
+		if len(l[2]) > 30 {
+			t.Fatalf("a line of the menu is wider than the host's terminal: %q", l[2])
+		}
+	}
+
+	if strings.Contains(terminal.String(), "host key:") {
+		t.Fatal("the menu was drawn past the bottom of the host's terminal")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/erikh/termproxy/server"
+	"github.com/erikh/termproxy/termproxy"
+	"golang.org/x/crypto/ssh"
+)
+
+// daemonHostKeyFD is the descriptor on which the background process started
+// by --daemon reads an ephemeral host key, which is then neither in anyone's
+// environment nor on disk.
+const daemonHostKeyFD = 3
+
+var (
+	cachedHostKey ssh.Signer
+	// daemonHostKey is the ephemeral host key to hand to the daemon.
+	daemonHostKey []byte
+)
+
+// stateDir is where termproxy keeps things between runs, such as its host key.
+func stateDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "termproxy")
+	}
+
+	return filepath.Join(os.Getenv("HOME"), ".local", "state", "termproxy")
+}
+
+// hostKey returns the key presented to clients: the one given with -k, a new
+// one with --ephemeral-host-key, or else one kept in the state directory,
+// which is made the first time it is needed.
+func hostKey() ssh.Signer {
+	if cachedHostKey != nil {
+		return cachedHostKey
+	}
+
+	var err error
+
+	switch {
+	case *ephemeralHostKeyFlag && os.Getenv(daemonEnv) != "":
+		cachedHostKey, err = readDaemonHostKey()
+	case *hostkeyFlag != "":
+		cachedHostKey, err = server.LoadHostKey(*hostkeyFlag)
+	case *ephemeralHostKeyFlag:
+		var encoded []byte
+		cachedHostKey, encoded, err = server.GenerateHostKey()
+		if *daemonFlag {
+			daemonHostKey = encoded
+		}
+	default:
+		cachedHostKey, err = cachedKey(filepath.Join(stateDir(), "host_key"))
+	}
+
+	if err != nil {
+		termproxy.ErrorOut("Could not load the host key", err, termproxy.ErrUsage)
+	}
+
+	return cachedHostKey
+}
+
+// readDaemonHostKey reads the ephemeral host key handed over by the process
+// which started the daemon.
+func readDaemonHostKey() (ssh.Signer, error) {
+	f := os.NewFile(daemonHostKeyFD, "host key")
+	defer f.Close()
+
+	encoded, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKey(encoded)
+}
+
+// cachedKey loads the host key kept in filename, making it if there is none.
+func cachedKey(filename string) (ssh.Signer, error) {
+	if _, err := os.Stat(filename); err == nil {
+		return server.LoadHostKey(filename)
+	}
+
+	key, encoded, err := server.GenerateHostKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(filename, encoded, 0600); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// hostKeyDescription is the host key's type and fingerprint, for guests to
+// check against what their SSH client shows them.
+func hostKeyDescription() string {
+	key := hostKey().PublicKey()
+	return fmt.Sprintf("%s %s", key.Type(), server.Fingerprint(key))
+}
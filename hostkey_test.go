@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/erikh/termproxy/server"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHostKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "termproxy-hostkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldState := os.Getenv("XDG_STATE_HOME")
+	os.Setenv("XDG_STATE_HOME", dir)
+	defer os.Setenv("XDG_STATE_HOME", oldState)
+
+	var (
+		keyFile   string
+		ephemeral bool
+		daemon    bool
+	)
+	hostkeyFlag, ephemeralHostKeyFlag, daemonFlag = &keyFile, &ephemeral, &daemon
+
+	load := func() ssh.PublicKey {
+		cachedHostKey, daemonHostKey = nil, nil
+		return hostKey().PublicKey()
+	}
+
+	same := func(a, b ssh.PublicKey) bool {
+		return bytes.Equal(a.Marshal(), b.Marshal())
+	}
+
+	// with nothing given, a key is made in the state directory and kept there.
+	kept := load()
+
+	stateKey := filepath.Join(dir, "termproxy", "host_key")
+	fi, err := os.Stat(stateKey)
+	if err != nil {
+		t.Fatalf("the host key was not kept in the state directory: %v", err)
+	}
+
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("the kept host key may be read by others: %v", fi.Mode())
+	}
+
+	if !same(load(), kept) {
+		t.Fatal("a second run did not present the kept host key")
+	}
+
+	// -k presents the key in the file given.
+	given, encoded, err := server.GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile = filepath.Join(dir, "given")
+	if err := ioutil.WriteFile(keyFile, encoded, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if !same(load(), given.PublicKey()) {
+		t.Fatal("-k did not present the key in the file given")
+	}
+	keyFile = ""
+
+	// --ephemeral-host-key makes a new key each run, and keeps none of them.
+	ephemeral = true
+	first, second := load(), load()
+	if same(first, second) || same(first, kept) {
+		t.Fatal("--ephemeral-host-key presented a key twice")
+	}
+
+	if daemonHostKey != nil {
+		t.Fatal("an ephemeral key was set aside for a daemon which was not asked for")
+	}
+
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "termproxy")); len(files) != 1 {
+		t.Fatalf("an ephemeral key was written to the state directory: %v", files)
+	}
+
+	// a daemon is handed the same key the starting process presents.
+	daemon = true
+	key := load()
+	handed, err := ssh.ParsePrivateKey(daemonHostKey)
+	if err != nil {
+		t.Fatalf("the key set aside for the daemon does not parse: %v", err)
+	}
+
+	if !same(handed.PublicKey(), key) {
+		t.Fatal("the daemon would be handed a different key than was printed")
+	}
+
+	// guests are shown the key's type and its fingerprint, as OpenSSH writes it.
+	sum := sha256.Sum256(key.Marshal())
+	want := "ecdsa-sha2-nistp256 SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+	if description := hostKeyDescription(); description != want {
+		t.Fatalf("the host key is described as %q, not %q", description, want)
+	}
+
+	cachedHostKey, daemonHostKey = nil, nil
+}
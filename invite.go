@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/erikh/termproxy/server"
+	"github.com/erikh/termproxy/termproxy"
+	"github.com/jawher/mow.cli"
+)
+
+// defaultInviteTTL is how long an invite lasts unless told otherwise.
+const defaultInviteTTL = 30 * time.Minute
+
+// invites are the tokens handed out by the host, which anyone may log in with
+// once.
+var invites = server.NewInvites()
+
+type inviteInfo struct {
+	Token   string    `json:"token"`
+	Guest   string    `json:"guest"`
+	Role    string    `json:"role"`
+	Expires time.Time `json:"expires"`
+	Login   string    `json:"login"`
+}
+
+// mintInvite makes an invite for role lasting ttl. Invites cannot make hosts.
+func mintInvite(role server.Role, ttl time.Duration) (inviteInfo, error) {
+	token, inv, err := invites.Mint(role, ttl)
+	if err != nil {
+		return inviteInfo{}, err
+	}
+
+	events.emit(event{Type: "invite", Role: role.String()})
+
+	host, port, err := net.SplitHostPort(*listenSpec)
+	if err != nil || host == "" || host == "0.0.0.0" || host == "::" {
+		host = "<host>"
+	}
+
+	return inviteInfo{
+		Token:   token,
+		Guest:   inv.Guest,
+		Role:    role.String(),
+		Expires: inv.Expires,
+		Login:   fmt.Sprintf("ssh -p %s %s@%s", port, token, host),
+	}, nil
+}
+
+func inviteCommand(cmd *cli.Cmd) {
+	role := cmd.StringOpt("role", "read-write", "Role of whoever uses the invite: 'read-only' or 'read-write'")
+	ttl := cmd.StringOpt("ttl", defaultInviteTTL.String(), "How long the invite lasts if it is not used")
+	socket := cmd.StringOpt("control-socket", "", "Control socket of the termproxy to invite to; by default NAME.sock in termproxy's runtime directory")
+
+	cmd.Action = func() {
+		invite(controlSocket(*socket), *role, *ttl)
+	}
+}
+
+// invite asks the termproxy listening on socket for an invite, and prints it.
+func invite(socket, role, ttl string) {
+	if r, err := server.ParseRole(role); err != nil {
+		termproxy.ErrorOut("Invalid role", err, termproxy.ErrUsage)
+	} else if r == server.RoleHost {
+		termproxy.ErrorOut("Invalid role", fmt.Errorf("invites cannot make hosts"), termproxy.ErrUsage)
+	}
+
+	if _, err := time.ParseDuration(ttl); err != nil {
+		termproxy.ErrorOut("Invalid TTL", err, termproxy.ErrUsage)
+	}
+
+	var info inviteInfo
+	if err := callControl(socket, "invite", map[string]string{"role": role, "ttl": ttl}, &info); err != nil {
+		termproxy.ErrorOut("Could not make an invite", err, termproxy.ErrUsage)
+	}
+
+	fmt.Printf("%s (%s, %s, until %s)\n", info.Token, info.Guest, info.Role, info.Expires.Format("15:04"))
+	fmt.Printf("log in with: %s\n", info.Login)
+}
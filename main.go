@@ -1,11 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/erikh/termproxy/server"
@@ -13,155 +14,321 @@ import (
 	"github.com/jawher/mow.cli"
 )
 
-const TIME_WAIT = 10 * time.Millisecond
-
 var (
-	listenSpec, usernameFlag, passwordFlag, hostkeyFlag, authorizedKeysFlag *string
-	readOnly, notifications                                                 *bool
+	listenSpec, usernameFlag, passwordFlag, hostkeyFlag, keysRefreshFlag                      *string
+	lagPolicyFlag, resizePolicyFlag, recordFlag, usersFlag, prefixKeyFlag, termFlag, nameFlag *string
+	socketFlag, controlSocketFlag, eventsFileFlag, webhookFlag, userCAFlag                    *string
+	httpFlag, httpCertFlag, httpKeyFlag, httpAssetsFlag, telnetFlag, telnetRoleFlag           *string
+	sessionFlag, hookFlag, authorizedKeysFlag                                                 *[]string
+	highWater                                                                                 *int
+	readOnly, notifications, controlFlag, daemonFlag, ephemeralHostKeyFlag                    *bool
+	reloadDisconnectFlag                                                                      *bool
 )
 
 func main() {
 	tp := cli.App("termproxy", "Proxy your terminal over SSH to others")
-
-	usernameFlag = tp.StringOpt("u username", "scott", "Username for SSH")
-	passwordFlag = tp.StringOpt("p password", "tiger", "Password for SSH (set to '' to disable)")
-	hostkeyFlag = tp.StringOpt("k host-key", os.ExpandEnv("${HOME}/.ssh/id_rsa"), "SSH private host key to present to clients")
-	authorizedKeysFlag = tp.StringOpt("a authorized-keys", "", "SSH authorized hosts for public key authentication")
-	readOnly = tp.BoolOpt("r read-only", false, "Disallow remote clients from entering input")
-	notifications = tp.BoolOpt("n notifications", true, "Print notifications on connection and disconnection")
-	listenSpec = tp.StringOpt("l listen", "0.0.0.0:1234", "The host:port to listen for SSH")
-
+	opts := loadOptions(tp, os.Args[1:])
+
+	usernameFlag = opts.StringOpt("u username", "scott", "Username for the shared password given with -p")
+	passwordFlag = opts.PasswordOpt("p password", "", "Password shared by everyone for SSH; by default there is none, and guests log in with invites")
+	hostkeyFlag = opts.StringOpt("k host-key", "", "SSH private host key to present to clients; by default one is made and kept in termproxy's state directory")
+	ephemeralHostKeyFlag = opts.BoolOpt("ephemeral-host-key", false, "Present a new host key each run instead of keeping one")
+	authorizedKeysFlag = opts.StringsOpt("a authorized-keys", nil, "Public keys which may log in: an authorized_keys file, a directory of USER.pub files or a key listing URL such as https://github.com/USER.keys (may be repeated)")
+	reloadDisconnectFlag = opts.BoolOpt("reload-disconnect", false, "When termproxy is sent SIGHUP to reload the logins, disconnect clients whose logins no longer work")
+	keysRefreshFlag = opts.StringOpt("keys-refresh", "5m", "How often to read the -a keys again, fetching listings anew")
+	userCAFlag = opts.StringOpt("user-ca", "", "SSH certificate authorities, one public key per line, whose user certificates may log in")
+	usersFlag = opts.StringOpt("users", "", "File giving users their own keys or passwords and roles")
+	readOnly = opts.BoolOpt("r read-only", false, "Disallow clients using the shared login or authorized keys from entering input")
+	controlFlag = opts.BoolOpt("c control", false, "Let one person type at a time; others ask for control with Ctrl-] c")
+	notifications = opts.BoolOpt("n notifications", true, "Print notifications on connection and disconnection")
+	prefixKeyFlag = opts.StringOpt("prefix-key", "C-b", "Key which opens the host menu, such as C-b or ^A ('' to disable)")
+	termFlag = opts.StringOpt("t term", "", "TERM for the program; by default one suiting your terminal is picked")
+	listenSpec = opts.StringOpt("l listen", "0.0.0.0:1234", "The host:port to listen for SSH")
+	highWater = opts.IntOpt("high-water", termproxy.DefaultHighWater, "Bytes of output a client may fall behind before the lag policy applies")
+	lagPolicyFlag = opts.StringOpt("lag-policy", "resync", "What to do with clients that fall behind: 'resync' or 'disconnect'")
+	resizePolicyFlag = opts.StringOpt("resize-policy", "smallest", "Whose terminal the program's size follows: 'smallest', 'largest', 'host', 'driver' (with -c) or 'active' (whoever typed last)")
+	httpFlag = opts.StringOpt("http", "", "Also serve a terminal to browsers on this host:port, logging in with the same passwords")
+	httpCertFlag = opts.StringOpt("http-cert", "", "TLS certificate for --http, which is then served over HTTPS")
+	httpKeyFlag = opts.StringOpt("http-key", "", "TLS private key for --http-cert")
+	httpAssetsFlag = opts.StringOpt("http-assets", "", "Directory holding xterm.js, xterm.css and xterm-addon-fit.js for --http, instead of loading them from a CDN")
+	telnetFlag = opts.StringOpt("telnet", "", "Also stream the session to nc and telnet users on this host:port, without authentication")
+	telnetRoleFlag = opts.StringOpt("telnet-role", "read-only", "Role of --telnet users: 'read-only' or 'read-write'")
+	recordFlag = opts.StringOpt("record", "", "Record the first session to this file in asciicast v2 format")
+	nameFlag = opts.StringOpt("name", "main", "Name of the session running COMMAND")
+	daemonFlag = opts.BoolOpt("d daemon", false, "Run in the background without a terminal; attach to it with 'termproxy attach'")
+	socketFlag = opts.StringOpt("S socket", defaultSocket(), "Unix socket a daemon listens on for 'termproxy attach'")
+	controlSocketFlag = opts.StringOpt("control-socket", "", "Unix socket for the JSON-RPC control API; by default NAME.sock in termproxy's runtime directory ('off' to disable)")
+	eventsFileFlag = opts.StringOpt("events-file", "", "Append events, such as connections and resizes, to this file as JSON lines")
+	webhookFlag = opts.StringOpt("webhook", "", "POST each event as JSON to this URL")
+	hookFlag = opts.StringsOpt("hook", nil, "Run this shell command for each event, described in TERMPROXY_* environment variables (may be repeated)")
+	sessionFlag = opts.StringsOpt("session", nil, "Run another session, given as NAME=COMMAND (may be repeated)")
+	opts.check()
+
+	tp.Spec = "[OPTIONS] [COMMAND]"
 	command := tp.StringArg("COMMAND", "/bin/sh", "The program to run inside termproxy")
 
 	tp.Action = func() {
-		if *authorizedKeysFlag == "" && *passwordFlag == "" {
-			termproxy.ErrorOut("Invalid flag combination: authorized keys or password must be non-nil", nil, termproxy.ErrUsage)
+		checkServerFlags()
+		fmt.Printf("SSH host key: %s\n", hostKeyDescription())
+
+		if *daemonFlag && os.Getenv(daemonEnv) == "" {
+			startDaemon(*socketFlag)
+			return
 		}
+
 		serve(*listenSpec, *command)
 	}
 
+	tp.Command("play", "Play back a session recorded with --record", playCommand)
+	tp.Command("attach", "Attach to a termproxy started with --daemon", attachCommand)
+	tp.Command("invite", "Make a single-use login for a running termproxy", inviteCommand)
+	tp.Command("reload", "Read the logins of a running termproxy again", reloadCommand)
+
 	tp.Run(os.Args)
 }
 
-func setCommand(cmd string, s *server.SSHServer) *termproxy.Command {
+func checkServerFlags() {
+	if interval, err := time.ParseDuration(*keysRefreshFlag); err != nil || interval <= 0 {
+		termproxy.ErrorOut("Invalid keys refresh interval", fmt.Errorf("%q is not a duration such as 5m", *keysRefreshFlag), termproxy.ErrUsage)
+	}
+
+	if _, err := termproxy.ParseOverflowPolicy(*lagPolicyFlag); err != nil {
+		termproxy.ErrorOut("Invalid lag policy", err, termproxy.ErrUsage)
+	}
+
+	if _, err := termproxy.ParseResizePolicy(*resizePolicyFlag); err != nil {
+		termproxy.ErrorOut("Invalid resize policy", err, termproxy.ErrUsage)
+	}
+
+	if _, err := parsePrefixKey(*prefixKeyFlag); err != nil {
+		termproxy.ErrorOut("Invalid prefix key", err, termproxy.ErrUsage)
+	}
+
+	if (*httpCertFlag == "") != (*httpKeyFlag == "") {
+		termproxy.ErrorOut("Invalid flag combination: --http-cert and --http-key go together", nil, termproxy.ErrUsage)
+	}
+
+	if *ephemeralHostKeyFlag && *hostkeyFlag != "" {
+		termproxy.ErrorOut("Invalid flag combination: --ephemeral-host-key makes a key, so it cannot be given one with -k", nil, termproxy.ErrUsage)
+	}
+
+	if *httpAssetsFlag != "" {
+		if err := server.CheckWebAssets(*httpAssetsFlag); err != nil {
+			termproxy.ErrorOut("Invalid --http-assets", err, termproxy.ErrUsage)
+		}
+	}
+
+	if role, err := server.ParseRole(*telnetRoleFlag); err != nil || role == server.RoleHost {
+		termproxy.ErrorOut("Invalid telnet role", fmt.Errorf("%q is not read-only or read-write", *telnetRoleFlag), termproxy.ErrUsage)
+	}
+
+	if *nameFlag == "" || strings.ContainsAny(*nameFlag, "+ ") {
+		termproxy.ErrorOut("Invalid session name", fmt.Errorf("%q must be non-empty, without '+' or spaces", *nameFlag), termproxy.ErrUsage)
+	}
+
+	names := map[string]bool{*nameFlag: true}
+	for _, spec := range *sessionFlag {
+		name, _, err := parseSessionFlag(spec)
+		if err != nil {
+			termproxy.ErrorOut("Invalid session", err, termproxy.ErrUsage)
+		}
+
+		if names[name] {
+			termproxy.ErrorOut("Invalid session", fmt.Errorf("the name %q is used twice", name), termproxy.ErrUsage)
+		}
+		names[name] = true
+	}
+}
+
+func setCommand(cmd string, sess *session) *termproxy.Command {
 	command := termproxy.NewCommand(cmd)
-	command.CloseHandler = closeHandler(s)
-	command.PTYSetupHandler = setPTYTerminal(s)
-	command.WinchHandler = handleWinch(s)
+	command.CloseHandler = closeHandler(sess)
+	command.PTYSetupHandler = setPTYTerminal(sess)
+	if !*daemonFlag {
+		command.WinchHandler = handleWinch(sess)
+	}
+	command.ResizeHandler = resizeHandler(sess)
 
 	return command
 }
 
-func launch(command *termproxy.Command) {
-	if err := command.Run(); err != nil {
+func launch(sess *session) {
+	if err := sess.command.Run(); err != nil {
 		if err != nil {
-			termproxy.ErrorOut(fmt.Sprintf("Could not start program %s", command.String()), err, termproxy.ErrCommand)
+			termproxy.ErrorOut(fmt.Sprintf("Could not start program %s", sess.command.String()), err, termproxy.ErrCommand)
 		}
 	}
 
-	termproxy.ErrorOut("Shell Exited!", nil, 0)
+	status := sess.command.ExitStatus()
+	events.emit(event{Type: "exit", Session: sess.name, Status: &status})
+
+	if sessions.remove(sess) == 0 {
+		stopSinks()
+		termproxy.ErrorOut("Shell Exited!", nil, 0)
+	}
+
+	// other sessions are still running; move the host to one of them.
+	if hostTerm.session() == sess {
+		next := sessions.list()[0]
+		hostTerm.attach(next)
+		termproxy.WriteTop(hostTerm.writer, fmt.Sprintf("Session %s exited; now watching %s\n", sess.name, next.name))
+	}
 }
 
 func serve(listenSpec string, cmd string) {
-	termproxy.MakeRaw(0)
-	os.Setenv("TERM", "screen-256color")
+	hostColors := termproxy.TermColors(os.Getenv("TERM"), os.Getenv("COLORTERM"))
 
-	s, err := server.NewSSHServer(listenSpec, *usernameFlag, *passwordFlag, *authorizedKeysFlag, *hostkeyFlag)
+	if !*daemonFlag {
+		termproxy.MakeRaw(0)
+	}
+	programColors := setProgramTerm()
+
+	auth := serverAuth()
+	s, err := server.NewSSHServer(listenSpec, auth, hostKey())
 
 	if err != nil {
 		termproxy.ErrorOut(fmt.Sprintf("Network Error trying to listen on %s", listenSpec), err, termproxy.ErrNetwork)
 	}
 
-	command := setCommand(cmd, s)
-	go launch(command)
-
-	input := new(bytes.Buffer)
-	output := new(bytes.Buffer)
-
-	ptyCopier := termproxy.NewCopier()
-	ptyCopier.Handler = func(buf []byte, w io.Writer, r io.Reader) ([]byte, error) {
-		input.Reset()
-		return buf, nil
+	var web *server.WebServer
+	if *httpFlag != "" {
+		web, err = server.NewWebServer(*httpFlag, auth, *httpCertFlag, *httpKeyFlag)
+		if err != nil {
+			termproxy.ErrorOut(fmt.Sprintf("Could not serve the browser terminal on %s", *httpFlag), err, termproxy.ErrNetwork)
+		}
+		web.AssetsDir = *httpAssetsFlag
 	}
 
-	outputCopier := termproxy.NewCopier()
-	inputCopier := termproxy.NewCopier()
+	var telnet *server.TelnetServer
+	if *telnetFlag != "" {
+		role, _ := server.ParseRole(*telnetRoleFlag)
+		telnet, err = server.NewTelnetServer(*telnetFlag, role)
+		if err != nil {
+			termproxy.ErrorOut(fmt.Sprintf("Network Error trying to listen on %s", *telnetFlag), err, termproxy.ErrNetwork)
+		}
+	}
 
-	go inputCopier.Copy(input, os.Stdin)
-	go writeOutputPty(outputCopier, output, command)
-	go writePtyInput(ptyCopier, input, command)
-	go writePtyOutput(output, s)
+	var ws termproxy.Winch
 
-	s.AcceptHandler = func(c net.Conn) {
-		c.Write([]byte("Connected to server (the screen will update on next output)\n"))
+	// the menu is ready before anyone can attach and use it.
+	if prefixKey, _ := parsePrefixKey(*prefixKeyFlag); prefixKey != 0 {
+		hostTerm.menu = &hostMenu{key: prefixKey, host: hostTerm}
+	}
 
-		if *notifications {
-			termproxy.WriteTop(output, fmt.Sprintf("%s connected\n", c.RemoteAddr().String()))
-			time.Sleep(1 * time.Second)
-			termproxy.WriteTop(output, string([]byte{27, '[', 'K'}))
+	if *daemonFlag {
+		// programs start at a conventional size until someone attaches.
+		ws = termproxy.Winch{Width: 80, Height: 24}
+		hostTerm.writer = ioutil.Discard
+	} else {
+		ws, err = termproxy.GetWinsize(0)
+		if err != nil {
+			termproxy.ErrorOut("Could not retrieve the terminal dimensions", err, termproxy.ErrTerminal)
 		}
 
-		if !*readOnly {
-			inputCopier.Copy(input, c)
+		if hostColors < programColors {
+			hostTerm.writer = termproxy.NewColorFilter(os.Stdout, hostColors)
 		}
 	}
 
-	s.CloseHandler = func(conn net.Conn) {
-		winsizeMutex.Lock()
-		delete(connectionWinsizeMap, conn.RemoteAddr().String())
-		winsizeMutex.Unlock()
+	notify.Set(*notifications)
+	startSinks()
+
+	first := startSession(*nameFlag, cmd, ws, programColors, *recordFlag)
+	for _, spec := range *sessionFlag {
+		name, command, _ := parseSessionFlag(spec)
+		startSession(name, command, ws, programColors, "")
+	}
+
+	hostTerm.attach(first)
 
-		if *notifications {
-			termproxy.WriteTop(output, fmt.Sprintf("%s disconnected\n", conn.RemoteAddr().String()))
+	// terminals attach to the daemon once there is a session to show them.
+	if *daemonFlag {
+		listenAttach(*socketFlag, programColors)
+	}
+
+	switch *controlSocketFlag {
+	case "off":
+	case "":
+		socket := defaultControlSocket()
+		if socketInUse(socket) {
+			// another termproxy has a session of the same name.
+			socket = filepath.Join(runtimeDir(), fmt.Sprintf("%s-%d.sock", *nameFlag, os.Getpid()))
 		}
+		listenControl(socket)
+	default:
+		listenControl(*controlSocketFlag)
+	}
+	if !*daemonFlag {
+		go hostTerm.readInput()
 	}
 
-	go func() {
-		for {
-			myWinch := <-s.InWinch
-			compareAndSetWinsize(myWinch.Conn.RemoteAddr().String(), myWinch, command, s)
+	s.AcceptHandler = func(c net.Conn) {
+		sess := pickSession(c)
+		if sess == nil {
+			c.Close()
+			return
 		}
-	}()
 
-	s.Listen()
+		sess.join(c)
+	}
 
-	termproxy.ErrorOut("Shell Exited!", nil, 0)
-}
+	s.ExecHandler = execHandler(sessions)
 
-func writeOutputPty(outputCopier *termproxy.Copier, output *bytes.Buffer, command *termproxy.Command) {
-	for {
-		if err := outputCopier.Copy(output, command.PTY()); err != nil {
-			continue
+	s.AuthHandler = func(addr net.Addr, user string, role server.Role, err error) {
+		if err != nil {
+			events.emit(event{Type: "auth-failed", Address: addr.String(), User: user, Error: err.Error()})
+			return
 		}
-		time.Sleep(TIME_WAIT)
+
+		events.emit(event{Type: "auth", Address: addr.String(), User: user, Role: role.String()})
 	}
-}
 
-func writePtyInput(ptyCopier *termproxy.Copier, input *bytes.Buffer, command *termproxy.Command) {
-	for {
-		if input.Len() == 0 {
-			time.Sleep(TIME_WAIT)
-			continue
+	s.CloseHandler = func(conn net.Conn) {
+		if sess := sessions.leave(conn); sess != nil {
+			sess.leave(conn)
 		}
+	}
 
-		ptyCopier.Copy(command.PTY(), input)
+	authServers = append(authServers, s)
+
+	if web != nil {
+		authServers = append(authServers, web)
+		web.AcceptHandler = s.AcceptHandler
+		web.CloseHandler = s.CloseHandler
+		web.AuthHandler = s.AuthHandler
+		web.InWinch = s.InWinch
+
+		go func() {
+			if err := web.Listen(); err != nil {
+				termproxy.ErrorOut("The browser terminal stopped", err, termproxy.ErrNetwork)
+			}
+		}()
 	}
-}
 
-func writePtyOutput(output *bytes.Buffer, t *server.SSHServer) {
-	for {
-		if output.Len() == 0 {
-			time.Sleep(TIME_WAIT)
-			continue
-		}
+	if telnet != nil {
+		telnet.AcceptHandler = s.AcceptHandler
+		telnet.CloseHandler = s.CloseHandler
+		telnet.InWinch = s.InWinch
 
-		buf := output.Bytes()
+		go telnet.Listen()
+	}
 
-		if _, err := os.Stdout.Write(buf); err != nil {
-			break
+	handleReload()
+
+	go func() {
+		for {
+			myWinch := <-s.InWinch
+			if sess := sessions.of(myWinch.Conn); sess != nil {
+				e := clientEvent("window-change", sess, myWinch.Conn)
+				e.Width, e.Height = myWinch.Width, myWinch.Height
+				events.emit(e)
+
+				sess.setWinsize(myWinch.Conn.RemoteAddr().String(), myWinch)
+			}
 		}
+	}()
 
-		t.MultiCopy(buf)
-		output.Reset()
-	}
+	s.Listen()
+
+	termproxy.ErrorOut("Shell Exited!", nil, 0)
 }
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/erikh/termproxy/server"
+	"github.com/erikh/termproxy/termproxy"
+)
+
+// toggle is a setting which the host may flip while the session runs.
+type toggle struct {
+	on    bool
+	mutex sync.Mutex
+}
+
+func (t *toggle) Get() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.on
+}
+
+func (t *toggle) Set(on bool) {
+	t.mutex.Lock()
+	t.on = on
+	t.mutex.Unlock()
+}
+
+// Flip inverts the setting and returns its new value.
+func (t *toggle) Flip() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.on = !t.on
+	return t.on
+}
+
+// notify says whether connections and disconnections are announced.
+var notify toggle
+
+// parsePrefixKey converts "C-b" or "^B" into the control character they name.
+// Any other single character stands for itself, and an empty string for no key.
+func parsePrefixKey(spec string) (byte, error) {
+	switch {
+	case spec == "":
+		return 0, nil
+	case len(spec) == 1:
+		return spec[0], nil
+	case len(spec) == 2 && spec[0] == '^', len(spec) == 3 && strings.HasPrefix(spec, "C-"):
+		c := spec[len(spec)-1]
+		if c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		if c < '@' || c > '_' {
+			return 0, fmt.Errorf("there is no control key for %q", c)
+		}
+		return c & 0x1f, nil
+	}
+
+	return 0, fmt.Errorf("cannot understand prefix key %q", spec)
+}
+
+// keyName is the inverse of parsePrefixKey.
+func keyName(key byte) string {
+	if key >= 0x20 {
+		return string(rune(key))
+	}
+
+	c := key + '@'
+	if c >= 'A' && c <= 'Z' {
+		c += 'a' - 'A'
+	}
+	return "C-" + string(rune(c))
+}
+
+type menuView int
+
+const (
+	menuClosed menuView = iota
+	menuMain
+	menuList
+	menuKick
+	menuSessions
+	menuInvite
+	menuInvited
+)
+
+// hostMenu is opened by the host with the prefix key. While it is open the
+// host's keys drive the menu instead of the program, and the program's output
+// to the host's terminal is held back; it is repainted when the menu closes.
+type hostMenu struct {
+	key  byte
+	host *host
+
+	// view and invite, the last invite made, shown until a key is pressed,
+	// are guarded by mutex.
+	mutex  sync.Mutex
+	view   menuView
+	invite inviteInfo
+}
+
+// Filter takes the host's input and returns what should reach the program.
+func (m *hostMenu) Filter(buf []byte) []byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	out := make([]byte, 0, len(buf))
+
+	for i, b := range buf {
+		if m.view == menuClosed {
+			if b == m.key {
+				m.open()
+			} else {
+				out = append(out, b)
+			}
+			continue
+		}
+
+		if b == m.key {
+			out = append(out, b)
+			m.close()
+			continue
+		}
+
+		if b == 27 {
+			// the rest of an escape sequence, such as an arrow key, is dropped
+			// with it.
+			m.close()
+			return out
+		}
+
+		m.keypress(b)
+
+		if m.view == menuClosed {
+			return append(out, buf[i+1:]...)
+		}
+	}
+
+	return out
+}
+
+// reset closes the menu without repainting, as the terminal it was drawn on
+// has gone.
+func (m *hostMenu) reset() {
+	m.mutex.Lock()
+	m.view = menuClosed
+	m.mutex.Unlock()
+}
+
+func (m *hostMenu) open() {
+	m.host.session().hub.Pause(m.host.output())
+	m.view = menuMain
+	m.draw()
+}
+
+func (m *hostMenu) close() {
+	m.view = menuClosed
+	m.host.session().hub.Resume(m.host.output())
+}
+
+func (m *hostMenu) keypress(b byte) {
+	sess := m.host.session()
+
+	switch m.view {
+	case menuList:
+		m.view = menuMain
+	case menuKick:
+		m.view = menuMain
+		clients := sess.clients.list()
+		if i := int(b - '1'); b >= '1' && b <= '9' && i < len(clients) {
+			sess.kick(clients[i].conn)
+		}
+	case menuInvite:
+		m.view = menuMain
+		if role, ok := map[byte]server.Role{'o': server.RoleReadOnly, 'w': server.RoleReadWrite}[b]; ok {
+			if invite, err := mintInvite(role, defaultInviteTTL); err == nil {
+				m.invite = invite
+				m.view = menuInvited
+			}
+		}
+	case menuInvited:
+		m.view = menuMain
+	case menuSessions:
+		m.view = menuMain
+		list := sessions.list()
+		if i := int(b - '1'); b >= '1' && b <= '9' && i < len(list) {
+			m.close()
+			m.host.attach(list[i])
+			return
+		}
+	case menuMain:
+		switch b {
+		case 'q':
+			m.close()
+			return
+		case 'l':
+			m.view = menuList
+		case 'k':
+			m.view = menuKick
+		case 's':
+			m.view = menuSessions
+		case 'i':
+			m.view = menuInvite
+		case 'r':
+			sess.setLocked(!sess.locked.Get())
+		case 'n':
+			notify.Flip()
+		case 'p':
+			sess.setPaused(!sess.clients.isPaused())
+		case 'z':
+			sess.setResizePolicy(nextResizePolicy(sess.getResizePolicy()))
+		case 'c', 'g':
+			if sess.control == nil {
+				return
+			}
+			controlHandler(sess)(os.Stdin, b)
+		case 'd':
+			if !*daemonFlag {
+				return
+			}
+			m.close()
+			m.host.detach()
+			return
+		default:
+			return
+		}
+	}
+
+	m.draw()
+}
+
+func (m *hostMenu) draw() {
+	var lines []string
+
+	sess := m.host.session()
+
+	onOff := func(on bool) string {
+		if on {
+			return "on"
+		}
+		return "off"
+	}
+
+	switch m.view {
+	case menuMain:
+		lines = []string{
+			fmt.Sprintf("termproxy: %s  (%s to send %s, q to close)", sess.name, keyName(m.key), keyName(m.key)),
+			"l  list clients",
+			"k  disconnect a client",
+			fmt.Sprintf("s  switch session (%d running)", len(sessions.list())),
+			fmt.Sprintf("i  invite someone (%d unused)", invites.Pending()),
+			fmt.Sprintf("r  read-only for everyone: %s", onOff(sess.locked.Get())),
+			fmt.Sprintf("n  notifications: %s", onOff(notify.Get())),
+			fmt.Sprintf("p  pause broadcasting: %s", onOff(sess.clients.isPaused())),
+			fmt.Sprintf("z  size follows: %s", policyDescription(sess.getResizePolicy())),
+		}
+
+		if sess.control != nil {
+			lines = append(lines,
+				fmt.Sprintf("c  take control (driving: %s)", ownerName(sess.control.Driver())),
+				fmt.Sprintf("g  grant control (%d waiting)", len(sess.control.Requests())),
+			)
+		}
+
+		if *daemonFlag {
+			lines = append(lines, "d  detach, leaving the sessions running")
+		}
+
+		lines = append(lines, "", "host key: "+hostKeyDescription())
+	case menuInvite:
+		lines = []string{
+			fmt.Sprintf("invite someone for %s as:  (any other key to go back)", defaultInviteTTL),
+			"o  read-only",
+			"w  read-write",
+		}
+	case menuInvited:
+		lines = []string{
+			fmt.Sprintf("invite: %s  (%s, %s, until %s; any key to go back)", m.invite.Token, m.invite.Guest, m.invite.Role, m.invite.Expires.Format("15:04")),
+			"log in with: " + m.invite.Login,
+			"or give it as the password when logging in",
+		}
+	case menuSessions:
+		lines = append(lines, "switch to which session?  (any other key to go back)")
+
+		for i, other := range sessions.list() {
+			if i >= 9 {
+				break
+			}
+
+			line := fmt.Sprintf("%d  %s: %s, %d watching", i+1, other.name, other.command.String(), len(other.clients.list()))
+			if other == sess {
+				line += " (current)"
+			}
+			lines = append(lines, line)
+		}
+	case menuList, menuKick:
+		clients := sess.clients.list()
+
+		if m.view == menuList {
+			lines = append(lines, fmt.Sprintf("%d clients connected  (any key to go back)", len(clients)))
+		} else {
+			lines = append(lines, "disconnect which client?  (any other key to go back)")
+		}
+
+		for i, c := range clients {
+			// only the first nine clients can be picked with a single key.
+			label := " "
+			if i < 9 {
+				label = strconv.Itoa(i + 1)
+			}
+
+			line := fmt.Sprintf("%s  %s for %s", label, clientName(c.conn), time.Since(c.since)/time.Second*time.Second)
+			if conn, ok := c.conn.(*server.Conn); ok && conn.PTYRequest().Term != "" {
+				line += ", " + conn.PTYRequest().Term
+			}
+			if sess.control != nil && sess.control.IsDriver(c.conn) {
+				line += ", driving"
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	// the menu fits the host's terminal, which may be smaller than the
+	// session when the session follows someone else's.
+	width, height := m.host.output().Size()
+	if width == 0 || height == 0 {
+		width, height = sess.hub.Screen.Size()
+	}
+
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+
+	// the menu is drawn over a fresh paint of the screen, so that nothing is
+	// left of a longer view drawn before it.
+	buf := bytes.NewBuffer(sess.hub.PaintFor(m.host.output()))
+	buf.WriteString("\x1b[?6l\x1b(B\x0f")
+	for i, line := range lines {
+		fmt.Fprintf(buf, "\x1b[%d;1H\x1b[0;7m\x1b[2K%s\x1b[0m", i+1, termproxy.Truncate(line, width))
+	}
+
+	m.host.output().Push(buf.Bytes())
+}
+
+// nextResizePolicy is the policy after policy, cycling back to the first.
+func nextResizePolicy(policy termproxy.ResizePolicy) termproxy.ResizePolicy {
+	for i, p := range termproxy.ResizePolicies {
+		if p == policy {
+			return termproxy.ResizePolicies[(i+1)%len(termproxy.ResizePolicies)]
+		}
+	}
+
+	return termproxy.ResizeSmallest
+}
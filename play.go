@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/erikh/termproxy/server"
+	"github.com/erikh/termproxy/termproxy"
+	"github.com/jawher/mow.cli"
+)
+
+// seekStep is how far the arrow keys move playback.
+const seekStep = 5 * time.Second
+
+func playCommand(cmd *cli.Cmd) {
+	speedFlag := cmd.StringOpt("speed", "1", "Playback speed multiplier")
+	idleFlag := cmd.StringOpt("i idle-limit", "", "Limit pauses in the recording to this many seconds")
+	serveFlag := cmd.BoolOpt("s serve", false, "Also serve the playback over SSH, using the top-level listen and authentication options")
+	file := cmd.StringArg("FILE", "", "The recording to play")
+
+	cmd.Action = func() {
+		speed, err := strconv.ParseFloat(*speedFlag, 64)
+		if err != nil || speed <= 0 {
+			termproxy.ErrorOut(fmt.Sprintf("Invalid speed %q", *speedFlag), nil, termproxy.ErrUsage)
+		}
+
+		var idle time.Duration
+		if *idleFlag != "" {
+			seconds, err := strconv.ParseFloat(*idleFlag, 64)
+			if err != nil || seconds <= 0 {
+				termproxy.ErrorOut(fmt.Sprintf("Invalid idle limit %q", *idleFlag), nil, termproxy.ErrUsage)
+			}
+			idle = time.Duration(seconds * float64(time.Second))
+		}
+
+		if *serveFlag {
+			checkServerFlags()
+		}
+
+		play(*file, speed, idle, *serveFlag)
+	}
+}
+
+func play(filename string, speed float64, idle time.Duration, serveReplay bool) {
+	rec, err := termproxy.LoadRecording(filename)
+	if err != nil {
+		termproxy.ErrorOut(fmt.Sprintf("Could not load recording %s", filename), err, termproxy.ErrUsage)
+	}
+
+	if idle > 0 {
+		rec = rec.CapIdle(idle)
+	}
+
+	termproxy.MakeRaw(0)
+
+	hub := termproxy.NewHub()
+	hub.Screen = termproxy.NewScreen(rec.Width, rec.Height)
+	hub.HighWater = *highWater
+	hub.Policy, _ = termproxy.ParseOverflowPolicy(*lagPolicyFlag)
+	hub.SubscribePolicy(os.Stdout, termproxy.OverflowResync)
+
+	player := termproxy.NewPlayer(rec, hub)
+	player.Speed = speed
+	player.Hold = serveReplay
+	player.ResizeHandler = hub.Screen.Resize
+
+	if serveReplay {
+		s, err := server.NewSSHServer(*listenSpec, serverAuth(), hostKey())
+		if err != nil {
+			termproxy.ErrorOut(fmt.Sprintf("Network Error trying to listen on %s", *listenSpec), err, termproxy.ErrNetwork)
+		}
+
+		// viewers of a playback cannot affect it, so their input and window
+		// sizes are discarded.
+		s.AcceptHandler = func(c net.Conn) {
+			sub := hub.Subscribe(c)
+			defer hub.Unsubscribe(sub)
+			io.Copy(ioutil.Discard, c)
+		}
+
+		go func() {
+			for range s.InWinch {
+			}
+		}()
+
+		go s.Listen()
+	}
+
+	go playbackKeys(player)
+
+	player.Play()
+
+	termproxy.ErrorOut("Playback finished", nil, 0)
+}
+
+// playbackKeys controls the player from the local terminal: space pauses, the
+// arrow keys seek and q quits.
+func playbackKeys(player *termproxy.Player) {
+	buf := make([]byte, 32)
+
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			player.Quit()
+			return
+		}
+
+		switch key := string(buf[:n]); key {
+		case " ":
+			player.TogglePause()
+		case "\x1b[C", "\x1bOC", "l":
+			player.Seek(seekStep)
+		case "\x1b[D", "\x1bOD", "h":
+			player.Seek(-seekStep)
+		case "q", "\x03":
+			player.Quit()
+			return
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/erikh/termproxy/server"
+	"github.com/erikh/termproxy/termproxy"
+)
+
+// The control socket speaks JSON-RPC 2.0, one request per line. Methods that
+// act on a session take its name as "session", defaulting to the first:
+//
+//	sessions                                    list the sessions
+//	clients           {session}                 list the clients watching a session
+//	kick              {address}                 disconnect a client
+//	set_read_only     {session, read_only}      lock or unlock a session's input
+//	send              {session, text}           type text into a session as the host
+//	resize            {session, width, height}  resize a session's program
+//	set_resize_policy {session, policy}         choose whose terminal the size follows
+//	invite            {role, ttl}               make a single-use login token
+//	reload            {disconnect}              read the logins again
+//	subscribe                                   receive events as "event" notifications
+//	unsubscribe                                 stop receiving them
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcFailed         = -32000
+)
+
+type rpcRequest struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Method  string           `json:"method"`
+	Params  json.RawMessage  `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResult struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result"`
+}
+
+type rpcErrorResult struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Error   *rpcError        `json:"error"`
+}
+
+type rpcNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// rpcParams holds the parameters of every method; each uses the ones it needs.
+type rpcParams struct {
+	Session    string `json:"session"`
+	Address    string `json:"address"`
+	ReadOnly   *bool  `json:"read_only"`
+	Text       string `json:"text"`
+	Width      uint   `json:"width"`
+	Height     uint   `json:"height"`
+	Role       string `json:"role"`
+	TTL        string `json:"ttl"`
+	Disconnect bool   `json:"disconnect"`
+	Policy     string `json:"policy"`
+}
+
+type sessionInfo struct {
+	Name     string    `json:"name"`
+	Command  string    `json:"command"`
+	Width    int       `json:"width"`
+	Height   int       `json:"height"`
+	Clients  int       `json:"clients"`
+	ReadOnly bool      `json:"read_only"`
+	Paused   bool      `json:"paused"`
+	Driver   string    `json:"driver,omitempty"`
+	Resize   string    `json:"resize_policy"`
+	Started  time.Time `json:"started"`
+}
+
+type clientInfo struct {
+	Address string    `json:"address"`
+	User    string    `json:"user,omitempty"`
+	Role    string    `json:"role,omitempty"`
+	Session string    `json:"session"`
+	Width   uint      `json:"width"`
+	Height  uint      `json:"height"`
+	Term    string    `json:"term,omitempty"`
+	Since   time.Time `json:"since"`
+	Driving bool      `json:"driving"`
+}
+
+// defaultControlSocket is where the control socket goes without
+// --control-socket, named after the first session.
+func defaultControlSocket() string {
+	return filepath.Join(runtimeDir(), *nameFlag+".sock")
+}
+
+// controlSocket is the control socket a command talks to: the one it was
+// given, or else the one given to termproxy before the command's name, or
+// else the default.
+func controlSocket(socket string) string {
+	if socket != "" {
+		return socket
+	}
+
+	if *controlSocketFlag != "" && *controlSocketFlag != "off" {
+		return *controlSocketFlag
+	}
+
+	return defaultControlSocket()
+}
+
+// listenControl serves the JSON-RPC control API on socket.
+func listenControl(socket string) {
+	l := listenUnix(socket)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				continue
+			}
+
+			go newControlConn(c).serve()
+		}
+	}()
+}
+
+// controlConn is one connection to the control socket.
+type controlConn struct {
+	conn    net.Conn
+	encoder *json.Encoder
+	events  chan event
+	mutex   sync.Mutex
+}
+
+func newControlConn(c net.Conn) *controlConn {
+	return &controlConn{conn: c, encoder: json.NewEncoder(c)}
+}
+
+func (cc *controlConn) send(v interface{}) {
+	cc.mutex.Lock()
+	cc.encoder.Encode(v)
+	cc.mutex.Unlock()
+}
+
+func (cc *controlConn) serve() {
+	defer cc.conn.Close()
+	defer cc.unsubscribe()
+
+	decoder := json.NewDecoder(cc.conn)
+
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if err != io.EOF {
+				// the rest of the stream cannot be made sense of.
+				cc.send(rpcErrorResult{"2.0", nil, &rpcError{rpcParseError, err.Error()}})
+			}
+			return
+		}
+
+		var req rpcRequest
+		if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+			cc.send(rpcErrorResult{"2.0", nil, &rpcError{rpcInvalidRequest, "not a JSON-RPC 2.0 request"}})
+			continue
+		}
+
+		result, rerr := cc.call(req.Method, req.Params)
+
+		// requests without an id are notifications, which are not answered.
+		if req.ID == nil {
+			continue
+		}
+
+		if rerr != nil {
+			cc.send(rpcErrorResult{"2.0", req.ID, rerr})
+		} else {
+			cc.send(rpcResult{"2.0", req.ID, result})
+		}
+	}
+}
+
+func (cc *controlConn) call(method string, raw json.RawMessage) (interface{}, *rpcError) {
+	var params rpcParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+	}
+
+	if method == "sessions" {
+		list := []sessionInfo{}
+		for _, sess := range sessions.list() {
+			list = append(list, sess.info())
+		}
+		return list, nil
+	}
+
+	if method == "kick" {
+		for _, sess := range sessions.list() {
+			for _, c := range sess.clients.list() {
+				if c.conn.RemoteAddr().String() == params.Address {
+					sess.kick(c.conn)
+					return true, nil
+				}
+			}
+		}
+
+		return nil, &rpcError{rpcFailed, fmt.Sprintf("no client at %q", params.Address)}
+	}
+
+	if method == "invite" {
+		role, ttl := server.RoleReadWrite, defaultInviteTTL
+
+		var err error
+		if params.Role != "" {
+			if role, err = server.ParseRole(params.Role); err != nil {
+				return nil, &rpcError{rpcInvalidParams, err.Error()}
+			}
+			if role == server.RoleHost {
+				return nil, &rpcError{rpcInvalidParams, "invites cannot make hosts"}
+			}
+		}
+		if params.TTL != "" {
+			if ttl, err = time.ParseDuration(params.TTL); err != nil || ttl <= 0 {
+				return nil, &rpcError{rpcInvalidParams, fmt.Sprintf("invalid ttl %q", params.TTL)}
+			}
+		}
+
+		info, err := mintInvite(role, ttl)
+		if err != nil {
+			return nil, &rpcError{rpcFailed, err.Error()}
+		}
+		return info, nil
+	}
+
+	if method == "reload" {
+		disconnected, err := reloadAuth(params.Disconnect)
+		if err != nil {
+			return nil, &rpcError{rpcFailed, err.Error()}
+		}
+		return map[string]int{"disconnected": disconnected}, nil
+	}
+
+	if method == "subscribe" {
+		cc.subscribe()
+		return true, nil
+	}
+
+	if method == "unsubscribe" {
+		cc.unsubscribe()
+		return true, nil
+	}
+
+	sess := sessions.get(params.Session)
+	if params.Session == "" {
+		if list := sessions.list(); len(list) > 0 {
+			sess = list[0]
+		}
+	}
+
+	switch method {
+	case "clients", "set_read_only", "send", "resize", "set_resize_policy":
+		if sess == nil {
+			return nil, &rpcError{rpcFailed, fmt.Sprintf("no session named %q", params.Session)}
+		}
+	default:
+		return nil, &rpcError{rpcMethodNotFound, fmt.Sprintf("no method %q", method)}
+	}
+
+	switch method {
+	case "clients":
+		list := []clientInfo{}
+		for _, c := range sess.clients.list() {
+			list = append(list, sess.clientInfo(c))
+		}
+		return list, nil
+	case "set_read_only":
+		if params.ReadOnly == nil {
+			return nil, &rpcError{rpcInvalidParams, "read_only is required"}
+		}
+		sess.setLocked(*params.ReadOnly)
+	case "send":
+		if err := sess.input.Write(sess.command.PTY(), os.Stdin, []byte(params.Text)); err != nil {
+			return nil, &rpcError{rpcFailed, err.Error()}
+		}
+	case "resize":
+		if params.Width == 0 || params.Height == 0 {
+			return nil, &rpcError{rpcInvalidParams, "width and height are required"}
+		}
+		if err := sess.setSize(termproxy.Winch{Width: params.Width, Height: params.Height}); err != nil {
+			return nil, &rpcError{rpcFailed, err.Error()}
+		}
+	case "set_resize_policy":
+		policy, err := termproxy.ParseResizePolicy(params.Policy)
+		if err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		sess.setResizePolicy(policy)
+	}
+
+	return true, nil
+}
+
+// callControl makes a single request of the control socket at socket, and
+// decodes its result into result. It gives up on the program if the socket
+// cannot be talked to; the method's own errors are returned.
+func callControl(socket, method string, params, result interface{}) error {
+	c, err := net.Dial("unix", socket)
+	if err != nil {
+		termproxy.ErrorOut(fmt.Sprintf("Could not connect to %s", socket), err, termproxy.ErrNetwork)
+	}
+	defer c.Close()
+
+	request := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  method,
+		"params":  params,
+	}
+	if err := json.NewEncoder(c).Encode(request); err != nil {
+		termproxy.ErrorOut(fmt.Sprintf("Could not talk to %s", socket), err, termproxy.ErrNetwork)
+	}
+
+	var response struct {
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+
+	if err := json.NewDecoder(c).Decode(&response); err != nil {
+		termproxy.ErrorOut(fmt.Sprintf("Could not talk to %s", socket), err, termproxy.ErrNetwork)
+	}
+
+	if response.Error != nil {
+		return errors.New(response.Error.Message)
+	}
+
+	return json.Unmarshal(response.Result, result)
+}
+
+// subscribe starts sending events to the connection.
+func (cc *controlConn) subscribe() {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	if cc.events != nil {
+		return
+	}
+
+	ch := events.subscribe(eventBufferSize)
+	cc.events = ch
+
+	go func() {
+		for e := range ch {
+			cc.send(rpcNotification{"2.0", "event", e})
+		}
+	}()
+}
+
+func (cc *controlConn) unsubscribe() {
+	cc.mutex.Lock()
+	ch := cc.events
+	cc.events = nil
+	cc.mutex.Unlock()
+
+	if ch != nil {
+		events.unsubscribe(ch)
+	}
+}
+
+func (sess *session) info() sessionInfo {
+	width, height := sess.hub.Screen.Size()
+
+	info := sessionInfo{
+		Name:     sess.name,
+		Command:  sess.command.String(),
+		Width:    width,
+		Height:   height,
+		Clients:  len(sess.clients.list()),
+		ReadOnly: sess.locked.Get(),
+		Paused:   sess.clients.isPaused(),
+		Resize:   sess.getResizePolicy().String(),
+		Started:  sess.started,
+	}
+
+	if sess.control != nil {
+		info.Driver = ownerName(sess.control.Driver())
+	}
+
+	return info
+}
+
+func (sess *session) clientInfo(c *client) clientInfo {
+	info := clientInfo{
+		Address: c.conn.RemoteAddr().String(),
+		Session: sess.name,
+		Since:   c.since,
+		Driving: sess.control != nil && sess.control.IsDriver(c.conn),
+	}
+
+	if conn, ok := c.conn.(*server.Conn); ok {
+		ws := conn.Winch()
+		info.User = conn.User()
+		info.Role = conn.Role().String()
+		info.Width = ws.Width
+		info.Height = ws.Height
+		info.Term = conn.PTYRequest().Term
+	}
+
+	return info
+}
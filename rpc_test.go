@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erikh/termproxy/server"
+)
+
+// rpcClient talks to a control connection as a client of the socket would.
+type rpcClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newRPCClient(t *testing.T) *rpcClient {
+	client, control := net.Pipe()
+	go newControlConn(control).serve()
+	t.Cleanup(func() { client.Close() })
+
+	return &rpcClient{conn: client, reader: bufio.NewReader(client)}
+}
+
+// call sends line, a request, and returns the response to it.
+func (c *rpcClient) call(t *testing.T, line string) (json.RawMessage, *rpcError) {
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result struct {
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	if err := json.Unmarshal(response, &result); err != nil {
+		t.Fatalf("%s: %v", response, err)
+	}
+
+	return result.Result, result.Error
+}
+
+func TestControlSocket(t *testing.T) {
+	spec := "127.0.0.1:2222"
+	listenSpec = &spec
+
+	sess := newTestSession("rpc-test", 80, 24)
+	sessions.add(sess)
+	defer sessions.remove(sess)
+
+	watcher := newTestConn(4242)
+	sess.clients.add(watcher)
+	defer sess.clients.remove(watcher)
+
+	c := newRPCClient(t)
+
+	result, rerr := c.call(t, `{"jsonrpc":"2.0","id":1,"method":"sessions"}`)
+	var list []sessionInfo
+	if rerr != nil || json.Unmarshal(result, &list) != nil {
+		t.Fatalf("sessions: %s, %v", result, rerr)
+	}
+	found := false
+	for _, info := range list {
+		if info.Name == "rpc-test" {
+			found = info.Command == "/bin/cat" && info.Width == 80 && info.Height == 24 && info.Clients == 1
+		}
+	}
+	if !found {
+		t.Fatalf("sessions: expected rpc-test, got %s", result)
+	}
+
+	result, rerr = c.call(t, `{"jsonrpc":"2.0","id":2,"method":"clients","params":{"session":"rpc-test"}}`)
+	var clients []clientInfo
+	if rerr != nil || json.Unmarshal(result, &clients) != nil || len(clients) != 1 || clients[0].Address != "127.0.0.1:4242" {
+		t.Fatalf("clients: expected 127.0.0.1:4242, got %s, %v", result, rerr)
+	}
+
+	result, rerr = c.call(t, `{"jsonrpc":"2.0","id":3,"method":"invite","params":{"role":"ro","ttl":"5m"}}`)
+	var info inviteInfo
+	if rerr != nil || json.Unmarshal(result, &info) != nil {
+		t.Fatalf("invite: %s, %v", result, rerr)
+	}
+	if info.Role != "read-only" || info.Token == "" || !strings.HasPrefix(info.Guest, "guest-") || !strings.HasSuffix(info.Login, info.Token+"@127.0.0.1") {
+		t.Fatalf("invite: unexpected %+v", info)
+	}
+	if time.Until(info.Expires) > 5*time.Minute || time.Until(info.Expires) < 4*time.Minute {
+		t.Fatalf("invite: expected it to last 5m, until %s", info.Expires)
+	}
+	if inv, ok := invites.Redeem(info.Token); !ok || inv.Role != server.RoleReadOnly {
+		t.Fatal("invite: the token does not log in")
+	}
+
+	result, rerr = c.call(t, `{"jsonrpc":"2.0","id":4,"method":"kick","params":{"address":"127.0.0.1:4242"}}`)
+	if rerr != nil || string(result) != "true" {
+		t.Fatalf("kick: %s, %v", result, rerr)
+	}
+	if !watcher.isClosed() {
+		t.Fatal("kick: the client was not disconnected")
+	}
+
+	for _, test := range []struct {
+		name, request string
+		code          int
+	}{
+		{"kick with nobody at the address", `{"jsonrpc":"2.0","id":5,"method":"kick","params":{"address":"10.0.0.1:1"}}`, rpcFailed},
+		{"kick with a mistyped address", `{"jsonrpc":"2.0","id":6,"method":"kick","params":{"address":42}}`, rpcInvalidParams},
+		{"invite with an unknown role", `{"jsonrpc":"2.0","id":7,"method":"invite","params":{"role":"admin"}}`, rpcInvalidParams},
+		{"invite for a host", `{"jsonrpc":"2.0","id":8,"method":"invite","params":{"role":"host"}}`, rpcInvalidParams},
+		{"invite with a bad ttl", `{"jsonrpc":"2.0","id":9,"method":"invite","params":{"ttl":"soon"}}`, rpcInvalidParams},
+		{"invite with a negative ttl", `{"jsonrpc":"2.0","id":10,"method":"invite","params":{"ttl":"-5m"}}`, rpcInvalidParams},
+		{"clients of an unknown session", `{"jsonrpc":"2.0","id":11,"method":"clients","params":{"session":"nope"}}`, rpcFailed},
+		{"an unknown method", `{"jsonrpc":"2.0","id":12,"method":"explode"}`, rpcMethodNotFound},
+		{"a request of another version", `{"jsonrpc":"1.0","id":13,"method":"sessions"}`, rpcInvalidRequest},
+		{"resize without a size", `{"jsonrpc":"2.0","id":14,"method":"resize","params":{"session":"rpc-test"}}`, rpcInvalidParams},
+	} {
+		if result, rerr := c.call(t, test.request); rerr == nil || rerr.Code != test.code {
+			t.Fatalf("%s: expected error %d, got %s, %+v", test.name, test.code, result, rerr)
+		}
+	}
+
+	// a stream which is not JSON ends the connection with a parse error.
+	if _, rerr := c.call(t, `{"jsonrpc":`+"\n}"); rerr == nil || rerr.Code != rpcParseError {
+		t.Fatalf("expected a parse error, got %+v", rerr)
+	}
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Auth decides who may log in to an SSHServer and which role they are given.
+type Auth struct {
+	// Username and Password are a login shared by everyone. It is disabled
+	// when Password is empty.
+	Username string
+	Password string
+	// AuthorizedKeys, when set, are keys which may log in. Those belonging to
+	// a user log in as them; others as whichever user they ask for.
+	AuthorizedKeys *AuthorizedKeys
+	// UserCAs are certificate authorities. Users with a certificate signed by
+	// one of them may log in as any of its principals. Logging in as a
+	// principal given to a user in Users gets that user's role; others get
+	// Role.
+	UserCAs []ssh.PublicKey
+	// Role is given to everyone logging in with the shared login or an
+	// authorized key.
+	Role Role
+	// Users, when set, gives individual users their own credentials and roles.
+	Users *Users
+	// Invites, when set, lets guests in with a token made for them.
+	Invites *Invites
+}
+
+// credential is what a client logged in with, kept so that it can be checked
+// again when the authentication changes.
+type credential struct {
+	method   string
+	login    string
+	password string
+	key      ssh.PublicKey
+}
+
+// checkPassword decides whether login, which may name a session as in
+// "user+session", may log in with pass.
+func (auth Auth) checkPassword(login, pass string) (*ssh.Permissions, error) {
+	if perms, err := auth.checkLogin(login, pass); err == nil {
+		return perms, nil
+	}
+
+	if auth.Invites != nil {
+		name, _ := splitLogin(login)
+
+		// the token is the login name if that is one, and otherwise the
+		// password. Only that one is used up.
+		if auth.Invites.Valid(name) {
+			if inv, ok := auth.Invites.Redeem(name); ok {
+				return invitePermissions(inv), nil
+			}
+		} else if inv, ok := auth.Invites.Redeem(pass); ok {
+			return invitePermissions(inv), nil
+		}
+	}
+
+	return nil, fmt.Errorf("password rejected for %q", login)
+}
+
+// checkLogin is checkPassword without invites, which cannot be used twice.
+func (auth Auth) checkLogin(login, pass string) (*ssh.Permissions, error) {
+	name, _ := splitLogin(login)
+
+	if auth.Users != nil {
+		if user, ok := auth.Users.Password(name, pass); ok {
+			return withCredential(permissions(user.Name, user.Role), "password", pass), nil
+		}
+	}
+
+	if auth.Password != "" && name == auth.Username && pass == auth.Password {
+		return withCredential(permissions(name, auth.Role), "password", pass), nil
+	}
+
+	return nil, fmt.Errorf("password rejected for %q", login)
+}
+
+// checkKey decides whether login may log in with key, which may be a
+// certificate.
+func (auth Auth) checkKey(login string, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		if len(auth.UserCAs) == 0 {
+			return nil, fmt.Errorf("Certificate authentication is not enabled")
+		}
+
+		perms, err := auth.checkCert(login, cert)
+		if err != nil {
+			return nil, err
+		}
+		return withCredential(perms, "publickey", string(key.Marshal())), nil
+	}
+
+	if auth.Users != nil {
+		if user, ok := auth.Users.Key(key); ok {
+			return withCredential(permissions(user.Name, user.Role), "publickey", string(key.Marshal())), nil
+		}
+	}
+
+	if auth.AuthorizedKeys != nil {
+		if user, ok := auth.AuthorizedKeys.Lookup(key); ok {
+			if user == "" {
+				user, _ = splitLogin(login)
+			}
+			return withCredential(permissions(user, auth.Role), "publickey", string(key.Marshal())), nil
+		}
+	}
+
+	return nil, fmt.Errorf("Public key authentication rejected")
+}
+
+// checkCert decides whether cert may log in as login. Its validity and
+// critical options are checked by the ssh package's CertChecker, apart from
+// source-address, which is checked against the permissions returned.
+func (auth Auth) checkCert(login string, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("not a user certificate")
+	}
+
+	// a certificate without principals would otherwise be good for anyone.
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, fmt.Errorf("certificate has no principals")
+	}
+
+	checker := &ssh.CertChecker{
+		IsAuthority: func(key ssh.PublicKey) bool {
+			for _, ca := range auth.UserCAs {
+				if bytes.Equal(key.Marshal(), ca.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+
+	// CheckCert makes sure name is one of the certificate's principals. The
+	// others are not the client's to use on this login.
+	name, _ := splitLogin(login)
+	if err := checker.CheckCert(name, cert); err != nil {
+		return nil, err
+	}
+
+	perms := permissions(name, auth.Role)
+	if auth.Users != nil {
+		if user, ok := auth.Users.Principal(name); ok {
+			perms = permissions(user.Name, user.Role)
+		}
+	}
+	perms.CriticalOptions = cert.CriticalOptions
+
+	return perms, nil
+}
+
+// Permits reports whether c could still log in as the same user, with the
+// same role, using what it logged in with. Clients let in by an invite, or
+// without logging in at all, are always permitted.
+func (auth Auth) Permits(c *Conn) bool {
+	var (
+		perms *ssh.Permissions
+		err   error
+	)
+
+	switch cred := c.credential; cred.method {
+	case "password":
+		perms, err = auth.checkLogin(cred.login, cred.password)
+	case "publickey":
+		perms, err = auth.checkKey(cred.login, cred.key)
+	default:
+		return true
+	}
+
+	return err == nil &&
+		perms.Extensions["termproxy-user"] == c.user &&
+		perms.Extensions["termproxy-role"] == c.role.String()
+}
+
+// permissions records who logged in, so that Listen can hand it to the Conn.
+func permissions(user string, role Role) *ssh.Permissions {
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			"termproxy-user": user,
+			"termproxy-role": role.String(),
+		},
+	}
+}
+
+// invitePermissions are permissions for the guest let in by inv, which
+// record when it would have expired.
+func invitePermissions(inv Invite) *ssh.Permissions {
+	perms := permissions(inv.Guest, inv.Role)
+	perms.Extensions["termproxy-invite"] = inv.Expires.Format(time.RFC3339Nano)
+	return perms
+}
+
+// withCredential records what was logged in with, for Permits.
+func withCredential(perms *ssh.Permissions, method, secret string) *ssh.Permissions {
+	perms.Extensions["termproxy-method"] = method
+	perms.Extensions["termproxy-secret"] = secret
+	return perms
+}
+
+// setPermissions gives c the user and role in perms, logged in as login.
+func (c *Conn) setPermissions(login string, perms *ssh.Permissions) {
+	c.user = perms.Extensions["termproxy-user"]
+	c.role, _ = ParseRole(perms.Extensions["termproxy-role"])
+	c.credential = credential{method: perms.Extensions["termproxy-method"], login: login}
+
+	switch c.credential.method {
+	case "password":
+		c.credential.password = perms.Extensions["termproxy-secret"]
+	case "publickey":
+		c.credential.key, _ = ssh.ParsePublicKey([]byte(perms.Extensions["termproxy-secret"]))
+	}
+}
+
+// splitLogin splits a login name of the form "user+session". Without a "+"
+// the whole name is taken as both.
+func splitLogin(login string) (string, string) {
+	if i := strings.Index(login, "+"); i >= 0 {
+		return login[:i], login[i+1:]
+	}
+
+	return login, login
+}
+
+// ReadAuthorizedKeys reads the public keys in an authorized_keys file.
+func ReadAuthorizedKeys(filename string) ([]ssh.PublicKey, error) {
+	pubKeys := []ssh.PublicKey{}
+
+	keysFile, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse authorized keys file %s: %v", filename, err)
+	}
+
+	for _, key := range bytes.Split(keysFile, []byte{'\n'}) {
+		if len(bytes.TrimSpace(key)) == 0 {
+			continue
+		}
+
+		parsed, _, _, _, err := ssh.ParseAuthorizedKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse public key: %v", err)
+		}
+
+		pubKeys = append(pubKeys, parsed)
+	}
+
+	return pubKeys, nil
+}
@@ -1,19 +1,84 @@
 package server
 
 import (
+	"io"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/erikh/termproxy/termproxy"
 	"golang.org/x/crypto/ssh"
 )
 
 type Conn struct {
 	conn    net.Conn
 	channel ssh.Channel
+	user    string
+	role    Role
+	session string
+
+	credential credential
+
+	pty    PTYRequest
+	size   termproxy.Winch
+	env    map[string]string
+	output io.Writer
+	mutex  sync.Mutex
 }
 
 func NewConn(conn net.Conn, channel ssh.Channel) *Conn {
-	return &Conn{conn, channel}
+	return &Conn{conn: conn, channel: channel, env: map[string]string{}, output: channel}
+}
+
+// User is the name the client logged in as, or the owner of the key it used.
+func (c *Conn) User() string {
+	return c.user
+}
+
+// Role is the role the client was given when it logged in.
+func (c *Conn) Role() Role {
+	return c.role
+}
+
+// Session is the name of the session the client asked for when logging in:
+// the part of its login name after a "+", or else the whole login name.
+func (c *Conn) Session() string {
+	return c.session
+}
+
+// Winch returns the size the client's terminal last reported.
+func (c *Conn) Winch() termproxy.Winch {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.size
+}
+
+// PTYRequest returns the terminal the client asked for. It is empty if the
+// client did not ask for one.
+func (c *Conn) PTYRequest() PTYRequest {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pty
+}
+
+// Getenv returns an environment variable the client sent, such as COLORTERM.
+func (c *Conn) Getenv(name string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.env[name]
+}
+
+// Colors guesses how many colors the client's terminal can show.
+func (c *Conn) Colors() termproxy.ColorSupport {
+	return termproxy.TermColors(c.PTYRequest().Term, c.Getenv("COLORTERM"))
+}
+
+// Downgrade rewrites colors written to the connection from now on to ones a
+// terminal with the given color support can show.
+func (c *Conn) Downgrade(colors termproxy.ColorSupport) {
+	c.mutex.Lock()
+	c.output = termproxy.NewColorFilter(c.channel, colors)
+	c.mutex.Unlock()
 }
 
 func (c *Conn) Read(buf []byte) (int, error) {
@@ -21,7 +86,11 @@ func (c *Conn) Read(buf []byte) (int, error) {
 }
 
 func (c *Conn) Write(buf []byte) (int, error) {
-	return c.channel.Write(buf)
+	c.mutex.Lock()
+	output := c.output
+	c.mutex.Unlock()
+
+	return output.Write(buf)
 }
 
 func (c *Conn) Close() error {
@@ -55,3 +124,15 @@ func (c *Conn) SetWriteDeadline(t time.Time) error {
 func (c *Conn) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
 	return c.channel.SendRequest(name, wantReply, payload)
 }
+
+// TellSize tells the client the size of the program it is watching, and
+// reports whether it could. Only browsers can be told: SSH clients ignore
+// window changes sent by a server, and telnet has no way to send one.
+func (c *Conn) TellSize(ws termproxy.Winch) bool {
+	if _, ok := c.channel.(*webChannel); !ok {
+		return false
+	}
+
+	ok, err := c.channel.SendRequest("window-change", false, winchPayload(ws))
+	return ok && err == nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Invites are single-use tokens which let someone log in once, with the role
+// they were made for. A guest gives the token as their password, or as their
+// login name with any password or none, and is known by the name of their
+// invite whatever login name they gave. Tokens are forgotten once used or when
+// they expire.
+type Invites struct {
+	invites map[string]Invite
+	minted  int
+	mutex   sync.Mutex
+}
+
+// Invite is what a token lets its guest in as.
+type Invite struct {
+	// Guest is the name the guest is known by, such as "guest-3".
+	Guest   string
+	Role    Role
+	Expires time.Time
+}
+
+func NewInvites() *Invites {
+	return &Invites{invites: map[string]Invite{}}
+}
+
+// Mint makes a token for role which lasts ttl. Invites cannot make hosts.
+func (i *Invites) Mint(role Role, ttl time.Duration) (string, Invite, error) {
+	if role == RoleHost {
+		return "", Invite{}, fmt.Errorf("invites cannot be made for hosts")
+	}
+
+	// 10 bytes encode to 16 characters without padding, and are lower cased so
+	// the token can be typed as a login name.
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", Invite{}, err
+	}
+	token := strings.ToLower(base32.StdEncoding.EncodeToString(buf))
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.prune()
+	i.minted++
+	inv := Invite{Guest: fmt.Sprintf("guest-%d", i.minted), Role: role, Expires: time.Now().Add(ttl)}
+	i.invites[token] = inv
+
+	return token, inv, nil
+}
+
+// Redeem uses up token, returning what it was made for.
+func (i *Invites) Redeem(token string) (Invite, bool) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.prune()
+
+	inv, ok := i.invites[token]
+	if !ok {
+		return Invite{}, false
+	}
+
+	delete(i.invites, token)
+	return inv, true
+}
+
+// Valid reports whether token may be redeemed, without using it up.
+func (i *Invites) Valid(token string) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.prune()
+
+	_, ok := i.invites[token]
+	return ok
+}
+
+// Pending is the number of tokens which have not been used or expired.
+func (i *Invites) Pending() int {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.prune()
+	return len(i.invites)
+}
+
+func (i *Invites) prune() {
+	now := time.Now()
+	for token, inv := range i.invites {
+		if now.After(inv.Expires) {
+			delete(i.invites, token)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// keysFetchTimeout bounds how long fetching a key listing may take.
+	keysFetchTimeout = 10 * time.Second
+	// keysMaxSize bounds how large a key listing may be.
+	keysMaxSize = 1 << 20
+	// keysCacheMaxAge is how long a listing's cached copy is used for while
+	// the listing cannot be fetched.
+	keysCacheMaxAge = 24 * time.Hour
+)
+
+// AuthorizedKeys are the public keys which may log in, gathered from sources
+// of three kinds:
+//
+//   - an authorized_keys file, whose keys may log in as any user,
+//   - a directory of NAME.pub files, whose keys log in as NAME,
+//   - the URL of a key listing, such as https://github.com/NAME.keys, whose
+//     keys log in as NAME.
+//
+// Listings are kept in a cache directory, and while one cannot be fetched its
+// copy is used until it is a day old. A source which cannot be read otherwise
+// has no keys until it can be again, so that a revoked key cannot linger for
+// long. Keys which cannot be read, such as ed25519 keys, are skipped in
+// directories and listings, and reported.
+type AuthorizedKeys struct {
+	sources  []string
+	cacheDir string
+	client   *http.Client
+
+	keys map[string][]authorizedKey
+	// skipped is what was last reported skipped in each source, so that it
+	// is reported again only when it changes.
+	skipped map[string]string
+	mutex   sync.RWMutex
+}
+
+type authorizedKey struct {
+	user string
+	key  ssh.PublicKey
+}
+
+// NewAuthorizedKeys reads the keys from sources, keeping copies of the
+// listings fetched in cacheDir unless it is empty. The keys are returned even
+// if some sources cannot be read, along with what went wrong.
+func NewAuthorizedKeys(sources []string, cacheDir string) (*AuthorizedKeys, error) {
+	a := &AuthorizedKeys{
+		sources:  sources,
+		cacheDir: cacheDir,
+		client:   &http.Client{Timeout: keysFetchTimeout},
+		keys:     map[string][]authorizedKey{},
+		skipped:  map[string]string{},
+	}
+
+	return a, a.Reload()
+}
+
+// Reload reads every source again. A source which cannot be read loses its
+// keys, unless it is a listing with a recent enough copy. The error lists the
+// sources which could not be read, and the keys newly skipped in the rest.
+func (a *AuthorizedKeys) Reload() error {
+	var errs keysErrors
+
+	for _, source := range a.sources {
+		keys, skipped, err := a.load(source)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		report := ""
+		for _, e := range skipped {
+			report += e.Error() + "\n"
+		}
+
+		a.mutex.Lock()
+		a.keys[source] = keys
+		if report != a.skipped[source] {
+			a.skipped[source] = report
+			errs = append(errs, skipped...)
+		}
+		a.mutex.Unlock()
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+// keysErrors are the problems found reading the keys, one per line.
+type keysErrors []error
+
+func (e keysErrors) Error() string {
+	lines := make([]string, 0, len(e))
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Refresh reloads the sources every interval, for as long as the program runs.
+// Errors are given to errors, if it is not nil.
+func (a *AuthorizedKeys) Refresh(interval time.Duration, errors func(error)) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := a.Reload(); err != nil && errors != nil {
+				errors(err)
+			}
+		}
+	}()
+}
+
+// Lookup returns the name of the user key belongs to, which is empty for keys
+// from an authorized_keys file.
+func (a *AuthorizedKeys) Lookup(key ssh.PublicKey) (string, bool) {
+	marshaled := key.Marshal()
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	for _, source := range a.sources {
+		for _, k := range a.keys[source] {
+			if bytes.Equal(k.key.Marshal(), marshaled) {
+				return k.user, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// load reads the keys from source, along with the lines of it which were
+// skipped.
+func (a *AuthorizedKeys) load(source string) ([]authorizedKey, []error, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		return a.fetch(source)
+	}
+
+	fi, err := os.Stat(source)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not parse authorized keys file %s: %v", source, err)
+	}
+
+	if !fi.IsDir() {
+		keys, err := ReadAuthorizedKeys(source)
+		if err != nil {
+			return nil, nil, err
+		}
+		return userKeys("", keys), nil, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(source, "*.pub"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := []authorizedKey{}
+	skipped := []error{}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not read public key %s: %v", file, err)
+		}
+
+		user := strings.TrimSuffix(filepath.Base(file), ".pub")
+		parsed, bad := parseKeyListing(file, content)
+		keys = append(keys, userKeys(user, parsed)...)
+		skipped = append(skipped, bad...)
+	}
+
+	return keys, skipped, nil
+}
+
+// fetch gets the key listing at url, falling back to its cached copy while
+// that is recent enough.
+func (a *AuthorizedKeys) fetch(url string) ([]authorizedKey, []error, error) {
+	user := strings.TrimSuffix(path.Base(url), ".keys")
+
+	content, err := a.get(url)
+	if err != nil {
+		err = fmt.Errorf("Could not fetch keys from %s: %v", url, err)
+
+		cached, fetched, cacheErr := a.cached(url)
+		if cacheErr != nil {
+			return nil, nil, err
+		}
+
+		keys, skipped := parseKeyListing(url, cached)
+		return userKeys(user, keys), skipped, fmt.Errorf("%v; using the copy fetched %s", err, fetched.Format(time.RFC3339))
+	}
+
+	if a.cacheDir != "" {
+		if err := os.MkdirAll(a.cacheDir, 0700); err == nil {
+			ioutil.WriteFile(a.cacheFile(url), content, 0600)
+		}
+	}
+
+	keys, skipped := parseKeyListing(url, content)
+	return userKeys(user, keys), skipped, nil
+}
+
+// cached returns the cached copy of the listing at url and when it was
+// fetched, unless it is too old to use.
+func (a *AuthorizedKeys) cached(url string) ([]byte, time.Time, error) {
+	if a.cacheDir == "" {
+		return nil, time.Time{}, fmt.Errorf("no cache")
+	}
+
+	fi, err := os.Stat(a.cacheFile(url))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	if time.Since(fi.ModTime()) > keysCacheMaxAge {
+		return nil, time.Time{}, fmt.Errorf("the cached copy of %s is too old", url)
+	}
+
+	content, err := ioutil.ReadFile(a.cacheFile(url))
+	return content, fi.ModTime(), err
+}
+
+func (a *AuthorizedKeys) cacheFile(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(a.cacheDir, hex.EncodeToString(sum[:8])+".keys")
+}
+
+func (a *AuthorizedKeys) get(url string) ([]byte, error) {
+	resp, err := a.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, keysMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(content) > keysMaxSize {
+		return nil, fmt.Errorf("the listing is larger than %d bytes", keysMaxSize)
+	}
+
+	return content, nil
+}
+
+func userKeys(user string, keys []ssh.PublicKey) []authorizedKey {
+	list := make([]authorizedKey, 0, len(keys))
+	for _, key := range keys {
+		list = append(list, authorizedKey{user: user, key: key})
+	}
+	return list
+}
+
+// parseKeyListing reads the keys in content, one per line, from the source
+// called name. Those it cannot parse are skipped, and returned as errors.
+func parseKeyListing(name string, content []byte) ([]ssh.PublicKey, []error) {
+	keys := []ssh.PublicKey{}
+	skipped := []error{}
+
+	for i, line := range bytes.Split(content, []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		key, _, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			skipped = append(skipped, fmt.Errorf("Skipped line %d of %s: %v", i+1, name, err))
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, skipped
+}
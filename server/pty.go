@@ -0,0 +1,64 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/erikh/termproxy/termproxy"
+	"golang.org/x/crypto/ssh"
+)
+
+// PTYRequest is a client's request for a terminal, as described in RFC 4254
+// section 6.2.
+type PTYRequest struct {
+	// Term is the client's TERM, such as "xterm-256color".
+	Term string
+	// Width and Height are in characters, PixelWidth and PixelHeight in pixels.
+	// Either pair may be zero when the client does not know it.
+	Width, Height           uint32
+	PixelWidth, PixelHeight uint32
+	// Modes are the client's terminal modes, keyed by the opcodes of RFC 4254
+	// section 8, such as ssh.ECHO.
+	Modes ssh.TerminalModes
+}
+
+// Winch returns the size the client asked for.
+func (p PTYRequest) Winch() termproxy.Winch {
+	return termproxy.Winch{Width: uint(p.Width), Height: uint(p.Height)}
+}
+
+type ptyRequestMsg struct {
+	Term        string
+	Width       uint32
+	Height      uint32
+	PixelWidth  uint32
+	PixelHeight uint32
+	Modes       string
+}
+
+func parsePTYRequest(payload []byte) (PTYRequest, error) {
+	var msg ptyRequestMsg
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return PTYRequest{}, fmt.Errorf("Could not read payload for pty-req: %v", err)
+	}
+
+	req := PTYRequest{
+		Term:        msg.Term,
+		Width:       msg.Width,
+		Height:      msg.Height,
+		PixelWidth:  msg.PixelWidth,
+		PixelHeight: msg.PixelHeight,
+		Modes:       ssh.TerminalModes{},
+	}
+
+	// each mode is an opcode byte followed by a uint32 argument. The list ends
+	// at TTY_OP_END, or at the first opcode RFC 4254 leaves undefined, as the
+	// size of its argument is unknown.
+	modes := []byte(msg.Modes)
+	for len(modes) >= 5 && modes[0] != 0 && modes[0] < 160 {
+		req.Modes[modes[0]] = binary.BigEndian.Uint32(modes[1:5])
+		modes = modes[5:]
+	}
+
+	return req, nil
+}
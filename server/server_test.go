@@ -0,0 +1,1146 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erikh/termproxy/termproxy"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestReadWinchPayload(t *testing.T) {
+	for _, ws := range []termproxy.Winch{
+		{Width: 80, Height: 24},
+		{Width: 1, Height: 1},
+		{Width: 65535, Height: 65535},
+		{Width: 70000, Height: 300},
+	} {
+		read, err := readWinchPayload(winchPayload(ws))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read != ws {
+			t.Fatalf("expected %dx%d, got %dx%d", ws.Width, ws.Height, read.Width, read.Height)
+		}
+	}
+
+	// the size in pixels which follows is ignored.
+	payload := []byte{
+		0, 0, 0, 132,
+		0, 0, 0, 43,
+		0, 0, 4, 0,
+		0, 0, 3, 0,
+	}
+	read, err := readWinchPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != (termproxy.Winch{Width: 132, Height: 43}) {
+		t.Fatalf("expected 132x43, got %dx%d", read.Width, read.Height)
+	}
+
+	// the pixels may be left off too.
+	if read, err = readWinchPayload(payload[:8]); err != nil || read.Width != 132 || read.Height != 43 {
+		t.Fatalf("expected 132x43 from a short payload, got %dx%d, %v", read.Width, read.Height, err)
+	}
+
+	for _, short := range [][]byte{nil, {}, payload[:4], payload[:7]} {
+		if _, err := readWinchPayload(short); err == nil {
+			t.Fatalf("a %d byte payload was read", len(short))
+		}
+	}
+}
+
+func TestWinchPayload(t *testing.T) {
+	payload := winchPayload(termproxy.Winch{Width: 0x1234, Height: 0x56})
+	expected := []byte{0, 0, 0x12, 0x34, 0, 0, 0, 0x56, 0, 0, 0, 0, 0, 0, 0, 0}
+	if string(payload) != string(expected) {
+		t.Fatalf("expected %v, got %v", expected, payload)
+	}
+}
+
+func TestListenSlowLogin(t *testing.T) {
+	key, _, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSSHServer("127.0.0.1:0", Auth{Username: "scott", Password: "tiger"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Listen()
+
+	addr := s.listener.Addr().String()
+
+	// someone who connects and says nothing holds up nobody else.
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User: "scott",
+			Auth: []ssh.AuthMethod{ssh.Password("tiger")},
+		})
+		if err == nil {
+			client.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("logging in was held up by an idle connection")
+	}
+}
+
+func TestParsePTYRequest(t *testing.T) {
+	modes := func(b ...byte) string { return string(b) }
+	full := ssh.Marshal(ptyRequestMsg{
+		Term:   "xterm-256color",
+		Width:  132,
+		Height: 43,
+		Modes:  modes(ssh.ECHO, 0, 0, 0, 1, ssh.TTY_OP_ISPEED, 0, 0, 0x96, 0, 0),
+	})
+
+	for _, test := range []struct {
+		name    string
+		payload []byte
+		modes   ssh.TerminalModes
+		err     bool
+	}{
+		{name: "a full request", payload: full, modes: ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 38400}},
+		{name: "no payload", payload: nil, err: true},
+		{name: "a payload cut short in the size", payload: full[:len("xterm-256color")+4+6], err: true},
+		{name: "a payload cut short in the modes", payload: full[:len(full)-3], err: true},
+		{name: "an oversized terminal name", payload: append([]byte{0xff, 0xff, 0xff, 0xf0}, "xterm"...), err: true},
+		{
+			name:    "no modes",
+			payload: ssh.Marshal(ptyRequestMsg{Term: "vt100", Width: 80, Height: 24}),
+			modes:   ssh.TerminalModes{},
+		},
+		{
+			name:    "a mode cut short",
+			payload: ssh.Marshal(ptyRequestMsg{Term: "vt100", Modes: modes(ssh.ECHO, 0, 0, 0, 1, ssh.ICANON, 0, 0)}),
+			modes:   ssh.TerminalModes{ssh.ECHO: 1},
+		},
+		{
+			name:    "modes after TTY_OP_END",
+			payload: ssh.Marshal(ptyRequestMsg{Term: "vt100", Modes: modes(ssh.ECHO, 0, 0, 0, 1, 0, ssh.ICANON, 0, 0, 0, 1)}),
+			modes:   ssh.TerminalModes{ssh.ECHO: 1},
+		},
+		{
+			name:    "an undefined opcode",
+			payload: ssh.Marshal(ptyRequestMsg{Term: "vt100", Modes: modes(ssh.ECHO, 0, 0, 0, 1, 200, 0, 0, 0, 1, ssh.ICANON, 0, 0, 0, 1)}),
+			modes:   ssh.TerminalModes{ssh.ECHO: 1},
+		},
+	} {
+		req, err := parsePTYRequest(test.payload)
+		if test.err {
+			if err == nil {
+				t.Fatalf("%s: was read", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(req.Modes) != len(test.modes) {
+			t.Fatalf("%s: expected modes %v, got %v", test.name, test.modes, req.Modes)
+		}
+		for op, arg := range test.modes {
+			if req.Modes[op] != arg {
+				t.Fatalf("%s: expected modes %v, got %v", test.name, test.modes, req.Modes)
+			}
+		}
+	}
+
+	req, err := parsePTYRequest(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Term != "xterm-256color" || req.Winch() != (termproxy.Winch{Width: 132, Height: 43}) {
+		t.Fatalf("expected xterm-256color at 132x43, got %s at %dx%d", req.Term, req.Width, req.Height)
+	}
+}
+
+func TestInvitesRedeemedOnce(t *testing.T) {
+	invites := NewInvites()
+	auth := Auth{Invites: invites}
+
+	first, _, err := invites.Mint(RoleReadWrite, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := invites.Mint(RoleReadOnly, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a token given as the login name is the one used up, even when the
+	// password is another.
+	perms, err := auth.checkPassword(first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role := perms.Extensions["termproxy-role"]; role != RoleReadWrite.String() {
+		t.Fatalf("expected %s, got %s", RoleReadWrite, role)
+	}
+	if invites.Valid(first) || !invites.Valid(second) {
+		t.Fatal("the wrong invite was used up")
+	}
+
+	// one given as the password logs in as its guest, whatever the login
+	// name claims.
+	perms, err = auth.checkPassword("host", second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user := perms.Extensions["termproxy-user"]; user != "guest-2" {
+		t.Fatalf("expected guest-2, got %s", user)
+	}
+
+	if _, err := auth.checkPassword("host", second); err == nil {
+		t.Fatal("an invite was used twice")
+	}
+	if invites.Pending() != 0 {
+		t.Fatalf("%d invites left", invites.Pending())
+	}
+
+	if _, _, err := invites.Mint(RoleHost, time.Minute); err == nil {
+		t.Fatal("an invite was made for a host")
+	}
+}
+
+func TestWebInviteExpires(t *testing.T) {
+	invites := NewInvites()
+	token, _, err := invites.Mint(RoleReadOnly, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &WebServer{auth: Auth{Invites: invites}, invited: map[string]invitedPage{}}
+	login := func() bool {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(token, "")
+		_, _, ok := s.login(httptest.NewRecorder(), r)
+		return ok
+	}
+
+	// loading the page uses the invite up, and its credentials work once more
+	// until the invite would have expired.
+	if !login() {
+		t.Fatal("the invite did not log in")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if login() {
+		t.Fatal("the page's credentials outlived the invite")
+	}
+	if len(s.invited) != 0 {
+		t.Fatalf("%d expired pages kept", len(s.invited))
+	}
+}
+
+func TestCertPrincipalRole(t *testing.T) {
+	ca, _, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := &ssh.Certificate{
+		Key:             key.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"alice", "admin"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := ParseUsers([]byte("root  host       principal admin\nalice read-only  principal alice\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := Auth{UserCAs: []ssh.PublicKey{ca.PublicKey()}, Users: users, Role: RoleReadWrite}
+
+	table := []struct {
+		login, user string
+		role        Role
+	}{
+		// alice does not get the role of the certificate's other principal.
+		{"alice", "alice", RoleReadOnly},
+		{"admin", "root", RoleHost},
+	}
+
+	for _, row := range table {
+		perms, err := auth.checkCert(row.login, cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user, role := perms.Extensions["termproxy-user"], perms.Extensions["termproxy-role"]; user != row.user || role != row.role.String() {
+			t.Fatalf("%s logged in as %s, %s rather than %s, %s", row.login, user, role, row.user, row.role)
+		}
+	}
+
+	if _, err := auth.checkCert("mallory", cert); err == nil {
+		t.Fatal("logged in as someone the certificate does not name")
+	}
+}
+
+func TestCertificateLogin(t *testing.T) {
+	ca, _, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCA, _, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, _, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSSHServer("127.0.0.1:0", Auth{UserCAs: []ssh.PublicKey{ca.PublicKey()}, Role: RoleReadWrite}, hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AcceptHandler = func(c net.Conn) { c.Close() }
+	go s.Listen()
+
+	now := time.Now()
+
+	// login signs a certificate changed by edit with signer, and logs in as
+	// user with it.
+	login := func(user string, signer ssh.Signer, edit func(*ssh.Certificate)) error {
+		cert := &ssh.Certificate{
+			Key:             key.PublicKey(),
+			CertType:        ssh.UserCert,
+			ValidPrincipals: []string{"alice"},
+			ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+			ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+		}
+		if edit != nil {
+			edit(cert)
+		}
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			t.Fatal(err)
+		}
+
+		certSigner, err := ssh.NewCertSigner(cert, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client, err := ssh.Dial("tcp", s.listener.Addr().String(), &ssh.ClientConfig{
+			User: user,
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(certSigner)},
+		})
+		if err != nil {
+			return err
+		}
+		return client.Close()
+	}
+
+	for _, test := range []struct {
+		name   string
+		user   string
+		signer ssh.Signer
+		edit   func(*ssh.Certificate)
+		ok     bool
+	}{
+		{"a good certificate", "alice", ca, nil, true},
+		{"a good certificate naming a session", "alice+editor", ca, nil, true},
+		{"a certificate for someone else", "bob", ca, nil, false},
+		{"a certificate from another authority", "alice", otherCA, nil, false},
+		{"an expired certificate", "alice", ca, func(c *ssh.Certificate) {
+			c.ValidBefore = uint64(now.Add(-time.Minute).Unix())
+		}, false},
+		{"a certificate which is not valid yet", "alice", ca, func(c *ssh.Certificate) {
+			c.ValidAfter = uint64(now.Add(time.Minute).Unix())
+		}, false},
+		{"a certificate without principals", "alice", ca, func(c *ssh.Certificate) {
+			c.ValidPrincipals = nil
+		}, false},
+		{"a host certificate", "alice", ca, func(c *ssh.Certificate) {
+			c.CertType = ssh.HostCert
+		}, false},
+		{"a certificate forcing a command", "alice", ca, func(c *ssh.Certificate) {
+			c.CriticalOptions = map[string]string{"force-command": "/bin/true"}
+		}, false},
+		{"a certificate for this address", "alice", ca, func(c *ssh.Certificate) {
+			c.CriticalOptions = map[string]string{"source-address": "127.0.0.1/32"}
+		}, true},
+		{"a certificate for another address", "alice", ca, func(c *ssh.Certificate) {
+			c.CriticalOptions = map[string]string{"source-address": "10.0.0.0/8"}
+		}, false},
+	} {
+		if err := login(test.user, test.signer, test.edit); (err == nil) != test.ok {
+			t.Fatalf("%s: expected success %v, got %v", test.name, test.ok, err)
+		}
+	}
+
+	// certificates are refused when no authority is configured.
+	noCA := Auth{Username: "scott", Password: "tiger"}
+	cert := &ssh.Certificate{Key: key.PublicKey(), CertType: ssh.UserCert, ValidPrincipals: []string{"alice"}, ValidBefore: ssh.CertTimeInfinity}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := noCA.checkKey("alice", cert); err == nil {
+		t.Fatal("a certificate was accepted without an authority")
+	}
+}
+
+func TestSetAuth(t *testing.T) {
+	hostKey, _, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := ParseUsers([]byte("sam read-write password hunter2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSSHServer("127.0.0.1:0", Auth{Users: users}, hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan *Conn, 1)
+	s.AcceptHandler = func(c net.Conn) { accepted <- c.(*Conn) }
+	go s.Listen()
+
+	login := func(password string) (*ssh.Client, error) {
+		return ssh.Dial("tcp", s.listener.Addr().String(), &ssh.ClientConfig{
+			User: "sam",
+			Auth: []ssh.AuthMethod{ssh.Password(password)},
+		})
+	}
+
+	client, err := login("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+
+	var conn *Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the login was not accepted")
+	}
+
+	if !s.Auth().Permits(conn) {
+		t.Fatal("a client is not permitted by the logins it used")
+	}
+
+	// the same logins with another role no longer permit the client, and new
+	// logins are checked against them straight away.
+	demoted, err := ParseUsers([]byte("sam read-only password hunter2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetAuth(Auth{Users: demoted})
+
+	if s.Auth().Permits(conn) {
+		t.Fatal("a client is still permitted after its role changed")
+	}
+
+	changed, err := ParseUsers([]byte("sam read-write password swordfish\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetAuth(Auth{Users: changed})
+
+	if s.Auth().Permits(conn) {
+		t.Fatal("a client is still permitted after its password changed")
+	}
+
+	if client, err := login("hunter2"); err == nil {
+		client.Close()
+		t.Fatal("logged in with a password which was taken away")
+	}
+
+	client, err = login("swordfish")
+	if err != nil {
+		t.Fatalf("could not log in with the new password: %v", err)
+	}
+	client.Close()
+}
+
+func TestAuthorizedKeysReloadFailure(t *testing.T) {
+	listed, _, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	filed, _, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		down  bool
+		mutex sync.Mutex
+	)
+	listing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if down {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(ssh.MarshalAuthorizedKey(listed.PublicKey()))
+	}))
+	defer listing.Close()
+
+	dir, err := ioutil.TempDir("", "termproxy-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyDir := filepath.Join(dir, "keys")
+	if err := os.Mkdir(keyDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(keyDir, "sam.pub"), ssh.MarshalAuthorizedKey(filed.PublicKey()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := NewAuthorizedKeys([]string{listing.URL + "/alex.keys", keyDir}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user, ok := keys.Lookup(listed.PublicKey()); !ok || user != "alex" {
+		t.Fatalf("listed key was not found: %q", user)
+	}
+	if user, ok := keys.Lookup(filed.PublicKey()); !ok || user != "sam" {
+		t.Fatalf("filed key was not found: %q", user)
+	}
+
+	// a listing which cannot be fetched loses its keys; the others keep theirs.
+	mutex.Lock()
+	down = true
+	mutex.Unlock()
+
+	if err := keys.Reload(); err == nil {
+		t.Fatal("reloading an unavailable listing did not fail")
+	}
+	if _, ok := keys.Lookup(listed.PublicKey()); ok {
+		t.Fatal("a key from an unavailable listing still logs in")
+	}
+	if _, ok := keys.Lookup(filed.PublicKey()); !ok {
+		t.Fatal("a key from a readable source was dropped")
+	}
+
+	// so does a directory which has gone.
+	if err := os.RemoveAll(keyDir); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	down = false
+	mutex.Unlock()
+
+	if err := keys.Reload(); err == nil {
+		t.Fatal("reloading a missing directory did not fail")
+	}
+	if _, ok := keys.Lookup(filed.PublicKey()); ok {
+		t.Fatal("a key from a missing directory still logs in")
+	}
+	if _, ok := keys.Lookup(listed.PublicKey()); !ok {
+		t.Fatal("a key from a listing available again was not restored")
+	}
+}
+
+func TestAuthorizedKeysCache(t *testing.T) {
+	listed, _, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		listing []byte
+		down    bool
+		mutex   sync.Mutex
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if down {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(listing)
+	}))
+	defer srv.Close()
+
+	setListing := func(content []byte, unavailable bool) {
+		mutex.Lock()
+		listing, down = content, unavailable
+		mutex.Unlock()
+	}
+
+	dir, err := ioutil.TempDir("", "termproxy-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// an unreachable source does not stop the rest from being used.
+	missing := filepath.Join(dir, "missing")
+	setListing(append([]byte("ssh-bogus AAAA\n"), ssh.MarshalAuthorizedKey(listed.PublicKey())...), false)
+
+	keys, err := NewAuthorizedKeys([]string{missing, srv.URL + "/alex.keys"}, filepath.Join(dir, "cache"))
+	if err == nil || !strings.Contains(err.Error(), missing) {
+		t.Fatalf("a missing source was not reported: %v", err)
+	}
+	if !strings.Contains(err.Error(), "Skipped line 1 of "+srv.URL+"/alex.keys") {
+		t.Fatalf("a skipped line was not reported: %v", err)
+	}
+	if user, ok := keys.Lookup(listed.PublicKey()); !ok || user != "alex" {
+		t.Fatalf("listed key was not found: %q", user)
+	}
+
+	// skipped lines are reported once.
+	if err := keys.Reload(); err == nil || strings.Contains(err.Error(), "Skipped") {
+		t.Fatalf("a skipped line was reported again: %v", err)
+	}
+
+	// while the listing cannot be fetched, its copy is used.
+	setListing(nil, true)
+	if err := keys.Reload(); err == nil || !strings.Contains(err.Error(), "using the copy") {
+		t.Fatalf("the cached copy was not reported: %v", err)
+	}
+	if _, ok := keys.Lookup(listed.PublicKey()); !ok {
+		t.Fatal("a key from the cached copy was dropped")
+	}
+
+	// until it is too old.
+	old := time.Now().Add(-keysCacheMaxAge - time.Minute)
+	if err := os.Chtimes(keys.cacheFile(srv.URL+"/alex.keys"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	keys.Reload()
+	if _, ok := keys.Lookup(listed.PublicKey()); ok {
+		t.Fatal("a key from a stale copy still logs in")
+	}
+
+	// a fetch which succeeds drops revoked keys.
+	setListing(ssh.MarshalAuthorizedKey(listed.PublicKey()), false)
+	keys.Reload()
+	if _, ok := keys.Lookup(listed.PublicKey()); !ok {
+		t.Fatal("a key from a listing available again was not restored")
+	}
+
+	setListing([]byte("\n"), false)
+	keys.Reload()
+	if _, ok := keys.Lookup(listed.PublicKey()); ok {
+		t.Fatal("a key removed from its listing still logs in")
+	}
+
+	// an oversized listing is refused.
+	setListing(bytes.Repeat([]byte{'\n'}, keysMaxSize+1), false)
+	if err := keys.Reload(); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Fatalf("an oversized listing was not refused: %v", err)
+	}
+}
+
+// wsFrame is a frame as a browser sends it, masked.
+func wsFrame(fin bool, opcode byte, payload []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+
+	frame := []byte{first}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, uint64(len(payload)))
+		frame = append(append(frame, 0x80|127), ext...)
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	return frame
+}
+
+// recordConn is a connection which records what is written to it.
+type recordConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	read := func(input ...[]byte) (byte, []byte, []byte, error) {
+		conn := new(recordConn)
+		ws := &wsConn{conn: conn, reader: bufio.NewReader(bytes.NewReader(bytes.Join(input, nil)))}
+		opcode, message, err := ws.ReadMessage()
+		return opcode, message, conn.written.Bytes(), err
+	}
+
+	// a fragmented message is put back together, answering a ping on the way.
+	opcode, message, written, err := read(
+		wsFrame(false, wsText, []byte("he")),
+		wsFrame(false, wsPing, []byte("hi")),
+		wsFrame(true, wsContinuation, []byte("llo")),
+	)
+	if err != nil || opcode != wsText || string(message) != "hello" {
+		t.Fatalf("expected a text hello, got %d %q, %v", opcode, message, err)
+	}
+	if !bytes.Equal(written, []byte{0x80 | wsPong, 2, 'h', 'i'}) {
+		t.Fatalf("expected a pong, got %q", written)
+	}
+
+	// lengths of 16 and 64 bits.
+	for _, size := range []int{300, 70000} {
+		payload := bytes.Repeat([]byte{'x'}, size)
+		if _, message, _, err := read(wsFrame(true, wsBinary, payload)); err != nil || !bytes.Equal(message, payload) {
+			t.Fatalf("a %d byte message was not read: %v", size, err)
+		}
+	}
+
+	// a close is answered, and ends the connection.
+	if _, _, written, err := read(wsFrame(true, wsClose, nil)); err != io.EOF || !bytes.Equal(written, []byte{0x80 | wsClose, 0}) {
+		t.Fatalf("expected a close to be answered, got %q, %v", written, err)
+	}
+
+	unmasked := wsFrame(true, wsText, []byte("hi"))
+	unmasked[1] &^= 0x80
+
+	oversized := []byte{0x80 | wsBinary, 0x80 | 127, 0, 0, 0, 0, 0x10, 0, 0, 0, 1, 2, 3, 4}
+
+	for name, input := range map[string][][]byte{
+		"an unmasked frame":            {unmasked},
+		"an oversized frame":           {oversized},
+		"a continuation with no start": {wsFrame(true, wsContinuation, []byte("x"))},
+		"a message inside another":     {wsFrame(false, wsText, []byte("a")), wsFrame(true, wsText, []byte("b"))},
+		"an unknown opcode":            {wsFrame(true, 0x3, nil)},
+		"a frame cut short":            {wsFrame(true, wsText, []byte("hello"))[:7]},
+		"an oversized message": {
+			wsFrame(false, wsBinary, bytes.Repeat([]byte{'x'}, wsMaxMessage)),
+			wsFrame(true, wsContinuation, []byte("x")),
+		},
+	} {
+		if _, _, _, err := read(input...); err == nil {
+			t.Fatalf("%s was read", name)
+		}
+	}
+}
+
+func TestWebTerminal(t *testing.T) {
+	assets, err := ioutil.TempDir("", "termproxy-assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(assets)
+
+	for name := range webAssets {
+		if err := ioutil.WriteFile(filepath.Join(assets, name), []byte("/* "+name+" */"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CheckWebAssets(assets); err != nil {
+		t.Fatal(err)
+	}
+
+	typed := make(chan string, 1)
+	s := &WebServer{
+		InWinch:      make(chan termproxy.Winch, 1),
+		CloseHandler: func(net.Conn) {},
+		auth:         Auth{Username: "sam", Password: "secret", Role: RoleReadWrite},
+		invited:      map[string]invitedPage{},
+		AcceptHandler: func(c net.Conn) {
+			c.Write([]byte("hello"))
+			buf := make([]byte, 16)
+			n, _ := c.Read(buf)
+			typed <- string(buf[:n])
+		},
+	}
+
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+
+	get := func(path string, login bool) (int, string) {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		if login {
+			req.SetBasicAuth("sam", "secret")
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// the page needs a login, and loads xterm.js from the CDN or from the
+	// server.
+	if status, _ := get("/", false); status != http.StatusUnauthorized {
+		t.Fatalf("the page was served without a login: %d", status)
+	}
+	if status, page := get("/", true); status != http.StatusOK || !strings.Contains(page, `src="`+webAssets["xterm.js"]+`" crossorigin="anonymous"`) {
+		t.Fatalf("expected the page loading xterm.js from the CDN, got %d: %s", status, page)
+	}
+	if status, _ := get("/assets/xterm.js", false); status != http.StatusNotFound {
+		t.Fatalf("assets were served without a directory: %d", status)
+	}
+
+	s.AssetsDir = assets
+	if _, page := get("/", true); !strings.Contains(page, `src="/assets/xterm.js"`) {
+		t.Fatalf("expected the page loading xterm.js from the server: %s", page)
+	}
+	if status, asset := get("/assets/xterm.js", false); status != http.StatusOK || asset != "/* xterm.js */" {
+		t.Fatalf("expected xterm.js, got %d: %q", status, asset)
+	}
+	if status, _ := get("/assets/..%2fsecret", false); status != http.StatusNotFound {
+		t.Fatalf("a file other than an asset was served: %d", status)
+	}
+
+	dial := func(origin string) (net.Conn, *bufio.Reader, *http.Response) {
+		c, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, _ := http.NewRequest("GET", srv.URL+"/ws", nil)
+		req.SetBasicAuth("sam", "secret")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Origin", origin)
+		if err := req.Write(c); err != nil {
+			t.Fatal(err)
+		}
+
+		reader := bufio.NewReader(c)
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, reader, resp
+	}
+
+	// other sites' pages cannot connect.
+	c, _, resp := dial("http://evil.example")
+	c.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("a cross-origin connection was let in: %d", resp.StatusCode)
+	}
+
+	c, reader, resp := dial(srv.URL)
+	defer c.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("expected a WebSocket, got %d %q", resp.StatusCode, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	// the page sends its size first.
+	c.Write(wsFrame(true, wsText, []byte(`{"type":"resize","cols":100,"rows":30}`)))
+	select {
+	case winch := <-s.InWinch:
+		if winch.Width != 100 || winch.Height != 30 {
+			t.Fatalf("expected 100x30, got %dx%d", winch.Width, winch.Height)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the page's size was not passed on")
+	}
+
+	// and then sees the output, and types.
+	header := make([]byte, 7)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(reader, header); err != nil || !bytes.Equal(header, []byte{0x80 | wsBinary, 5, 'h', 'e', 'l', 'l', 'o'}) {
+		t.Fatalf("expected hello, got %q, %v", header, err)
+	}
+
+	c.Write(wsFrame(true, wsBinary, []byte("ls\r")))
+	select {
+	case input := <-typed:
+		if input != "ls\r" {
+			t.Fatalf("expected ls, got %q", input)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the page's keys were not passed on")
+	}
+}
+
+// chunkConn is a connection which is read a chunk at a time, and records
+// what is written to it.
+type chunkConn struct {
+	recordConn
+	chunks [][]byte
+}
+
+func (c *chunkConn) Read(p []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, c.chunks[0])
+	c.chunks = c.chunks[1:]
+	return n, nil
+}
+
+func TestTelnetChannel(t *testing.T) {
+	read := func(chunks ...[]byte) (*telnetChannel, string) {
+		conn := &chunkConn{chunks: chunks}
+		channel := &telnetChannel{conn: conn}
+		channel.owner = NewConn(conn, channel)
+
+		for channel.fill(false) == nil {
+		}
+
+		return channel, string(channel.pending)
+	}
+
+	// commands and escaped IACs are understood when split across reads.
+	if _, data := read([]byte("a"), []byte{telnetIAC}, []byte{telnetIAC}, []byte("b")); data != "a\xffb" {
+		t.Fatalf("expected an escaped IAC, got %q", data)
+	}
+
+	channel, data := read([]byte("a"), []byte{telnetIAC}, []byte{telnetWill}, []byte{42, 'b'})
+	if data != "ab" {
+		t.Fatalf("expected the command to be stripped, got %q", data)
+	}
+	if written := channel.conn.(*chunkConn).written.Bytes(); !bytes.Equal(written, []byte{telnetIAC, telnetDont, 42}) {
+		t.Fatalf("expected the option to be refused, got %v", written)
+	}
+
+	// the end of a line is CR LF or CR NUL.
+	if _, data := read([]byte("ls\r"), []byte{0}, []byte("pwd\r\n")); data != "ls\rpwd\r" {
+		t.Fatalf("expected lines ending in CR, got %q", data)
+	}
+
+	for _, test := range []struct {
+		name   string
+		chunks [][]byte
+		winch  termproxy.Winch
+	}{
+		{
+			name:   "a window size split across reads",
+			chunks: [][]byte{{telnetIAC, telnetSB, telnetNAWS, 0}, {100, 0, 30, telnetIAC}, {telnetSE, 'x'}},
+			winch:  termproxy.Winch{Width: 100, Height: 30},
+		},
+		{
+			name:   "a window size with an escaped IAC",
+			chunks: [][]byte{{telnetIAC, telnetSB, telnetNAWS, 0, telnetIAC, telnetIAC, 0, 40, telnetIAC, telnetSE, 'x'}},
+			winch:  termproxy.Winch{Width: 255, Height: 40},
+		},
+		{
+			name:   "a short window size",
+			chunks: [][]byte{{telnetIAC, telnetSB, telnetNAWS, 0, 80, telnetIAC, telnetSE, 'x'}},
+		},
+		{
+			name:   "an oversized window size",
+			chunks: [][]byte{append(append([]byte{telnetIAC, telnetSB, telnetNAWS}, bytes.Repeat([]byte{telnetIAC, telnetIAC, 1}, 100)...), telnetIAC, telnetSE, 'x')},
+		},
+		{
+			name:   "an empty window size",
+			chunks: [][]byte{{telnetIAC, telnetSB, telnetNAWS, 0, 0, 0, 0, telnetIAC, telnetSE, 'x'}},
+		},
+	} {
+		channel, data := read(test.chunks...)
+		if data != "x" {
+			t.Fatalf("%s: expected the data after it, got %q", test.name, data)
+		}
+		if winch := channel.owner.Winch(); winch != test.winch {
+			t.Fatalf("%s: expected %dx%d, got %dx%d", test.name, test.winch.Width, test.winch.Height, winch.Width, winch.Height)
+		}
+	}
+
+	// IACs sent to the client are escaped.
+	conn := &chunkConn{}
+	channel = &telnetChannel{conn: conn}
+	if n, err := channel.Write([]byte{1, telnetIAC, 2}); n != 3 || err != nil {
+		t.Fatalf("expected 3 bytes written, got %d, %v", n, err)
+	}
+	if written := conn.written.Bytes(); !bytes.Equal(written, []byte{1, telnetIAC, telnetIAC, 2}) {
+		t.Fatalf("expected an escaped IAC, got %v", written)
+	}
+}
+
+func TestSplitLogin(t *testing.T) {
+	for _, test := range []struct{ login, user, session string }{
+		{"alice", "alice", "alice"},
+		{"alice+editor", "alice", "editor"},
+		{"alice+", "alice", ""},
+		{"+editor", "", "editor"},
+		{"alice+editor+logs", "alice", "editor+logs"},
+	} {
+		if user, session := splitLogin(test.login); user != test.user || session != test.session {
+			t.Fatalf("%q: expected %q and %q, got %q and %q", test.login, test.user, test.session, user, session)
+		}
+	}
+}
+
+func TestParseUsers(t *testing.T) {
+	signer, _, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+
+	users, err := ParseUsers([]byte(`# user  role  credential
+
+	# an indented comment
+erik  host        ` + key + ` erik@laptop
+sam   read-write  password hunter2
+sam   rw          password #notacomment
+ops   host        principal oncall
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user, ok := users.Key(signer.PublicKey()); !ok || user.Name != "erik" || user.Role != RoleHost {
+		t.Fatalf("expected erik's key to be a host's, got %+v", user)
+	}
+	// a user listed twice has both passwords.
+	for _, password := range []string{"hunter2", "#notacomment"} {
+		if user, ok := users.Password("sam", password); !ok || user.Role != RoleReadWrite {
+			t.Fatalf("expected sam's password %q to log in read-write, got %+v", password, user)
+		}
+	}
+	if _, ok := users.Password("sam", "wrong"); ok {
+		t.Fatal("a wrong password logged in")
+	}
+	if user, ok := users.Principal("oncall"); !ok || user.Name != "ops" {
+		t.Fatalf("expected the principal oncall to be ops, got %+v", user)
+	}
+
+	for _, test := range []struct {
+		name, content string
+		line          int
+	}{
+		{"an unknown role", "sam  admin  password hunter2", 2},
+		{"a user given two roles", "sam  read-write  password a\nsam  host  password b", 3},
+		{"a line without a credential", "sam  read-write", 2},
+		{"a password with spaces", "sam  read-write  password hunter 2", 2},
+		{"a principal with spaces", "ops  host  principal on call", 2},
+		{"a password missing", "sam  read-write  password", 2},
+		{"a key which cannot be parsed", "erik  host  ssh-rsa notakey erik@laptop", 2},
+	} {
+		_, err := ParseUsers([]byte("# users\n" + test.content + "\n"))
+		if err == nil {
+			t.Fatalf("%s was accepted", test.name)
+		}
+		if prefix := fmt.Sprintf("line %d:", test.line); !strings.HasPrefix(err.Error(), prefix) {
+			t.Fatalf("%s: expected the error on line %d, got %v", test.name, test.line, err)
+		}
+	}
+}
+
+func TestExecRequest(t *testing.T) {
+	key, _, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSSHServer("127.0.0.1:0", Auth{Username: "scott", Password: "tiger"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AcceptHandler = func(c net.Conn) { c.Close() }
+	s.ExecHandler = func(c net.Conn, command string) int {
+		if command != "who" {
+			return 127
+		}
+		c.Write([]byte("sam\n"))
+		return 0
+	}
+	go s.Listen()
+
+	// each connection has a single session.
+	session := func() *ssh.Session {
+		client, err := ssh.Dial("tcp", s.listener.Addr().String(), &ssh.ClientConfig{
+			User: "scott",
+			Auth: []ssh.AuthMethod{ssh.Password("tiger")},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session
+	}
+
+	run := func(command string) (string, error) {
+		output, err := session().Output(command)
+		return string(output), err
+	}
+
+	// the command's output and exit status come back.
+	if output, err := run("who"); err != nil || output != "sam\n" {
+		t.Fatalf("expected sam, got %q, %v", output, err)
+	}
+	if _, err := run("explode"); err == nil {
+		t.Fatal("an unknown command succeeded")
+	} else if exit, ok := err.(*ssh.ExitError); !ok || exit.ExitStatus() != 127 {
+		t.Fatalf("expected exit status 127, got %v", err)
+	}
+
+	// a shell takes no command.
+	if ok, err := session().SendRequest("shell", true, ssh.Marshal(&struct{ Command string }{"who"})); ok || err != nil {
+		t.Fatalf("a shell request with a command was accepted: %v", err)
+	}
+}
@@ -4,37 +4,42 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/erikh/termproxy/termproxy"
 	"golang.org/x/crypto/ssh"
 )
 
+// handshakeTimeout is how long a client has to log in, prompts and all.
+const handshakeTimeout = 2 * time.Minute
+
 type SSHServer struct {
 	AcceptHandler func(net.Conn)
 	CloseHandler  func(net.Conn)
+	// ExecHandler, when set, runs the command of an exec request, writing its
+	// output to the connection, and returns its exit status.
+	ExecHandler func(net.Conn, string) int
+	// AuthHandler, when set, is told who each connection authenticated as,
+	// or for a rejected attempt, the login name it tried and why it failed.
+	AuthHandler func(addr net.Addr, user string, role Role, err error)
 
 	InWinch  chan termproxy.Winch
 	OutWinch chan termproxy.Winch
 
-	connections []net.Conn
-	listener    net.Listener
-
-	copier *termproxy.Copier
+	listener net.Listener
 
 	sshConfig *ssh.ServerConfig
-
-	mutex sync.Mutex
+	auth      Auth
+	authMutex sync.Mutex
 }
 
 func defaultCloseHandler(conn net.Conn) {
 	conn.Close()
 }
 
-func NewSSHServer(listenSpec, username, password, authorizedKeys, privateKey string) (*SSHServer, error) {
+func NewSSHServer(listenSpec string, auth Auth, hostKey ssh.Signer) (*SSHServer, error) {
 	listener, err := net.Listen("tcp", listenSpec)
 	if err != nil {
 		return nil, err
@@ -45,67 +50,74 @@ func NewSSHServer(listenSpec, username, password, authorizedKeys, privateKey str
 		OutWinch:     make(chan termproxy.Winch),
 		CloseHandler: defaultCloseHandler,
 		listener:     listener,
-		copier:       termproxy.NewCopier(),
 	}
 
-	if err := srv.initSSH(username, password, authorizedKeys, privateKey); err != nil {
+	if err := srv.initSSH(auth, hostKey); err != nil {
 		return nil, err
 	}
 
 	return srv, nil
 }
 
-func (s *SSHServer) initSSH(username, password, authorizedKeys, privateKey string) error {
-	pubKeys := []ssh.PublicKey{}
-
-	if authorizedKeys != "" {
-		keysFile, err := ioutil.ReadFile(authorizedKeys)
-		if err != nil {
-			return fmt.Errorf("Could not parse authorized keys file %s: %v", authorizedKeys, err)
-		}
+// Auth returns the authentication new connections are checked against.
+func (s *SSHServer) Auth() Auth {
+	s.authMutex.Lock()
+	defer s.authMutex.Unlock()
+	return s.auth
+}
 
-		for _, key := range bytes.Split(keysFile, []byte{'\n'}) {
-			parsed, _, _, _, err := ssh.ParseAuthorizedKey(key)
-			if err != nil {
-				return fmt.Errorf("could not parse public key: %v", err)
-			}
+// SetAuth changes the authentication new connections are checked against.
+// Connections already made are left alone.
+func (s *SSHServer) SetAuth(auth Auth) {
+	s.authMutex.Lock()
+	s.auth = auth
+	s.authMutex.Unlock()
+}
 
-			pubKeys = append(pubKeys, parsed)
-		}
-	}
+func (s *SSHServer) initSSH(auth Auth, hostKey ssh.Signer) error {
+	s.auth = auth
 
 	s.sshConfig = &ssh.ServerConfig{
 		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			for _, pubKey := range pubKeys {
-				if bytes.Equal(key.Marshal(), pubKey.Marshal()) {
-					return nil, nil
+			return s.Auth().checkKey(c.User(), key)
+		},
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			return s.Auth().checkPassword(c.User(), string(pass))
+		},
+		// OpenSSH tries keyboard-interactive before passwords. A guest whose
+		// login name is their invite gets in without being asked anything;
+		// everyone else is asked for their password.
+		KeyboardInteractiveCallback: func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			auth := s.Auth()
+
+			if auth.Invites != nil {
+				name, _ := splitLogin(c.User())
+				if inv, ok := auth.Invites.Redeem(name); ok {
+					return invitePermissions(inv), nil
 				}
 			}
-			return nil, fmt.Errorf("Public key authentication rejected")
-		},
-	}
 
-	if password != "" {
-		s.sshConfig.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			if c.User() == username && string(pass) == password {
-				return nil, nil
+			answers, err := client(c.User(), "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 1 {
+				return nil, fmt.Errorf("expected a password")
 			}
 
-			return nil, fmt.Errorf("password rejected for %q", c.User())
-		}
-	}
-
-	privateBytes, err := ioutil.ReadFile(privateKey)
-	if err != nil {
-		return err
+			return auth.checkPassword(c.User(), answers[0])
+		},
 	}
 
-	private, err := ssh.ParsePrivateKey(privateBytes)
-	if err != nil {
-		return err
+	s.sshConfig.AuthLogCallback = func(c ssh.ConnMetadata, method string, err error) {
+		// "none" is how clients ask which methods they may use.
+		if err != nil && method != "none" && s.AuthHandler != nil {
+			user, _ := splitLogin(c.User())
+			s.AuthHandler(c.RemoteAddr(), user, RoleReadOnly, fmt.Errorf("%s: %v", method, err))
+		}
 	}
 
-	s.sshConfig.AddHostKey(private)
+	s.sshConfig.AddHostKey(hostKey)
 
 	return nil
 }
@@ -117,123 +129,166 @@ func (s *SSHServer) Listen() {
 			continue
 		}
 
-		serverConn, chans, reqs, err := ssh.NewServerConn(c, s.sshConfig)
-		if err != nil {
+		// logging in may wait on a person, so each client does it on its own.
+		go s.serve(c)
+	}
+}
+
+// serve logs in the client connected on c and hands it to the AcceptHandler.
+func (s *SSHServer) serve(c net.Conn) {
+	// nobody may sit at a prompt forever.
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	serverConn, chans, reqs, err := ssh.NewServerConn(c, s.sshConfig)
+	if err != nil {
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	if s.AuthHandler != nil && serverConn.Permissions != nil {
+		role, _ := ParseRole(serverConn.Permissions.Extensions["termproxy-role"])
+		s.AuthHandler(c.RemoteAddr(), serverConn.Permissions.Extensions["termproxy-user"], role, nil)
+	}
+	// The incoming Request channel must be serviced.
+	go ssh.DiscardRequests(reqs)
+
+	// Service the incoming Channel channel.
+	for newChannel := range chans {
+		// Channels have a type, depending on the application level
+		// protocol intended. In the case of a shell, the type is
+		// "session" and ServerShell may be used to present a simple
+		// terminal interface.
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
 			continue
 		}
-		// The incoming Request channel must be serviced.
-		go ssh.DiscardRequests(reqs)
-
-		// Service the incoming Channel channel.
-		for newChannel := range chans {
-			// Channels have a type, depending on the application level
-			// protocol intended. In the case of a shell, the type is
-			// "session" and ServerShell may be used to present a simple
-			// terminal interface.
-			if newChannel.ChannelType() != "session" {
-				newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
-				continue
-			}
-			channel, requests, err := newChannel.Accept()
-			if err != nil {
-				break
-			}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			break
+		}
 
-			s.mutex.Lock()
-			conn := NewConn(c, channel)
-			s.connections = append(s.connections, conn)
-			s.mutex.Unlock()
-
-			go func(in <-chan *ssh.Request) {
-				for req := range in {
-					ok := false
-					switch req.Type {
-					case "window-change":
-						winch, err := readWinchPayload(req.Payload)
-						if err != nil {
-							req.Reply(false, nil)
-							continue
-						}
+		conn := NewConn(c, channel)
+		_, conn.session = splitLogin(serverConn.User())
+		if perms := serverConn.Permissions; perms != nil {
+			conn.setPermissions(serverConn.User(), perms)
+		}
+
+		if s.AcceptHandler == nil {
+			panic("no accept handler provided")
+		}
+
+		// the connection is handed to the AcceptHandler once the client asks
+		// for a shell, by which time it has sent its terminal and environment.
+		// Until then its size is kept out of the negotiation.
+		accepted := make(chan struct{})
+
+		go func(in <-chan *ssh.Request) {
+			started := false
 
+			for req := range in {
+				switch req.Type {
+				case "window-change":
+					winch, err := readWinchPayload(req.Payload)
+					if err != nil {
+						req.Reply(false, nil)
+						continue
+					}
+
+					conn.mutex.Lock()
+					conn.size = winch
+					conn.mutex.Unlock()
+
+					if started {
 						winch.Conn = conn
 						s.InWinch <- winch
-					case "pty-req":
-						split := bytes.SplitN(req.Payload[4:], []byte{0}, 2)
-						// the nul termination split up here chops a byte off the head of
-						// our filtered payload. We don't actually care about this byte as
-						// terminals are still not large enough to cap 32bits. :)
-						// just append a zero to make uint32 happy and move on.
-						payload := append([]byte{0}, split[1]...)
-						winch, err := readWinchPayload(payload)
-						if err != nil {
-							req.Reply(false, nil)
-							continue
-						}
+					}
+				case "pty-req":
+					pty, err := parsePTYRequest(req.Payload)
+					if err != nil {
+						req.Reply(false, nil)
+						continue
+					}
+
+					conn.mutex.Lock()
+					conn.pty = pty
+					conn.size = pty.Winch()
+					conn.mutex.Unlock()
+					req.Reply(true, nil)
+				case "env":
+					var env struct{ Name, Value string }
+					if err := ssh.Unmarshal(req.Payload, &env); err != nil {
+						req.Reply(false, nil)
+						continue
+					}
 
+					conn.mutex.Lock()
+					conn.env[env.Name] = env.Value
+					conn.mutex.Unlock()
+					req.Reply(true, nil)
+				case "shell":
+					if started || len(req.Payload) > 0 {
+						req.Reply(false, nil)
+						continue
+					}
+
+					started = true
+					req.Reply(true, nil)
+
+					if winch := conn.Winch(); winch.Width != 0 {
 						winch.Conn = conn
 						s.InWinch <- winch
-						req.Reply(true, nil)
-					case "shell":
-						ok = true
-						if len(req.Payload) > 0 {
-							ok = false
-						}
-						req.Reply(ok, nil)
-					default:
-						req.Reply(false, nil)
 					}
-				}
-			}(requests)
 
-			if s.AcceptHandler == nil {
-				panic("no accept handler provided")
-			}
+					close(accepted)
+					go s.AcceptHandler(conn)
+				case "exec":
+					var exec struct{ Command string }
+					if started || s.ExecHandler == nil || ssh.Unmarshal(req.Payload, &exec) != nil {
+						req.Reply(false, nil)
+						continue
+					}
 
-			go s.AcceptHandler(conn)
-			go func() {
-				serverConn.Wait()
-				serverConn.Close()
-				conn.Close()
-				s.CloseHandler(conn)
-			}()
+					started = true
+					req.Reply(true, nil)
 
-			break
-		}
-	}
-}
+					go func() {
+						status := s.ExecHandler(conn, exec.Command)
+						conn.SendRequest("exit-status", false, ssh.Marshal(&struct{ Status uint32 }{uint32(status)}))
+						channel.Close()
+					}()
+				default:
+					req.Reply(false, nil)
+				}
+			}
+		}(requests)
 
-func (s *SSHServer) Prune(i int) {
-	if len(s.connections)-1 == i {
-		s.connections = s.connections[:i]
-	} else {
-		s.connections = append(s.connections[:i], s.connections[i+1:]...)
-	}
-}
+		go func() {
+			serverConn.Wait()
+			serverConn.Close()
+			conn.Close()
 
-func (s *SSHServer) Iterate(iterator func(*SSHServer, net.Conn, int) error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+			select {
+			case <-accepted:
+				s.CloseHandler(conn)
+			default:
+			}
+		}()
 
-	for i, conn := range s.connections {
-		if err := iterator(s, conn, i); err != nil {
-			s.CloseHandler(conn)
-			s.Prune(i)
-		}
+		break
 	}
 }
 
-func (s *SSHServer) MultiCopy(buf []byte) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	for i, conn := range s.connections {
-		if _, err := conn.Write(buf); err != nil && err != io.EOF {
-			s.CloseHandler(conn)
-			s.Prune(i)
-		}
-	}
+// winchPayload is the payload of a window-change request for ws, the inverse
+// of readWinchPayload.
+func winchPayload(ws termproxy.Winch) []byte {
+	payload := make([]byte, 16)
+	binary.BigEndian.PutUint32(payload[0:], uint32(ws.Width))
+	binary.BigEndian.PutUint32(payload[4:], uint32(ws.Height))
+	return payload
 }
 
+// readWinchPayload reads the columns and rows of a window-change request,
+// ignoring its size in pixels.
 func readWinchPayload(payload []byte) (termproxy.Winch, error) {
 	buf := bytes.NewBuffer(payload)
 	if buf.Len() < 8 {
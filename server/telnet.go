@@ -0,0 +1,290 @@
+package server
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/erikh/termproxy/termproxy"
+)
+
+// Telnet commands and options, from RFC 854, RFC 857, RFC 858 and RFC 1073.
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWill = 251
+	telnetWont = 252
+	telnetDo   = 253
+	telnetDont = 254
+	telnetIAC  = 255
+
+	telnetEcho = 1
+	telnetSGA  = 3
+	telnetNAWS = 31
+)
+
+// telnetNAWSWait is how long a new client is given to report its window size
+// before it is let in without one.
+const telnetNAWSWait = 500 * time.Millisecond
+
+// TelnetServer streams the session to plain TCP clients, such as nc and
+// telnet, without any authentication. Telnet clients are asked for their
+// window size, which takes part in the negotiation like anyone else's; nc's
+// does not. Its connections are Conns which go to the same kind of handlers
+// as SSH clients'.
+type TelnetServer struct {
+	AcceptHandler func(net.Conn)
+	CloseHandler  func(net.Conn)
+
+	// InWinch receives the size of a client's window whenever it changes. It
+	// may be shared with an SSHServer.
+	InWinch chan termproxy.Winch
+
+	role     Role
+	listener net.Listener
+}
+
+// NewTelnetServer listens on listenSpec, giving everyone who connects role.
+func NewTelnetServer(listenSpec string, role Role) (*TelnetServer, error) {
+	listener, err := net.Listen("tcp", listenSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TelnetServer{
+		InWinch:      make(chan termproxy.Winch),
+		CloseHandler: defaultCloseHandler,
+		role:         role,
+		listener:     listener,
+	}, nil
+}
+
+func (s *TelnetServer) Listen() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			continue
+		}
+
+		go s.serve(c)
+	}
+}
+
+func (s *TelnetServer) serve(c net.Conn) {
+	channel := &telnetChannel{conn: c, winch: s.InWinch}
+	conn := NewConn(c, channel)
+	channel.owner = conn
+
+	conn.role = s.role
+	conn.pty = PTYRequest{Term: "xterm"}
+
+	// ask for the window size, and for the client not to echo or buffer what
+	// is typed.
+	c.Write([]byte{
+		telnetIAC, telnetDo, telnetNAWS,
+		telnetIAC, telnetWill, telnetEcho,
+		telnetIAC, telnetWill, telnetSGA,
+	})
+
+	// anything typed while waiting is kept for the session.
+	c.SetReadDeadline(time.Now().Add(telnetNAWSWait))
+	for conn.Winch().Width == 0 {
+		if err := channel.fill(false); err != nil {
+			break
+		}
+	}
+	c.SetReadDeadline(time.Time{})
+
+	if winch := conn.Winch(); winch.Width != 0 {
+		winch.Conn = conn
+		s.InWinch <- winch
+	}
+
+	if s.AcceptHandler == nil {
+		panic("no accept handler provided")
+	}
+
+	s.AcceptHandler(conn)
+	conn.Close()
+	s.CloseHandler(conn)
+}
+
+// telnetChannel strips telnet commands out of what the client sends, acting
+// on window sizes, and escapes what is sent to it.
+type telnetChannel struct {
+	conn  net.Conn
+	owner *Conn
+	winch chan termproxy.Winch
+
+	state   int
+	command byte
+	sb      []byte
+	lastCR  bool
+	pending []byte
+	mutex   sync.Mutex
+}
+
+// states of the telnet parser.
+const (
+	telnetData = iota
+	telnetCommand
+	telnetOption
+	telnetSub
+	telnetSubIAC
+)
+
+// fill reads from the client until it has something for Read. Window sizes
+// are sent on to winch if notify is set.
+func (c *telnetChannel) fill(notify bool) error {
+	buf := make([]byte, 1024)
+
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range buf[:n] {
+		switch c.state {
+		case telnetData:
+			switch {
+			case b == telnetIAC:
+				c.state = telnetCommand
+			case c.lastCR && (b == '\n' || b == 0):
+				// the end of a line is sent as CR LF or CR NUL; a terminal sends CR.
+			default:
+				c.pending = append(c.pending, b)
+			}
+			c.lastCR = b == '\r'
+		case telnetCommand:
+			switch b {
+			case telnetIAC:
+				c.pending = append(c.pending, b)
+				c.state = telnetData
+			case telnetWill, telnetWont, telnetDo, telnetDont:
+				c.command = b
+				c.state = telnetOption
+			case telnetSB:
+				c.sb = c.sb[:0]
+				c.state = telnetSub
+			default:
+				c.state = telnetData
+			}
+		case telnetOption:
+			c.answer(c.command, b)
+			c.state = telnetData
+		case telnetSub:
+			if b == telnetIAC {
+				c.state = telnetSubIAC
+			} else if len(c.sb) < 64 {
+				c.sb = append(c.sb, b)
+			}
+		case telnetSubIAC:
+			switch b {
+			case telnetSE:
+				c.subnegotiation(notify)
+				c.state = telnetData
+			case telnetIAC:
+				if len(c.sb) < 64 {
+					c.sb = append(c.sb, b)
+				}
+				c.state = telnetSub
+			default:
+				c.state = telnetData
+			}
+		}
+	}
+
+	return nil
+}
+
+// answer refuses options the client offers or asks for, other than the ones
+// asked of it.
+func (c *telnetChannel) answer(command, option byte) {
+	switch command {
+	case telnetDo:
+		if option != telnetEcho && option != telnetSGA {
+			c.writeRaw([]byte{telnetIAC, telnetWont, option})
+		}
+	case telnetWill:
+		if option != telnetNAWS {
+			c.writeRaw([]byte{telnetIAC, telnetDont, option})
+		}
+	}
+}
+
+func (c *telnetChannel) subnegotiation(notify bool) {
+	if len(c.sb) != 5 || c.sb[0] != telnetNAWS {
+		return
+	}
+
+	winch := termproxy.Winch{
+		Width:  uint(c.sb[1])<<8 | uint(c.sb[2]),
+		Height: uint(c.sb[3])<<8 | uint(c.sb[4]),
+	}
+	if winch.Width == 0 || winch.Height == 0 {
+		return
+	}
+
+	c.owner.mutex.Lock()
+	c.owner.size = winch
+	c.owner.mutex.Unlock()
+
+	if notify {
+		winch.Conn = c.owner
+		c.winch <- winch
+	}
+}
+
+func (c *telnetChannel) Read(buf []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if err := c.fill(true); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(buf, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *telnetChannel) writeRaw(buf []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func (c *telnetChannel) Write(buf []byte) (int, error) {
+	out := make([]byte, 0, len(buf))
+	for _, b := range buf {
+		if b == telnetIAC {
+			out = append(out, telnetIAC)
+		}
+		out = append(out, b)
+	}
+
+	if err := c.writeRaw(out); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (c *telnetChannel) Close() error {
+	return c.conn.Close()
+}
+
+func (c *telnetChannel) CloseWrite() error {
+	return nil
+}
+
+// SendRequest does nothing: telnet has no way to tell a client its window
+// should change.
+func (c *telnetChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return false, nil
+}
+
+func (c *telnetChannel) Stderr() io.ReadWriter {
+	return c
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Role decides what a connected user may do.
+type Role int
+
+const (
+	// RoleReadOnly users watch the session; their input is discarded.
+	RoleReadOnly Role = iota
+	// RoleReadWrite users may type into the shared program.
+	RoleReadWrite
+	// RoleHost users may type and manage the session.
+	RoleHost
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleReadOnly:
+		return "read-only"
+	case RoleReadWrite:
+		return "read-write"
+	case RoleHost:
+		return "host"
+	}
+
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// CanWrite reports whether input from users with this role reaches the program.
+func (r Role) CanWrite() bool {
+	return r >= RoleReadWrite
+}
+
+// ParseRole converts the name of a role into a Role. "ro" and "rw" are
+// accepted as short forms.
+func ParseRole(name string) (Role, error) {
+	switch name {
+	case "read-only", "ro":
+		return RoleReadOnly, nil
+	case "read-write", "rw":
+		return RoleReadWrite, nil
+	case "host":
+		return RoleHost, nil
+	}
+
+	return 0, fmt.Errorf("unknown role %q", name)
+}
+
+// User is a single user from a users file.
+type User struct {
+	Name       string
+	Role       Role
+	Passwords  []string
+	Keys       []ssh.PublicKey
+	Principals []string
+}
+
+// Users maps user names and keys to roles. It is read from a file with one
+// credential per line:
+//
+//	# user  role        credential
+//	erik    host        ssh-rsa AAAAB3Nza... erik@laptop
+//	sam     read-write  password hunter2
+//	pat     read-only   ssh-rsa AAAAB3Nza... pat@desktop
+//	ops     host        principal oncall
+//
+// A principal gives the user to anyone with a certificate for it from one of
+// the server's user certificate authorities. A user may be listed on several
+// lines to give them more than one credential, but must be given the same role
+// on each.
+type Users struct {
+	users map[string]*User
+	order []string
+}
+
+// LoadUsers reads the users file at filename.
+func LoadUsers(filename string) (*Users, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := ParseUsers(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	return users, nil
+}
+
+// ParseUsers parses the contents of a users file.
+func ParseUsers(content []byte) (*Users, error) {
+	u := &Users{users: map[string]*User{}}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected a user, a role and a credential", line)
+		}
+
+		role, err := ParseRole(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		user, ok := u.users[fields[0]]
+		if !ok {
+			user = &User{Name: fields[0], Role: role}
+			u.users[user.Name] = user
+			u.order = append(u.order, user.Name)
+		} else if user.Role != role {
+			return nil, fmt.Errorf("line %d: %s was already given the role %s", line, user.Name, user.Role)
+		}
+
+		if fields[2] == "password" {
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("line %d: expected a single password", line)
+			}
+
+			user.Passwords = append(user.Passwords, fields[3])
+			continue
+		}
+
+		if fields[2] == "principal" {
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("line %d: expected a single principal", line)
+			}
+
+			user.Principals = append(user.Principals, fields[3])
+			continue
+		}
+
+		credential := strings.TrimSpace(text[len(fields[0]):])
+		credential = strings.TrimSpace(credential[len(fields[1]):])
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(credential))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: could not parse public key: %v", line, err)
+		}
+
+		user.Keys = append(user.Keys, key)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// Password returns the user with the given name and password.
+func (u *Users) Password(name, password string) (*User, bool) {
+	user, ok := u.users[name]
+	if !ok {
+		return nil, false
+	}
+
+	for _, p := range user.Passwords {
+		if p == password {
+			return user, true
+		}
+	}
+
+	return nil, false
+}
+
+// Key returns the user who owns key. Keys identify their owner whatever name
+// they log in with.
+func (u *Users) Key(key ssh.PublicKey) (*User, bool) {
+	marshaled := key.Marshal()
+
+	for _, name := range u.order {
+		user := u.users[name]
+		for _, k := range user.Keys {
+			if bytes.Equal(k.Marshal(), marshaled) {
+				return user, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// Principal returns the user given principal, the first in the file if it
+// was given to more than one.
+func (u *Users) Principal(principal string) (*User, bool) {
+	for _, name := range u.order {
+		user := u.users[name]
+		for _, p := range user.Principals {
+			if p == principal {
+				return user, true
+			}
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// webAssets are the files of xterm.js the page needs, by name, and where a CDN
+// serves them.
+var webAssets = map[string]string{
+	"xterm.css":          "https://cdn.jsdelivr.net/npm/xterm@5.3.0/css/xterm.css",
+	"xterm.js":           "https://cdn.jsdelivr.net/npm/xterm@5.3.0/lib/xterm.js",
+	"xterm-addon-fit.js": "https://cdn.jsdelivr.net/npm/xterm-addon-fit@0.8.0/lib/xterm-addon-fit.js",
+}
+
+// CheckWebAssets makes sure dir holds the files of xterm.js the page needs.
+func CheckWebAssets(dir string) error {
+	for name := range webAssets {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return fmt.Errorf("%s is a directory", filepath.Join(dir, name))
+		}
+	}
+
+	return nil
+}
+
+// webPageFor is the page with its assets loaded from the CDN, or with local
+// set, from the server's /assets/.
+func webPageFor(local bool) string {
+	replacements := []string{}
+	for name, cdn := range webAssets {
+		tag := `"` + cdn + `" crossorigin="anonymous" referrerpolicy="no-referrer"`
+		if local {
+			tag = `"/assets/` + name + `"`
+		}
+		replacements = append(replacements, "{{"+name+"}}", tag)
+	}
+
+	return strings.NewReplacer(replacements...).Replace(webPage)
+}
+
+// webPage is the terminal browsers are shown. The terminal itself is
+// xterm.js, whose files are filled in by webPageFor.
+const webPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>termproxy</title>
+<link rel="stylesheet" href={{xterm.css}}>
+<script src={{xterm.js}}></script>
+<script src={{xterm-addon-fit.js}}></script>
+<style>
+html, body { margin: 0; height: 100%; background: #000; }
+#terminal { height: 100%; }
+</style>
+</head>
+<body>
+<div id="terminal"></div>
+<script>
+var term = new Terminal();
+var fit = new FitAddon.FitAddon();
+term.loadAddon(fit);
+term.open(document.getElementById("terminal"));
+
+var scheme = location.protocol === "https:" ? "wss:" : "ws:";
+var ws = new WebSocket(scheme + "//" + location.host + "/ws" + location.search);
+ws.binaryType = "arraybuffer";
+
+// the size sent is how much room the window has; the server replies with the
+// size everyone shares, and paints a view of the screen fitting the room when
+// they differ.
+function sendSize() {
+  fit.fit();
+  ws.send(JSON.stringify({ type: "resize", cols: term.cols, rows: term.rows }));
+}
+
+ws.onopen = sendSize;
+
+ws.onmessage = function(e) {
+  if (typeof e.data === "string") {
+    var msg = JSON.parse(e.data);
+    if (msg.type === "resize") {
+      document.title = "termproxy (" + msg.cols + "x" + msg.rows + ")";
+    }
+    return;
+  }
+
+  term.write(new Uint8Array(e.data));
+};
+
+ws.onclose = function() {
+  term.write("\r\n[disconnected]\r\n");
+};
+
+var encoder = new TextEncoder();
+term.onData(function(data) {
+  if (ws.readyState === WebSocket.OPEN) {
+    ws.send(encoder.encode(data));
+  }
+});
+
+window.addEventListener("resize", sendSize);
+</script>
+</body>
+</html>
+`
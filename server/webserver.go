@@ -0,0 +1,346 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/erikh/termproxy/termproxy"
+	"golang.org/x/crypto/ssh"
+)
+
+// webHelloTimeout is how long a browser has to send its terminal size once
+// it has connected.
+const webHelloTimeout = 10 * time.Second
+
+// WebServer serves a terminal page to browsers and connects them to the
+// session over a WebSocket. Browsers log in with the same passwords as SSH
+// clients, and their connections are Conns which go to the same kind of
+// handlers.
+type WebServer struct {
+	AcceptHandler func(net.Conn)
+	CloseHandler  func(net.Conn)
+	AuthHandler   func(addr net.Addr, user string, role Role, err error)
+
+	// InWinch receives the size of a browser's terminal whenever it changes.
+	// It may be shared with an SSHServer.
+	InWinch chan termproxy.Winch
+	// AssetsDir, when set, is a directory holding xterm.js's files, which the
+	// page then loads from the server instead of a CDN.
+	AssetsDir string
+
+	auth      Auth
+	authMutex sync.Mutex
+	listener  net.Listener
+
+	// invited holds the credentials of guests who loaded the page with an
+	// invite, until the page connects with them or the invite would have
+	// expired.
+	invited map[string]invitedPage
+	mutex   sync.Mutex
+}
+
+type invitedPage struct {
+	perms   *ssh.Permissions
+	expires time.Time
+}
+
+// NewWebServer listens on listenSpec for browsers. With certFile and keyFile
+// set, it serves HTTPS.
+func NewWebServer(listenSpec string, auth Auth, certFile, keyFile string) (*WebServer, error) {
+	listener, err := net.Listen("tcp", listenSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	return &WebServer{
+		InWinch:      make(chan termproxy.Winch),
+		CloseHandler: defaultCloseHandler,
+		auth:         auth,
+		listener:     listener,
+		invited:      map[string]invitedPage{},
+	}, nil
+}
+
+// Auth returns the authentication browsers are checked against.
+func (s *WebServer) Auth() Auth {
+	s.authMutex.Lock()
+	defer s.authMutex.Unlock()
+	return s.auth
+}
+
+// SetAuth changes the authentication browsers are checked against from now on.
+func (s *WebServer) SetAuth(auth Auth) {
+	s.authMutex.Lock()
+	s.auth = auth
+	s.authMutex.Unlock()
+}
+
+func (s *WebServer) Listen() error {
+	return http.Serve(s.listener, s.handler())
+}
+
+func (s *WebServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.page)
+	mux.HandleFunc("/ws", s.websocket)
+	mux.HandleFunc("/assets/", s.asset)
+	return mux
+}
+
+// login checks the request's basic authentication, asking for it if it is
+// missing or wrong. An invite is used up by loading the page, and the
+// credentials it was given with work once more, for the page's WebSocket.
+func (s *WebServer) login(w http.ResponseWriter, r *http.Request) (*ssh.Permissions, string, bool) {
+	login, pass, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="termproxy"`)
+		http.Error(w, "log in to watch this session", http.StatusUnauthorized)
+		return nil, "", false
+	}
+
+	credentials := login + "\x00" + pass
+
+	s.mutex.Lock()
+	now := time.Now()
+	for c, page := range s.invited {
+		if now.After(page.expires) {
+			delete(s.invited, c)
+		}
+	}
+	page, invited := s.invited[credentials]
+	delete(s.invited, credentials)
+	s.mutex.Unlock()
+
+	if invited {
+		return page.perms, login, true
+	}
+
+	perms, err := s.Auth().checkPassword(login, pass)
+	if err == nil && perms.Extensions["termproxy-invite"] != "" && r.URL.Path == "/" {
+		expires, _ := time.Parse(time.RFC3339Nano, perms.Extensions["termproxy-invite"])
+		s.mutex.Lock()
+		s.invited[credentials] = invitedPage{perms: perms, expires: expires}
+		s.mutex.Unlock()
+	}
+
+	if err != nil {
+		if s.AuthHandler != nil {
+			user, _ := splitLogin(login)
+			s.AuthHandler(remoteAddr(r), user, RoleReadOnly, err)
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="termproxy"`)
+		http.Error(w, "log in to watch this session", http.StatusUnauthorized)
+		return nil, "", false
+	}
+
+	return perms, login, true
+}
+
+func (s *WebServer) page(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if _, _, ok := s.login(w, r); !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, webPageFor(s.AssetsDir != ""))
+}
+
+// asset serves one of xterm.js's files from AssetsDir. They are public, so no
+// login is needed.
+func (s *WebServer) asset(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/assets/")
+	if _, ok := webAssets[name]; !ok || s.AssetsDir == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeFile(w, r, filepath.Join(s.AssetsDir, name))
+}
+
+func (s *WebServer) websocket(w http.ResponseWriter, r *http.Request) {
+	perms, login, ok := s.login(w, r)
+	if !ok {
+		return
+	}
+
+	// other sites' pages must not be able to connect with the browser's
+	// credentials.
+	if origin, err := url.Parse(r.Header.Get("Origin")); err != nil || origin.Host != r.Host {
+		http.Error(w, "cross-origin requests are not allowed", http.StatusForbidden)
+		return
+	}
+
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+
+	channel := &webChannel{ws: ws, winch: s.InWinch}
+	conn := NewConn(ws.conn, channel)
+	channel.conn = conn
+
+	_, conn.session = splitLogin(login)
+	if session := r.URL.Query().Get("session"); session != "" {
+		conn.session = session
+	}
+	conn.setPermissions(login, perms)
+	conn.pty = PTYRequest{Term: "xterm-256color"}
+	conn.env["COLORTERM"] = "truecolor"
+	conn.size = termproxy.Winch{Width: 80, Height: 24}
+
+	if s.AuthHandler != nil {
+		s.AuthHandler(conn.RemoteAddr(), conn.user, conn.role, nil)
+	}
+
+	// the page sends its size first, which is taken as the pty-req of an SSH
+	// client would be.
+	ws.conn.SetReadDeadline(time.Now().Add(webHelloTimeout))
+	if err := channel.readMessage(false); err != nil {
+		conn.Close()
+		return
+	}
+	ws.conn.SetReadDeadline(time.Time{})
+
+	if winch := conn.Winch(); winch.Width != 0 {
+		winch.Conn = conn
+		s.InWinch <- winch
+	}
+
+	if s.AcceptHandler == nil {
+		panic("no accept handler provided")
+	}
+
+	s.AcceptHandler(conn)
+	conn.Close()
+	s.CloseHandler(conn)
+}
+
+func remoteAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+// webChannel carries a browser's session over its WebSocket. Binary messages
+// are terminal data; text messages are JSON, such as
+// {"type":"resize","cols":80,"rows":24}.
+type webChannel struct {
+	ws      *wsConn
+	conn    *Conn
+	winch   chan termproxy.Winch
+	pending []byte
+}
+
+type webMessage struct {
+	Type string `json:"type"`
+	Cols uint   `json:"cols"`
+	Rows uint   `json:"rows"`
+}
+
+var errNotWebChannel = errors.New("not supported by a browser")
+
+// readMessage reads the next message, keeping terminal data for Read and
+// handling the rest. Size changes are sent on to winch if notify is set.
+func (c *webChannel) readMessage(notify bool) error {
+	opcode, message, err := c.ws.ReadMessage()
+	if err != nil {
+		return err
+	}
+
+	if opcode == wsBinary {
+		c.pending = append(c.pending, message...)
+		return nil
+	}
+
+	var msg webMessage
+	if json.Unmarshal(message, &msg) != nil || msg.Type != "resize" || msg.Cols == 0 || msg.Rows == 0 {
+		return nil
+	}
+
+	winch := termproxy.Winch{Width: msg.Cols, Height: msg.Rows}
+
+	c.conn.mutex.Lock()
+	c.conn.size = winch
+	c.conn.mutex.Unlock()
+
+	if notify {
+		winch.Conn = c.conn
+		c.winch <- winch
+	}
+
+	return nil
+}
+
+func (c *webChannel) Read(buf []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if err := c.readMessage(true); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(buf, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *webChannel) Write(buf []byte) (int, error) {
+	if err := c.ws.writeFrame(wsBinary, buf); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (c *webChannel) Close() error {
+	return c.ws.Close()
+}
+
+func (c *webChannel) CloseWrite() error {
+	return nil
+}
+
+// SendRequest passes window changes on to the page, which shows the size in
+// its title. Other requests are not supported.
+func (c *webChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	if name != "window-change" {
+		return false, errNotWebChannel
+	}
+
+	winch, err := readWinchPayload(payload)
+	if err != nil {
+		return false, err
+	}
+
+	msg, _ := json.Marshal(webMessage{Type: "resize", Cols: winch.Width, Rows: winch.Height})
+	return true, c.ws.writeFrame(wsText, msg)
+}
+
+func (c *webChannel) Stderr() io.ReadWriter {
+	return c
+}
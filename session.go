@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/erikh/termproxy/server"
+	"github.com/erikh/termproxy/termproxy"
+)
+
+// session is one shared program and everyone watching it. Each session has
+// its own PTY, screen, clients and window size.
+type session struct {
+	name     string
+	command  *termproxy.Command
+	hub      *termproxy.Hub
+	clients  *clientList
+	control  *termproxy.Control
+	escaper  *termproxy.Escaper
+	input    *termproxy.Copier
+	colors   termproxy.ColorSupport
+	recorder *termproxy.Recorder
+	started  time.Time
+	// locked makes every client but the hosts read-only.
+	locked toggle
+
+	// winsizes are the sizes of everyone's terminals, from which the program's
+	// is picked by resizePolicy. active is the terminal which typed last.
+	winsizes     map[string]termproxy.Winch
+	resizePolicy termproxy.ResizePolicy
+	active       string
+	winsizeMutex sync.Mutex
+}
+
+// sessionList holds the running sessions and which one each client joined.
+type sessionList struct {
+	sessions []*session
+	joined   map[net.Conn]*session
+	mutex    sync.Mutex
+}
+
+var sessions = &sessionList{joined: map[net.Conn]*session{}}
+
+func (l *sessionList) add(sess *session) {
+	l.mutex.Lock()
+	l.sessions = append(l.sessions, sess)
+	l.mutex.Unlock()
+}
+
+// remove forgets a session whose program has exited and returns how many
+// are left.
+func (l *sessionList) remove(sess *session) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for i, s := range l.sessions {
+		if s == sess {
+			l.sessions = append(l.sessions[:i], l.sessions[i+1:]...)
+			break
+		}
+	}
+
+	return len(l.sessions)
+}
+
+// list returns the sessions in the order they were started.
+func (l *sessionList) list() []*session {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]*session{}, l.sessions...)
+}
+
+func (l *sessionList) get(name string) *session {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, sess := range l.sessions {
+		if sess.name == name {
+			return sess
+		}
+	}
+
+	return nil
+}
+
+func (l *sessionList) join(conn net.Conn, sess *session) {
+	l.mutex.Lock()
+	l.joined[conn] = sess
+	l.mutex.Unlock()
+}
+
+// leave forgets conn and returns the session it had joined, if any.
+func (l *sessionList) leave(conn net.Conn) *session {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	sess := l.joined[conn]
+	delete(l.joined, conn)
+	return sess
+}
+
+func (l *sessionList) of(conn net.Conn) *session {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.joined[conn]
+}
+
+// parseSessionFlag splits a --session flag of the form NAME=COMMAND.
+func parseSessionFlag(spec string) (string, string, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("expected NAME=COMMAND, not %q", spec)
+	}
+
+	if strings.ContainsAny(parts[0], "+ ") {
+		return "", "", fmt.Errorf("session name %q may not contain '+' or spaces", parts[0])
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// startSession starts cmd in a new PTY of size ws and returns once it is
+// running. With recordTo set, the session is recorded to that file.
+func startSession(name, cmd string, ws termproxy.Winch, colors termproxy.ColorSupport, recordTo string) *session {
+	sess := &session{
+		name:     name,
+		hub:      termproxy.NewHub(),
+		input:    termproxy.NewCopier(),
+		colors:   colors,
+		started:  time.Now(),
+		winsizes: map[string]termproxy.Winch{},
+	}
+
+	sess.hub.Screen = termproxy.NewScreen(int(ws.Width), int(ws.Height))
+	sess.hub.HighWater = *highWater
+	sess.hub.Policy, _ = termproxy.ParseOverflowPolicy(*lagPolicyFlag)
+	sess.hub.OverflowHandler = overflowHandler(sess.hub)
+	sess.resizePolicy, _ = termproxy.ParseResizePolicy(*resizePolicyFlag)
+	sess.clients = newClientList(sess.hub)
+
+	if recordTo != "" {
+		var err error
+		sess.recorder, err = termproxy.CreateRecording(recordTo, ws, cmd)
+		if err != nil {
+			termproxy.ErrorOut(fmt.Sprintf("Could not start recording to %s", recordTo), err, termproxy.ErrUsage)
+		}
+	}
+
+	if *controlFlag {
+		sess.control = termproxy.NewControl(os.Stdin)
+		sess.escaper = termproxy.NewEscaper(controlKey, controlHandler(sess))
+	}
+
+	sess.input.Handler = func(buf []byte, w io.Writer, r io.Reader) ([]byte, error) {
+		if sess.control != nil {
+			buf = sess.escaper.Filter(r, buf)
+			if !sess.control.IsDriver(r) {
+				return nil, nil
+			}
+		}
+
+		if !canWrite(sess, r) {
+			return nil, nil
+		}
+
+		sess.typed(r)
+		return buf, nil
+	}
+
+	sess.command = setCommand(cmd, sess)
+	go launch(sess)
+	<-sess.command.Ready()
+
+	var ptyOutput io.Reader = sess.command.PTY()
+	if sess.recorder != nil {
+		ptyOutput = io.TeeReader(ptyOutput, sess.recorder)
+	}
+	go sess.hub.ReadFrom(ptyOutput)
+
+	sessions.add(sess)
+
+	return sess
+}
+
+// pickSession finds the session a new client asked for by its login name.
+// When it did not name one, and there is more than one, it is asked to pick.
+// It returns nil if the client gave up.
+func pickSession(c net.Conn) *session {
+	if conn, ok := c.(*server.Conn); ok {
+		if sess := sessions.get(conn.Session()); sess != nil {
+			return sess
+		}
+	}
+
+	buf := make([]byte, 1)
+
+	for {
+		list := sessions.list()
+		if len(list) == 1 {
+			return list[0]
+		}
+
+		fmt.Fprint(c, "\x1b[H\x1b[2JPick a session to join:\r\n\r\n")
+		for i, sess := range list {
+			if i < 9 {
+				fmt.Fprintf(c, "  %d  %s  (%s, %d watching)\r\n", i+1, sess.name, sess.command.String(), len(sess.clients.list()))
+			}
+		}
+		fmt.Fprint(c, "\r\nor q to leave. Log in as <user>+<session> to skip this.\r\n")
+
+		if _, err := c.Read(buf); err != nil {
+			return nil
+		}
+
+		switch b := buf[0]; {
+		case b == 'q' || b == 3 || b == 4:
+			return nil
+		case b >= '1' && b <= '9' && int(b-'1') < len(list):
+			return list[b-'1']
+		}
+	}
+}
+
+// join adds a client to the session, passing its input to the program until
+// it disconnects.
+func (sess *session) join(c net.Conn) {
+	if conn, ok := c.(*server.Conn); ok {
+		if conn.Colors() < sess.colors {
+			conn.Downgrade(conn.Colors())
+		}
+
+		if ws := conn.Winch(); ws.Width != 0 {
+			sess.setWinsize(c.RemoteAddr().String(), ws)
+		}
+	}
+
+	sessions.join(c, sess)
+	sess.clients.add(c)
+	defer sess.clients.remove(c)
+
+	if conn, ok := c.(*server.Conn); ok && conn.Winch().Width != 0 {
+		width, height := sess.hub.Screen.Size()
+		sess.clients.setSize(c, conn.Winch(), termproxy.Winch{Width: uint(width), Height: uint(height)})
+	}
+
+	events.emit(clientEvent("connect", sess, c))
+
+	if notify.Get() {
+		termproxy.WriteTop(sess.hub.Overlay(), fmt.Sprintf("%s connected\n", clientName(c)))
+		time.Sleep(1 * time.Second)
+		termproxy.WriteTop(sess.hub.Overlay(), string([]byte{27, '[', 'K'}))
+	}
+
+	sess.input.Copy(sess.command.PTY(), c)
+}
+
+// leave cleans up after a client of the session has disconnected.
+func (sess *session) leave(conn net.Conn) {
+	sess.forgetWinsize(conn.RemoteAddr().String())
+
+	if sess.control != nil {
+		sess.escaper.Forget(conn)
+		if sess.control.Remove(conn) {
+			termproxy.WriteTop(sess.hub.Overlay(), fmt.Sprintf("%s left; control returns to the host\n", clientName(conn)))
+			events.emit(clientEvent("control", sess, nil))
+			sess.controlChanged()
+		}
+	}
+
+	if notify.Get() {
+		termproxy.WriteTop(sess.hub.Overlay(), fmt.Sprintf("%s disconnected\n", clientName(conn)))
+	}
+
+	events.emit(clientEvent("disconnect", sess, conn))
+}
+
+// kick disconnects a client of the session on the host's behalf.
+func (sess *session) kick(conn net.Conn) {
+	conn.Close()
+
+	if notify.Get() {
+		termproxy.WriteTop(sess.hub.Overlay(), fmt.Sprintf("%s was disconnected by the host\n", clientName(conn)))
+	}
+
+	events.emit(clientEvent("kick", sess, conn))
+}
+
+// setLocked makes the session read-only for everyone but hosts, or writable
+// again.
+func (sess *session) setLocked(locked bool) {
+	if sess.locked.Get() == locked {
+		return
+	}
+	sess.locked.Set(locked)
+
+	if locked {
+		termproxy.WriteTop(sess.hub.Overlay(), "The host made the session read-only\n")
+	} else {
+		termproxy.WriteTop(sess.hub.Overlay(), "The host made the session writable again\n")
+	}
+
+	events.emit(toggleEvent("read-only", sess, locked))
+}
+
+// setPaused stops or restarts broadcasting the session's output to clients.
+func (sess *session) setPaused(paused bool) {
+	if sess.clients.isPaused() == paused {
+		return
+	}
+
+	if paused {
+		// announced before pausing, so that it is the last thing clients see.
+		termproxy.WriteTop(sess.hub.Overlay(), "The host paused the session\n")
+	}
+	sess.clients.setPaused(paused)
+
+	events.emit(toggleEvent("pause", sess, paused))
+}
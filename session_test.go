@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseSessionFlag(t *testing.T) {
+	for _, test := range []struct {
+		spec, name, command string
+		ok                  bool
+	}{
+		{"editor=vim", "editor", "vim", true},
+		{"logs=tail -f /var/log/syslog", "logs", "tail -f /var/log/syslog", true},
+		{"calc=bc -l x=1", "calc", "bc -l x=1", true},
+		{"editor", "", "", false},
+		{"=vim", "", "", false},
+		{"editor=", "", "", false},
+		{"my editor=vim", "", "", false},
+		{"a+b=vim", "", "", false},
+	} {
+		name, command, err := parseSessionFlag(test.spec)
+		if (err == nil) != test.ok || name != test.name || command != test.command {
+			t.Fatalf("%q: expected %q, %q and ok %v, got %q, %q and %v", test.spec, test.name, test.command, test.ok, name, command, err)
+		}
+	}
+}
+
+func TestPickSession(t *testing.T) {
+	old := sessions
+	defer func() { sessions = old }()
+
+	sessions = &sessionList{joined: map[net.Conn]*session{}}
+	editor, tests := newTestSession("editor", 80, 24), newTestSession("tests", 80, 24)
+	sessions.add(editor)
+
+	// pick runs pickSession for a client which types keys, and returns the
+	// session it joined and what it was shown.
+	pick := func(keys string) (*session, string) {
+		client, server := net.Pipe()
+		defer client.Close()
+
+		shown := make(chan string)
+		go func() {
+			out, _ := ioutil.ReadAll(client)
+			shown <- string(out)
+		}()
+
+		picked := make(chan *session)
+		go func() {
+			sess := pickSession(server)
+			server.Close()
+			picked <- sess
+		}()
+
+		client.Write([]byte(keys))
+		return <-picked, <-shown
+	}
+
+	// with one session there is nothing to pick.
+	if sess, output := pick(""); sess != editor || output != "" {
+		t.Fatalf("with one session, joined %v and was shown %q", sess, output)
+	}
+
+	sessions.add(tests)
+
+	// keys which pick nothing show the list again.
+	sess, output := pick("x2")
+	if sess != tests {
+		t.Fatalf("picking 2 joined %v", sess)
+	}
+
+	if strings.Count(output, "Pick a session to join") != 2 {
+		t.Fatalf("the list was not shown again after a bad key: %q", output)
+	}
+
+	for _, line := range []string{"1  editor  (/bin/cat, 0 watching)", "2  tests  (/bin/cat, 0 watching)", "<user>+<session>"} {
+		if !strings.Contains(output, line) {
+			t.Fatalf("the list does not show %q: %q", line, output)
+		}
+	}
+
+	if sess, _ := pick("1"); sess != editor {
+		t.Fatalf("picking 1 joined %v", sess)
+	}
+
+	if sess, _ := pick("q"); sess != nil {
+		t.Fatalf("leaving the list joined %v", sess)
+	}
+
+	// a session which has exited is no longer offered.
+	sessions.remove(editor)
+	if sess, output := pick(""); sess != tests || output != "" {
+		t.Fatalf("with one session left, joined %v and was shown %q", sess, output)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/erikh/termproxy/termproxy"
+)
+
+const (
+	// hookTimeout is how long a hook script may run before it is killed.
+	hookTimeout = 30 * time.Second
+	// sinkDrainTimeout is how long termproxy waits on exit for the sinks to
+	// handle the last events.
+	sinkDrainTimeout = 5 * time.Second
+)
+
+var (
+	sinkQueues []*eventQueue
+	sinksDone  sync.WaitGroup
+)
+
+// startSinks sends events to the file, webhook and hook scripts given on the
+// command line. Each sink gets every event in order, in its own goroutine, so
+// a slow one holds up nobody but itself.
+func startSinks() {
+	if *eventsFileFlag != "" {
+		f, err := os.OpenFile(*eventsFileFlag, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			termproxy.ErrorOut(fmt.Sprintf("Could not open the events file %s", *eventsFileFlag), err, termproxy.ErrUsage)
+		}
+
+		sink(fileSink(f))
+	}
+
+	if *webhookFlag != "" {
+		sink(webhookSink(*webhookFlag))
+	}
+
+	for _, hook := range *hookFlag {
+		sink(hookSink(hook))
+	}
+}
+
+func sink(handle func(event)) {
+	q := events.subscribeQueue()
+	sinkQueues = append(sinkQueues, q)
+	sinksDone.Add(1)
+
+	go func() {
+		defer sinksDone.Done()
+		for e, ok := q.pop(); ok; e, ok = q.pop() {
+			handle(e)
+		}
+	}()
+}
+
+// stopSinks waits for the sinks to handle the events they have been sent, for
+// a while, so that the last ones are not lost when termproxy exits.
+func stopSinks() {
+	for _, q := range sinkQueues {
+		events.unsubscribeQueue(q)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		sinksDone.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(sinkDrainTimeout):
+	}
+}
+
+// fileSink appends events to f as JSON, one per line.
+func fileSink(f *os.File) func(event) {
+	encoder := json.NewEncoder(f)
+
+	return func(e event) {
+		encoder.Encode(e)
+	}
+}
+
+// webhookSink POSTs each event to url as JSON. Failures are not retried.
+func webhookSink(url string) func(event) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	return func(e event) {
+		body, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// hookSink runs command with /bin/sh for each event, with the event in its
+// environment. Its output is discarded.
+func hookSink(command string) func(event) {
+	return func(e event) {
+		cmd := exec.Command("/bin/sh", "-c", command)
+		cmd.Env = append(os.Environ(), hookEnv(e)...)
+
+		if err := cmd.Start(); err != nil {
+			return
+		}
+
+		timer := time.AfterFunc(hookTimeout, func() { cmd.Process.Kill() })
+		cmd.Wait()
+		timer.Stop()
+	}
+}
+
+// hookEnv describes e in environment variables: TERMPROXY_EVENT is its type,
+// TERMPROXY_JSON the whole event, and the rest its fields, which are only set
+// when the event has them.
+func hookEnv(e event) []string {
+	body, _ := json.Marshal(e)
+
+	env := []string{
+		"TERMPROXY_EVENT=" + e.Type,
+		"TERMPROXY_TIME=" + e.Time.Format(time.RFC3339Nano),
+		"TERMPROXY_JSON=" + string(body),
+	}
+
+	set := func(name, value string) {
+		if value != "" {
+			env = append(env, "TERMPROXY_"+name+"="+value)
+		}
+	}
+
+	set("SESSION", e.Session)
+	set("ADDRESS", e.Address)
+	set("USER", e.User)
+	set("ROLE", e.Role)
+	set("ERROR", e.Error)
+	set("POLICY", e.Policy)
+
+	if e.Width != 0 || e.Height != 0 {
+		set("WIDTH", strconv.Itoa(int(e.Width)))
+		set("HEIGHT", strconv.Itoa(int(e.Height)))
+	}
+
+	if e.Enabled != nil {
+		set("ENABLED", strconv.FormatBool(*e.Enabled))
+	}
+
+	if e.Status != nil {
+		set("STATUS", strconv.Itoa(*e.Status))
+	}
+
+	return env
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSinksReceiveEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "termproxy-sinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := os.Create(filepath.Join(dir, "events"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var (
+		posted []event
+		mutex  sync.Mutex
+	)
+
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("the webhook was sent a bad event: %v", err)
+		}
+
+		mutex.Lock()
+		posted = append(posted, e)
+		mutex.Unlock()
+	}))
+	defer hook.Close()
+
+	hookOutput := filepath.Join(dir, "hook")
+
+	// a sink which holds up on the first event must still get every one after
+	// it, however many there are.
+	var slow []event
+	release := make(chan struct{})
+
+	sinkQueues = nil
+	sink(fileSink(f))
+	sink(webhookSink(hook.URL))
+	sink(hookSink(`echo "$TERMPROXY_EVENT $TERMPROXY_SESSION $TERMPROXY_WIDTH $TERMPROXY_STATUS" >> ` + hookOutput))
+	sink(func(e event) {
+		if len(slow) == 0 {
+			<-release
+		}
+		slow = append(slow, e)
+	})
+
+	status := 3
+	sent := []event{
+		{Type: "connect", Session: "main", Address: "127.0.0.1:1", User: "alice", Role: "write"},
+		{Type: "resize", Session: "main", Width: 80, Height: 24},
+		{Type: "exit", Session: "main", Status: &status},
+	}
+
+	for _, e := range sent {
+		events.emit(e)
+	}
+
+	for i := 0; i < eventBufferSize*2; i++ {
+		events.emit(event{Type: "filler", Session: fmt.Sprint(i)})
+	}
+
+	close(release)
+	stopSinks()
+	sinkQueues = nil
+
+	// the file has one JSON event per line, in the order they were sent.
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var written []event
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var e event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("the events file has a bad line %q: %v", scanner.Text(), err)
+		}
+		written = append(written, e)
+	}
+
+	checkEvents := func(sink string, got []event) {
+		if len(got) != len(sent)+eventBufferSize*2 {
+			t.Fatalf("the %s got %d events, not %d", sink, len(got), len(sent)+eventBufferSize*2)
+		}
+
+		for i, want := range sent {
+			e := got[i]
+			if e.Type != want.Type || e.Session != want.Session || e.Address != want.Address || e.User != want.User || e.Role != want.Role || e.Width != want.Width || e.Height != want.Height {
+				t.Fatalf("the %s got %+v for event %d, not %+v", sink, e, i, want)
+			}
+
+			if e.Time.IsZero() {
+				t.Fatalf("the %s got event %d without a time", sink, i)
+			}
+		}
+
+		if got[2].Status == nil || *got[2].Status != status {
+			t.Fatalf("the %s got the exit event without its status", sink)
+		}
+
+		for i, e := range got[len(sent):] {
+			if e.Type != "filler" || e.Session != fmt.Sprint(i) {
+				t.Fatalf("the %s got %+v out of order, as filler %d", sink, e, i)
+			}
+		}
+	}
+
+	checkEvents("events file", written)
+	checkEvents("slow sink", slow)
+
+	mutex.Lock()
+	checkEvents("webhook", posted)
+	mutex.Unlock()
+
+	// the hook is run once for each event, with the event in its environment.
+	content, err := ioutil.ReadFile(hookOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(string(content), "\n")
+	want := []string{"connect main  ", "resize main 80 ", "exit main  3"}
+	for i, line := range want {
+		if lines[i] != line {
+			t.Fatalf("hook run %d was given %q, not %q", i, lines[i], line)
+		}
+	}
+
+	if len(lines) != len(sent)+eventBufferSize*2+1 {
+		t.Fatalf("the hook was run %d times, not %d", len(lines)-1, len(sent)+eventBufferSize*2)
+	}
+}
+
+func TestEventQueueClose(t *testing.T) {
+	bus := &eventBus{subscribers: map[chan event]struct{}{}, queues: map[*eventQueue]struct{}{}}
+	q := bus.subscribeQueue()
+
+	bus.emit(event{Type: "connect"})
+	bus.emit(event{Type: "disconnect"})
+	bus.unsubscribeQueue(q)
+
+	// events sent after the queue is closed do not reach it, but those sent
+	// before are still handed out.
+	bus.emit(event{Type: "exit"})
+
+	for _, want := range []string{"connect", "disconnect"} {
+		e, ok := q.pop()
+		if !ok || e.Type != want {
+			t.Fatalf("popped %+v, %v; want a %s event", e, ok, want)
+		}
+	}
+
+	done := make(chan bool)
+	go func() {
+		_, ok := q.pop()
+		done <- ok
+	}()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatal("popped an event from an emptied, closed queue")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("popping an emptied, closed queue did not return")
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+
+	"github.com/erikh/termproxy/termproxy"
+)
+
+// setProgramTerm sets the TERM, and COLORTERM, the program is started with
+// and returns the color support they promise it. Without --term they are
+// picked to suit the host's terminal; clients whose terminals can show fewer
+// colors are sent downgraded output.
+func setProgramTerm() termproxy.ColorSupport {
+	if *termFlag != "" {
+		os.Setenv("TERM", *termFlag)
+		return termproxy.TermColors(*termFlag, os.Getenv("COLORTERM"))
+	}
+
+	colors := termproxy.TermColors(os.Getenv("TERM"), os.Getenv("COLORTERM"))
+
+	switch colors {
+	case termproxy.ColorsTrue:
+		os.Setenv("TERM", "screen-256color")
+		os.Setenv("COLORTERM", "truecolor")
+	case termproxy.Colors256:
+		os.Setenv("TERM", "screen-256color")
+		os.Unsetenv("COLORTERM")
+	default:
+		os.Setenv("TERM", "screen")
+		os.Unsetenv("COLORTERM")
+		colors = termproxy.Colors16
+	}
+
+	return colors
+}
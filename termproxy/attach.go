@@ -0,0 +1,86 @@
+package termproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Frames are what a terminal attached to a daemon over its Unix socket sends
+// it. Output goes the other way unframed.
+const (
+	// FrameHello starts every attach with the terminal's TERM and COLORTERM.
+	FrameHello byte = iota
+	// FrameInput carries keys typed at the terminal.
+	FrameInput
+	// FrameWinch carries the terminal's new size.
+	FrameWinch
+)
+
+// maxFrame bounds the payload of a frame.
+const maxFrame = 1 << 16
+
+var errFrameTooLarge = errors.New("frame too large")
+
+// WriteFrame writes a frame of kind with payload to w in one call.
+func WriteFrame(w io.Writer, kind byte, payload []byte) error {
+	if len(payload) >= maxFrame {
+		return errFrameTooLarge
+	}
+
+	buf := make([]byte, 3, 3+len(payload))
+	buf[0] = kind
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(payload)))
+
+	_, err := w.Write(append(buf, payload...))
+	return err
+}
+
+// ReadFrame reads the next frame from r.
+func ReadFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], payload, nil
+}
+
+// HelloPayload and ParseHello encode the TERM and COLORTERM of a FrameHello.
+func HelloPayload(term, colorterm string) []byte {
+	return []byte(term + "\n" + colorterm)
+}
+
+func ParseHello(payload []byte) (string, string) {
+	parts := strings.SplitN(string(payload), "\n", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// WinchPayload and ParseWinch encode the size in a FrameWinch.
+func WinchPayload(ws Winch) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint16(buf, uint16(ws.Width))
+	binary.BigEndian.PutUint16(buf[2:], uint16(ws.Height))
+	return buf
+}
+
+func ParseWinch(payload []byte) (Winch, error) {
+	if len(payload) != 4 {
+		return Winch{}, errors.New("malformed window size")
+	}
+
+	return Winch{
+		Width:  uint(binary.BigEndian.Uint16(payload)),
+		Height: uint(binary.BigEndian.Uint16(payload[2:])),
+	}, nil
+}
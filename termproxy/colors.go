@@ -0,0 +1,294 @@
+package termproxy
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ColorSupport is how many colors a terminal can show.
+type ColorSupport int
+
+const (
+	ColorsNone ColorSupport = iota
+	Colors16
+	Colors256
+	ColorsTrue
+)
+
+func (c ColorSupport) String() string {
+	switch c {
+	case ColorsNone:
+		return "no colors"
+	case Colors16:
+		return "16 colors"
+	case Colors256:
+		return "256 colors"
+	case ColorsTrue:
+		return "truecolor"
+	}
+
+	return "ColorSupport(" + strconv.Itoa(int(c)) + ")"
+}
+
+// TermColors guesses the color support of a terminal from its TERM and
+// COLORTERM, either of which may be empty.
+func TermColors(term, colorterm string) ColorSupport {
+	switch {
+	case colorterm == "truecolor" || colorterm == "24bit":
+		return ColorsTrue
+	case term == "" || term == "dumb" || strings.HasPrefix(term, "vt") || strings.HasSuffix(term, "-mono"):
+		return ColorsNone
+	case strings.Contains(term, "direct") || strings.Contains(term, "truecolor") || strings.Contains(term, "24bit"):
+		return ColorsTrue
+	case strings.Contains(term, "256color"):
+		return Colors256
+	}
+
+	return Colors16
+}
+
+// maxFilterSequence bounds how much of an unfinished escape sequence a
+// ColorFilter holds on to before giving up and passing it through.
+const maxFilterSequence = 256
+
+// ColorFilter writes output to a terminal with less color support than the
+// program producing it, rewriting colors to the nearest ones the terminal
+// can show. Other output passes through untouched.
+type ColorFilter struct {
+	writer io.Writer
+	colors ColorSupport
+	// seq holds an escape sequence which may be split across writes.
+	seq   []byte
+	mutex sync.Mutex
+}
+
+func NewColorFilter(w io.Writer, colors ColorSupport) *ColorFilter {
+	return &ColorFilter{writer: w, colors: colors}
+}
+
+func (f *ColorFilter) Write(buf []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	out := make([]byte, 0, len(buf))
+
+	for _, b := range buf {
+		switch {
+		case len(f.seq) == 0:
+			if b == 27 {
+				f.seq = append(f.seq, b)
+			} else {
+				out = append(out, b)
+			}
+		case len(f.seq) == 1:
+			if b == '[' {
+				f.seq = append(f.seq, b)
+			} else {
+				out = append(append(out, f.seq...), b)
+				f.seq = f.seq[:0]
+			}
+		case b == 27:
+			// a new sequence abandons the unfinished one.
+			out = append(out, f.seq...)
+			f.seq = append(f.seq[:0], b)
+		default:
+			f.seq = append(f.seq, b)
+
+			if b >= 0x40 && b <= 0x7e {
+				if b == 'm' {
+					out = append(out, f.sgr(f.seq[2:len(f.seq)-1])...)
+				} else {
+					out = append(out, f.seq...)
+				}
+				f.seq = f.seq[:0]
+			} else if len(f.seq) > maxFilterSequence || b < 0x20 || b > 0x7e {
+				out = append(out, f.seq...)
+				f.seq = f.seq[:0]
+			}
+		}
+	}
+
+	if _, err := f.writer.Write(out); err != nil {
+		return 0, err
+	}
+
+	return len(buf), nil
+}
+
+// Close closes the underlying writer if it is an io.Closer.
+func (f *ColorFilter) Close() error {
+	if closer, ok := f.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// sgr rewrites the parameters of an SGR sequence.
+func (f *ColorFilter) sgr(params []byte) []byte {
+	if len(params) == 0 || params[0] < '0' || params[0] > ';' {
+		// empty, or a private sequence which is not SGR at all.
+		return []byte("\x1b[" + string(params) + "m")
+	}
+
+	items := strings.Split(string(params), ";")
+	kept := []string{}
+
+	for i := 0; i < len(items); i++ {
+		item := items[i]
+
+		// extended colors come as "38;5;n" and "38;2;r;g;b", or with colons as
+		// "38:5:n", "38:2:r:g:b" and "38:2::r:g:b".
+		var sub []string
+		if strings.Contains(item, ":") {
+			sub = strings.Split(item, ":")
+		} else if item == "38" || item == "48" || item == "58" {
+			sub = []string{item}
+			if i+1 < len(items) {
+				n := 0
+				switch items[i+1] {
+				case "5":
+					n = 2
+				case "2":
+					n = 4
+				}
+				if i+n < len(items) {
+					sub = items[i : i+n+1]
+					i += n
+				}
+			}
+		}
+
+		if sub != nil {
+			kept = append(kept, f.extendedColor(sub)...)
+			continue
+		}
+
+		if n, err := strconv.Atoi(item); err == nil && f.colors == ColorsNone && isBasicColor(n) {
+			continue
+		}
+
+		kept = append(kept, item)
+	}
+
+	if len(kept) == 0 {
+		return nil
+	}
+
+	return []byte("\x1b[" + strings.Join(kept, ";") + "m")
+}
+
+func isBasicColor(n int) bool {
+	return (n >= 30 && n <= 37) || (n >= 40 && n <= 47) || (n >= 90 && n <= 97) || (n >= 100 && n <= 107)
+}
+
+// extendedColor converts the parts of a 38, 48 or 58 color into parameters
+// the terminal understands.
+func (f *ColorFilter) extendedColor(sub []string) []string {
+	if len(sub) < 2 {
+		return nil
+	}
+
+	var rgb [3]int
+	index := -1
+
+	switch sub[1] {
+	case "5":
+		if len(sub) < 3 {
+			return nil
+		}
+		index, _ = strconv.Atoi(sub[2])
+	case "2":
+		// the colon form may carry a color space id before the components.
+		values := sub[2:]
+		if len(values) > 3 {
+			values = values[len(values)-3:]
+		}
+		if len(values) < 3 {
+			return nil
+		}
+		for i, v := range values {
+			rgb[i], _ = strconv.Atoi(v)
+		}
+	default:
+		return nil
+	}
+
+	// underline colors are dropped rather than approximated.
+	if sub[0] == "58" || f.colors == ColorsNone {
+		return nil
+	}
+
+	base := 30
+	if sub[0] == "48" {
+		base = 40
+	}
+
+	if f.colors == Colors256 {
+		if index < 0 {
+			index = nearestColor(rgb, 16, 256)
+		}
+		return []string{strconv.Itoa(base + 8), "5", strconv.Itoa(index)}
+	}
+
+	if index < 0 || index > 15 {
+		if index >= 0 {
+			rgb = paletteColor(index)
+		}
+		index = nearestColor(rgb, 0, 16)
+	}
+
+	if index < 8 {
+		return []string{strconv.Itoa(base + index)}
+	}
+	return []string{strconv.Itoa(base + 60 + index - 8)}
+}
+
+// nearestColor returns the palette index in [from, to) closest to rgb.
+func nearestColor(rgb [3]int, from, to int) int {
+	best, bestDistance := from, -1
+
+	for i := from; i < to; i++ {
+		c := paletteColor(i)
+
+		distance := 0
+		for j := range c {
+			d := c[j] - rgb[j]
+			distance += d * d
+		}
+
+		if bestDistance < 0 || distance < bestDistance {
+			best, bestDistance = i, distance
+		}
+	}
+
+	return best
+}
+
+var ansiPalette = [16][3]int{
+	{0, 0, 0}, {205, 0, 0}, {0, 205, 0}, {205, 205, 0},
+	{0, 0, 238}, {205, 0, 205}, {0, 205, 205}, {229, 229, 229},
+	{127, 127, 127}, {255, 0, 0}, {0, 255, 0}, {255, 255, 0},
+	{92, 92, 255}, {255, 0, 255}, {0, 255, 255}, {255, 255, 255},
+}
+
+// paletteColor returns the RGB value xterm gives a color of its 256 color
+// palette.
+func paletteColor(index int) [3]int {
+	switch {
+	case index < 0:
+		return [3]int{}
+	case index < 16:
+		return ansiPalette[index]
+	case index < 232:
+		levels := []int{0, 95, 135, 175, 215, 255}
+		index -= 16
+		return [3]int{levels[index/36], levels[index/6%6], levels[index%6]}
+	case index < 256:
+		gray := 8 + (index-232)*10
+		return [3]int{gray, gray, gray}
+	}
+
+	return [3]int{255, 255, 255}
+}
@@ -13,13 +13,15 @@ type Command struct {
 	CloseHandler    func(*Command)
 	PTYSetupHandler func(*Command)
 	WinchHandler    func(*Command)
+	ResizeHandler   func(*Command, Winch)
 	pty             *os.File
 	command         *exec.Cmd
 	commandString   string
+	ready           chan struct{}
 }
 
 func NewCommand(command string) *Command {
-	return &Command{commandString: command}
+	return &Command{commandString: command, ready: make(chan struct{})}
 }
 
 func (c *Command) String() string {
@@ -30,6 +32,22 @@ func (c *Command) PTY() *os.File {
 	return c.pty
 }
 
+// Ready is closed once the PTY has been started and PTY() may be used.
+func (c *Command) Ready() <-chan struct{} {
+	return c.ready
+}
+
+// Resize notifies the ResizeHandler and then sets the size of the PTY. The
+// handler goes first so that whatever the program paints in answer to the
+// SIGWINCH is read at the new size.
+func (c *Command) Resize(ws Winch) error {
+	if c.ResizeHandler != nil {
+		c.ResizeHandler(c, ws)
+	}
+
+	return SetWinsize(c.pty.Fd(), ws)
+}
+
 func (c *Command) Quit() error {
 	return c.command.Process.Signal(syscall.SIGTERM)
 }
@@ -48,14 +66,24 @@ func (c *Command) Run() error {
 		c.PTYSetupHandler(c)
 	}
 
+	close(c.ready)
+
 	if c.WinchHandler != nil {
-		sigchan := make(chan os.Signal)
+		sigchan := make(chan os.Signal, 1)
 		signal.Notify(sigchan, syscall.SIGWINCH)
-		// FIXME leaky goroutine
+		defer signal.Stop(sigchan)
+
+		done := make(chan struct{})
+		defer close(done)
+
 		go func() {
 			for {
-				<-sigchan
-				c.WinchHandler(c)
+				select {
+				case <-sigchan:
+					c.WinchHandler(c)
+				case <-done:
+					return
+				}
 			}
 		}()
 	}
@@ -64,6 +92,20 @@ func (c *Command) Run() error {
 	return nil
 }
 
+// ExitStatus is the exit status of the program once Run has returned, or -1
+// if it was killed by a signal.
+func (c *Command) ExitStatus() int {
+	if c.command == nil || c.command.ProcessState == nil {
+		return -1
+	}
+
+	if status, ok := c.command.ProcessState.Sys().(syscall.WaitStatus); ok {
+		return status.ExitStatus()
+	}
+
+	return -1
+}
+
 func (c *Command) waitForClose() {
 	c.command.Wait()
 
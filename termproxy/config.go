@@ -0,0 +1,271 @@
+package termproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// ConfigValue is a setting from a configuration file: a single value, or a
+// list of them. Booleans and numbers are kept as they were written.
+type ConfigValue struct {
+	Values []string
+	List   bool
+}
+
+// Config is a configuration file, written in a subset of TOML. Settings come
+// first, and are followed by profiles, which override them:
+//
+//	listen = "0.0.0.0:2222"
+//	authorized-keys = ["/etc/termproxy/keys", "https://github.com/sam.keys"]
+//	notifications = true   # strings, booleans, integers and lists of them
+//
+//	[profile.demo]
+//	read-only = true
+//	high-water = 65536
+type Config struct {
+	Settings map[string]ConfigValue
+	Profiles map[string]map[string]ConfigValue
+}
+
+// LoadConfig reads the configuration file at filename.
+func LoadConfig(filename string) (*Config, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := ParseConfig(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	return config, nil
+}
+
+// ParseConfig parses the contents of a configuration file.
+func ParseConfig(content []byte) (*Config, error) {
+	p := &configParser{text: string(content), line: 1}
+	config := &Config{
+		Settings: map[string]ConfigValue{},
+		Profiles: map[string]map[string]ConfigValue{},
+	}
+
+	settings := config.Settings
+
+	for {
+		p.skipSpace(true)
+		if p.done() {
+			return config, nil
+		}
+
+		if p.peek() == '[' {
+			p.pos++
+			end := strings.IndexAny(p.text[p.pos:], "]\n")
+			if end < 0 || p.text[p.pos+end] != ']' {
+				return nil, p.errorf("expected ] to end the table name")
+			}
+
+			table := strings.TrimSpace(p.text[p.pos : p.pos+end])
+			p.pos += end + 1
+
+			name := strings.TrimPrefix(table, "profile.")
+			if name == table || !isBareKey(name) {
+				return nil, p.errorf("expected a table named profile.NAME, not %q", table)
+			}
+			if _, ok := config.Profiles[name]; ok {
+				return nil, p.errorf("profile %q is given twice", name)
+			}
+
+			settings = map[string]ConfigValue{}
+			config.Profiles[name] = settings
+		} else {
+			key := p.bare()
+			if key == "" {
+				return nil, p.errorf("expected a setting's name")
+			}
+
+			p.skipSpace(false)
+			if p.done() || p.peek() != '=' {
+				return nil, p.errorf("expected = after %s", key)
+			}
+			p.pos++
+			p.skipSpace(false)
+
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+
+			if _, ok := settings[key]; ok {
+				return nil, p.errorf("%s is given twice", key)
+			}
+			settings[key] = value
+		}
+
+		p.skipSpace(false)
+		if !p.done() && p.peek() != '\n' {
+			return nil, p.errorf("expected the end of the line")
+		}
+	}
+}
+
+// Profile returns the settings with those of the named profile laid over
+// them. An empty name gives the settings alone.
+func (c *Config) Profile(name string) (map[string]ConfigValue, error) {
+	settings := map[string]ConfigValue{}
+	for key, value := range c.Settings {
+		settings[key] = value
+	}
+
+	if name == "" {
+		return settings, nil
+	}
+
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("there is no profile %q", name)
+	}
+
+	for key, value := range profile {
+		settings[key] = value
+	}
+
+	return settings, nil
+}
+
+type configParser struct {
+	text string
+	pos  int
+	line int
+}
+
+func (p *configParser) done() bool {
+	return p.pos >= len(p.text)
+}
+
+func (p *configParser) peek() byte {
+	return p.text[p.pos]
+}
+
+func (p *configParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+// skipSpace skips spaces and comments, and newlines too if newlines is set.
+func (p *configParser) skipSpace(newlines bool) {
+	for !p.done() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '\n' && newlines:
+			p.pos++
+			p.line++
+		case c == '#':
+			for !p.done() && p.peek() != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func isBareKey(s string) bool {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// bare reads a bare key, or a bare value such as true or 42.
+func (p *configParser) bare() string {
+	start := p.pos
+	for !p.done() && isBareKey(p.text[p.pos:p.pos+1]) {
+		p.pos++
+	}
+	return p.text[start:p.pos]
+}
+
+func (p *configParser) value() (ConfigValue, error) {
+	if p.done() || p.peek() != '[' {
+		value, err := p.scalar()
+		return ConfigValue{Values: []string{value}}, err
+	}
+
+	p.pos++
+	list := ConfigValue{Values: []string{}, List: true}
+
+	for {
+		p.skipSpace(true)
+		if p.done() {
+			return list, p.errorf("expected ] to end the list")
+		}
+		if p.peek() == ']' {
+			p.pos++
+			return list, nil
+		}
+
+		value, err := p.scalar()
+		if err != nil {
+			return list, err
+		}
+		list.Values = append(list.Values, value)
+
+		p.skipSpace(true)
+		if !p.done() && p.peek() == ',' {
+			p.pos++
+		} else if p.done() || p.peek() != ']' {
+			return list, p.errorf("expected , or ] in the list")
+		}
+	}
+}
+
+func (p *configParser) scalar() (string, error) {
+	if p.done() {
+		return "", p.errorf("expected a value")
+	}
+
+	switch p.peek() {
+	case '"':
+		end := p.pos + 1
+		for end < len(p.text) && p.text[end] != '"' && p.text[end] != '\n' {
+			if p.text[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(p.text) || p.text[end] != '"' {
+			return "", p.errorf("expected \" to end the string")
+		}
+
+		value, err := strconv.Unquote(p.text[p.pos : end+1])
+		if err != nil {
+			return "", p.errorf("cannot read the string %s", p.text[p.pos:end+1])
+		}
+		p.pos = end + 1
+		return value, nil
+	case '\'':
+		end := strings.IndexAny(p.text[p.pos+1:], "'\n")
+		if end < 0 || p.text[p.pos+1+end] != '\'' {
+			return "", p.errorf("expected ' to end the string")
+		}
+
+		value := p.text[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return value, nil
+	}
+
+	value := p.bare()
+	if value == "true" || value == "false" {
+		return value, nil
+	}
+	if _, err := strconv.Atoi(value); err == nil {
+		return value, nil
+	}
+
+	return "", p.errorf("expected a string, a boolean, a number or a list, not %q", value)
+}
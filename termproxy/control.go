@@ -0,0 +1,118 @@
+package termproxy
+
+import "sync"
+
+// Control is the token which decides whose input reaches the program. Exactly
+// one owner, the driver, holds it at a time; the others may queue up to ask
+// for it. Owners are any comparable value identifying an input, such as the
+// net.Conn or io.Reader it is read from.
+type Control struct {
+	host     interface{}
+	driver   interface{}
+	requests []interface{}
+	mutex    sync.Mutex
+}
+
+// NewControl returns a Control driven by host. Control returns to the host
+// whenever the driver releases it or goes away.
+func NewControl(host interface{}) *Control {
+	return &Control{host: host, driver: host}
+}
+
+// Driver returns the current driver.
+func (c *Control) Driver() interface{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.driver
+}
+
+// IsDriver reports whether owner currently holds control.
+func (c *Control) IsDriver(owner interface{}) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.driver == owner
+}
+
+// Request queues owner for control. It returns false if owner is already the
+// driver or already waiting.
+func (c *Control) Request(owner interface{}) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.driver == owner || c.waiting(owner) >= 0 {
+		return false
+	}
+
+	c.requests = append(c.requests, owner)
+	return true
+}
+
+// Requests returns the owners waiting for control, oldest first.
+func (c *Control) Requests() []interface{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]interface{}{}, c.requests...)
+}
+
+// Grant gives control to the owner which has waited longest, and returns it.
+// It returns false if nobody is waiting.
+func (c *Control) Grant() (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.requests) == 0 {
+		return nil, false
+	}
+
+	c.driver = c.requests[0]
+	c.requests = c.requests[1:]
+	return c.driver, true
+}
+
+// Give makes owner the driver, whether or not it asked.
+func (c *Control) Give(owner interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if i := c.waiting(owner); i >= 0 {
+		c.requests = append(c.requests[:i], c.requests[i+1:]...)
+	}
+	c.driver = owner
+}
+
+// Release returns control to the host if owner is the driver. It reports
+// whether owner was the driver.
+func (c *Control) Release(owner interface{}) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.driver != owner || owner == c.host {
+		return false
+	}
+
+	c.driver = c.host
+	return true
+}
+
+// Remove forgets owner, returning control to the host if it was driving. It
+// reports whether owner was the driver.
+func (c *Control) Remove(owner interface{}) bool {
+	c.mutex.Lock()
+	if i := c.waiting(owner); i >= 0 {
+		c.requests = append(c.requests[:i], c.requests[i+1:]...)
+	}
+	c.mutex.Unlock()
+
+	return c.Release(owner)
+}
+
+// waiting returns the position of owner among the requests, or -1. The lock
+// must be held.
+func (c *Control) waiting(owner interface{}) int {
+	for i, r := range c.requests {
+		if r == owner {
+			return i
+		}
+	}
+	return -1
+}
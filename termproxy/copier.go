@@ -23,21 +23,25 @@ func (c *Copier) Copy(w io.Writer, r io.Reader) error {
 			return err
 		}
 
-		c.ioLock.Lock()
-
-		buf = buf[:n]
-
-		if c.Handler != nil {
-			var err error
-			if buf, err = c.Handler(buf, w, r); err != nil {
-				c.ioLock.Unlock()
-				return err
-			}
+		if err := c.Write(w, r, buf[:n]); err != nil {
+			return err
 		}
+	}
+}
 
-		w.Write(buf)
+// Write passes buf, which the caller read from r, through the Handler to w,
+// just as Copy does with what it reads.
+func (c *Copier) Write(w io.Writer, r io.Reader, buf []byte) error {
+	c.ioLock.Lock()
+	defer c.ioLock.Unlock()
 
-		c.ioLock.Unlock()
+	if c.Handler != nil {
+		var err error
+		if buf, err = c.Handler(buf, w, r); err != nil {
+			return err
+		}
 	}
+
+	w.Write(buf)
 	return nil
 }
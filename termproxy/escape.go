@@ -0,0 +1,50 @@
+package termproxy
+
+import "sync"
+
+// Escaper picks key commands out of input, in the manner of ssh's "~." or
+// telnet's Ctrl-]. A command is Key followed by one more byte, which is
+// passed to Handler along with the input's owner; Key typed twice sends a
+// single Key through. A command may be split across reads.
+type Escaper struct {
+	Key     byte
+	Handler func(owner interface{}, command byte)
+
+	pending map[interface{}]bool
+	mutex   sync.Mutex
+}
+
+func NewEscaper(key byte, handler func(interface{}, byte)) *Escaper {
+	return &Escaper{Key: key, Handler: handler, pending: map[interface{}]bool{}}
+}
+
+// Filter returns buf with any commands removed, calling Handler for each of
+// them in turn.
+func (e *Escaper) Filter(owner interface{}, buf []byte) []byte {
+	out := make([]byte, 0, len(buf))
+
+	for _, b := range buf {
+		e.mutex.Lock()
+		pending := e.pending[owner]
+		e.pending[owner] = !pending && b == e.Key
+		e.mutex.Unlock()
+
+		switch {
+		case pending && b != e.Key:
+			if e.Handler != nil {
+				e.Handler(owner, b)
+			}
+		case pending || b != e.Key:
+			out = append(out, b)
+		}
+	}
+
+	return out
+}
+
+// Forget drops any command owner has half typed.
+func (e *Escaper) Forget(owner interface{}) {
+	e.mutex.Lock()
+	delete(e.pending, owner)
+	e.mutex.Unlock()
+}
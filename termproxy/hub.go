@@ -0,0 +1,599 @@
+package termproxy
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultHighWater is the number of bytes a subscriber may fall behind before
+// its overflow policy is applied.
+const DefaultHighWater = 1 << 20
+
+// disconnectTimeout bounds how long a lagging subscriber is given to accept
+// its disconnect message before its writer is closed anyway.
+var disconnectTimeout = 5 * time.Second
+
+// OverflowPolicy decides what happens to a subscriber that falls further
+// behind than the hub's high-water mark.
+type OverflowPolicy int
+
+const (
+	// OverflowResync drops everything queued for the subscriber and replaces it
+	// with a redraw of the screen.
+	OverflowResync OverflowPolicy = iota
+	// OverflowDisconnect sends the subscriber a message and closes its writer.
+	OverflowDisconnect
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowResync:
+		return "resync"
+	case OverflowDisconnect:
+		return "disconnect"
+	}
+
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// ParseOverflowPolicy converts the name of a policy into an OverflowPolicy.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch name {
+	case "resync":
+		return OverflowResync, nil
+	case "disconnect":
+		return OverflowDisconnect, nil
+	}
+
+	return 0, fmt.Errorf("unknown overflow policy %q", name)
+}
+
+// HubStats counts how often subscribers fell behind.
+type HubStats struct {
+	Overflows    uint64
+	Resyncs      uint64
+	Disconnects  uint64
+	DroppedBytes uint64
+}
+
+// Hub fans output out to many writers. Each writer is fed by its own goroutine
+// from its own queue, so a slow writer only ever delays itself.
+type Hub struct {
+	// HighWater is the number of queued bytes at which a subscriber's overflow
+	// policy is applied.
+	HighWater int
+	// Policy is the overflow policy given to new subscribers.
+	Policy OverflowPolicy
+	// Screen, when set, is fed everything broadcast. New and resynced
+	// subscribers are painted the current screen before any other output;
+	// without it a resynced subscriber's screen is only cleared.
+	Screen *Screen
+	// OverflowHandler is called whenever a subscriber's overflow policy is
+	// applied.
+	OverflowHandler func(*Subscriber, OverflowPolicy)
+
+	subscribers map[*Subscriber]struct{}
+	stats       HubStats
+	mutex       sync.Mutex
+}
+
+// Subscriber is a single writer registered with a Hub.
+type Subscriber struct {
+	writer io.Writer
+	policy OverflowPolicy
+	paused bool
+
+	// width and height are the size of the subscriber's terminal, if known,
+	// and screenWidth and screenHeight the Screen's when it was last fitted.
+	// While the terminal's size differs from the Screen's, the subscriber is
+	// painted views of the screen instead of being sent the broadcasts; dirty
+	// says the screen has changed since the last, fresh that the terminal
+	// must be painted afresh, and notices are drawn over the top row after
+	// the next.
+	width, height int
+	screenWidth   int
+	screenHeight  int
+	viewing       bool
+	dirty         bool
+	fresh         bool
+	notices       [][]byte
+
+	queue  [][]byte
+	queued int
+	stats  HubStats
+	mutex  sync.Mutex
+
+	wake chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		HighWater:   DefaultHighWater,
+		Policy:      OverflowResync,
+		subscribers: map[*Subscriber]struct{}{},
+	}
+}
+
+// Subscribe registers w with the hub using the hub's overflow policy and
+// starts delivering broadcasts to it.
+func (h *Hub) Subscribe(w io.Writer) *Subscriber {
+	return h.SubscribePolicy(w, h.Policy)
+}
+
+// SubscribePolicy registers w with the hub using the given overflow policy.
+// Delivery stops when w returns an error or the subscriber is unsubscribed.
+// OverflowDisconnect is only honored when w is an io.Closer.
+func (h *Hub) SubscribePolicy(w io.Writer, policy OverflowPolicy) *Subscriber {
+	if _, ok := w.(io.Closer); !ok {
+		policy = OverflowResync
+	}
+
+	sub := &Subscriber{
+		writer: w,
+		policy: policy,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	h.mutex.Lock()
+	if h.Screen != nil {
+		sub.Push(h.Screen.Paint())
+		sub.screenWidth, sub.screenHeight = h.Screen.Size()
+	}
+	h.subscribers[sub] = struct{}{}
+	h.mutex.Unlock()
+
+	go h.deliver(sub)
+
+	return sub
+}
+
+// Unsubscribe stops delivery to sub. It is safe to call more than once.
+func (h *Hub) Unsubscribe(sub *Subscriber) {
+	sub.once.Do(func() { close(sub.done) })
+
+	h.mutex.Lock()
+	delete(h.subscribers, sub)
+	h.mutex.Unlock()
+}
+
+// Pause stops broadcasts reaching sub until it is resumed. Output given to
+// its Push method is still delivered.
+func (h *Hub) Pause(sub *Subscriber) {
+	h.mutex.Lock()
+	sub.mutex.Lock()
+	sub.paused = true
+	sub.mutex.Unlock()
+	h.mutex.Unlock()
+}
+
+// Resume restarts broadcasts to a paused subscriber. It is painted the current
+// screen first, or has its screen cleared without one, so that it catches up
+// on what it missed.
+func (h *Hub) Resume(sub *Subscriber) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	sub.mutex.Lock()
+	paused := sub.paused
+	sub.paused = false
+	sub.mutex.Unlock()
+
+	if !paused {
+		return
+	}
+
+	if sub.isViewing() {
+		sub.repaint()
+		return
+	}
+
+	redraw := []byte{27, 'c'}
+	if h.Screen != nil {
+		redraw = h.Screen.Paint()
+	}
+	sub.Push(redraw)
+}
+
+// SetSize tells the hub the size of sub's terminal. While it differs from the
+// size of the hub's Screen, sub is painted its own view of the screen: in the
+// middle of a larger terminal, or scrolled to follow the cursor on a smaller
+// one.
+func (h *Hub) SetSize(sub *Subscriber, width, height int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	sub.mutex.Lock()
+	sub.width, sub.height = width, height
+	sub.mutex.Unlock()
+
+	h.fit(sub)
+}
+
+// Refit fits every subscriber to the Screen again after it has been resized.
+func (h *Hub) Refit() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for sub := range h.subscribers {
+		h.fit(sub)
+	}
+}
+
+// fit decides whether sub is painted views of the screen, and repaints it when
+// that or the screen's size has changed. A subscriber whose size is unknown
+// is sent the broadcasts, and painted afresh when the screen is resized. The
+// hub lock must be held.
+func (h *Hub) fit(sub *Subscriber) {
+	if h.Screen == nil {
+		return
+	}
+
+	width, height := h.Screen.Size()
+
+	sub.mutex.Lock()
+	known := sub.width != 0 && sub.height != 0
+	viewing := known && (sub.width != width || sub.height != height)
+	resized := sub.screenWidth != 0 && (sub.screenWidth != width || sub.screenHeight != height)
+	wasViewing := sub.viewing
+	paused := sub.paused
+
+	sub.viewing = viewing
+	sub.screenWidth, sub.screenHeight = width, height
+	sub.mutex.Unlock()
+
+	switch {
+	case paused:
+		// it is repainted when it is resumed.
+	case viewing && !wasViewing:
+		sub.repaint()
+	case viewing:
+		sub.redraw()
+	case wasViewing || resized:
+		sub.Push(h.Screen.Paint())
+	}
+}
+
+// PaintFor returns what paints sub's terminal afresh: the Screen's Paint, or a
+// view of the screen if sub's terminal is a different size.
+func (h *Hub) PaintFor(sub *Subscriber) []byte {
+	width, height := h.Screen.Size()
+
+	sub.mutex.Lock()
+	subWidth, subHeight := sub.width, sub.height
+	sub.mutex.Unlock()
+
+	if subWidth == 0 || subHeight == 0 || (subWidth == width && subHeight == height) {
+		return h.Screen.Paint()
+	}
+
+	return h.Screen.paintView(newView(subWidth, subHeight))
+}
+
+// Stats returns the overflow counters for every subscriber the hub has had.
+func (h *Hub) Stats() HubStats {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.stats
+}
+
+// Writer returns the writer the subscriber delivers to.
+func (sub *Subscriber) Writer() io.Writer {
+	return sub.writer
+}
+
+// Done is closed when the subscriber stops receiving output.
+func (sub *Subscriber) Done() <-chan struct{} {
+	return sub.done
+}
+
+// Size returns the size of the subscriber's terminal given to SetSize, or
+// zeros if it was never given one.
+func (sub *Subscriber) Size() (int, int) {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	return sub.width, sub.height
+}
+
+// Stats returns the overflow counters for this subscriber.
+func (sub *Subscriber) Stats() HubStats {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	return sub.stats
+}
+
+// Broadcast queues a copy of buf for every subscriber. It never waits on a
+// subscriber's writer.
+func (h *Hub) Broadcast(buf []byte) {
+	h.broadcast(buf, true)
+}
+
+// Overlay returns a writer which broadcasts without feeding the Screen, for
+// notices drawn over the program's output which should not become part of
+// it. They are lost when a subscriber is repainted.
+func (h *Hub) Overlay() io.Writer {
+	return overlay{h}
+}
+
+type overlay struct {
+	hub *Hub
+}
+
+func (o overlay) Write(buf []byte) (int, error) {
+	o.hub.broadcast(buf, false)
+	return len(buf), nil
+}
+
+func (h *Hub) broadcast(buf []byte, screen bool) {
+	if len(buf) == 0 {
+		return
+	}
+
+	chunk := make([]byte, len(buf))
+	copy(chunk, buf)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if screen && h.Screen != nil {
+		h.Screen.Write(chunk)
+	}
+
+	for sub := range h.subscribers {
+		sub.mutex.Lock()
+		if sub.paused {
+			sub.mutex.Unlock()
+			continue
+		}
+
+		if sub.viewing {
+			sub.dirty = true
+			if !screen {
+				sub.notices = append(sub.notices, chunk)
+			}
+			sub.mutex.Unlock()
+
+			sub.notify()
+			continue
+		}
+
+		overflow := h.HighWater > 0 && sub.queued+len(chunk) > h.HighWater
+		if overflow {
+			h.overflow(sub, chunk)
+		} else {
+			sub.queue = append(sub.queue, chunk)
+			sub.queued += len(chunk)
+		}
+		sub.mutex.Unlock()
+
+		sub.notify()
+
+		if overflow && h.OverflowHandler != nil {
+			go h.OverflowHandler(sub, sub.policy)
+		}
+	}
+}
+
+// overflow applies the subscriber's policy. Both the hub and subscriber locks
+// must be held.
+func (h *Hub) overflow(sub *Subscriber, chunk []byte) {
+	dropped := uint64(sub.queued + len(chunk))
+
+	sub.queue = nil
+	sub.queued = 0
+
+	for _, stats := range []*HubStats{&h.stats, &sub.stats} {
+		stats.Overflows++
+		stats.DroppedBytes += dropped
+	}
+
+	switch sub.policy {
+	case OverflowDisconnect:
+		h.stats.Disconnects++
+		sub.stats.Disconnects++
+
+		delete(h.subscribers, sub)
+		sub.once.Do(func() { close(sub.done) })
+		go disconnect(sub)
+	default:
+		h.stats.Resyncs++
+		sub.stats.Resyncs++
+
+		if sub.viewing {
+			sub.dirty, sub.fresh = true, true
+			return
+		}
+
+		redraw := []byte{27, 'c'}
+		if h.Screen != nil {
+			redraw = h.Screen.Paint()
+		}
+
+		sub.queue = append(sub.queue, redraw)
+		sub.queued = len(redraw)
+	}
+}
+
+// Overlay returns a writer which sends notices to this subscriber alone, like
+// the hub's Overlay. They are dropped while it is paused.
+func (sub *Subscriber) Overlay() io.Writer {
+	return subscriberOverlay{sub}
+}
+
+type subscriberOverlay struct {
+	sub *Subscriber
+}
+
+func (o subscriberOverlay) Write(buf []byte) (int, error) {
+	sub := o.sub
+	notice := append([]byte{}, buf...)
+
+	sub.mutex.Lock()
+	switch {
+	case sub.paused:
+	case sub.viewing:
+		sub.dirty = true
+		sub.notices = append(sub.notices, notice)
+	default:
+		sub.queue = append(sub.queue, notice)
+		sub.queued += len(notice)
+	}
+	sub.mutex.Unlock()
+
+	sub.notify()
+	return len(buf), nil
+}
+
+// Push queues buf for delivery to this subscriber alone, outside of any
+// broadcast.
+func (sub *Subscriber) Push(buf []byte) {
+	sub.mutex.Lock()
+	sub.queue = append(sub.queue, buf)
+	sub.queued += len(buf)
+	sub.mutex.Unlock()
+
+	sub.notify()
+}
+
+func (sub *Subscriber) isViewing() bool {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	return sub.viewing
+}
+
+// redraw has the subscriber's view painted again.
+func (sub *Subscriber) redraw() {
+	sub.mutex.Lock()
+	sub.dirty = true
+	sub.mutex.Unlock()
+
+	sub.notify()
+}
+
+// repaint has the subscriber's view painted afresh, clearing its terminal.
+func (sub *Subscriber) repaint() {
+	sub.mutex.Lock()
+	sub.dirty, sub.fresh = true, true
+	sub.mutex.Unlock()
+
+	sub.notify()
+}
+
+func (sub *Subscriber) notify() {
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+func disconnect(sub *Subscriber) {
+	closer := sub.writer.(io.Closer)
+	timer := time.AfterFunc(disconnectTimeout, func() { closer.Close() })
+
+	WriteClear(sub.writer)
+	fmt.Fprint(sub.writer, "Disconnected by termproxy: your connection could not keep up with the output.\r\n")
+
+	if timer.Stop() {
+		closer.Close()
+	}
+}
+
+// Write broadcasts buf, allowing the hub to be used as an io.Writer.
+func (h *Hub) Write(buf []byte) (int, error) {
+	h.Broadcast(buf)
+	return len(buf), nil
+}
+
+// ReadFrom broadcasts everything read from r until r returns an error.
+func (h *Hub) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	buf := make([]byte, 4096)
+
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			total += int64(n)
+			h.Broadcast(buf[:n])
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				return total, nil
+			}
+			return total, err
+		}
+	}
+}
+
+func (h *Hub) deliver(sub *Subscriber) {
+	defer h.Unsubscribe(sub)
+
+	var v *view
+
+	for {
+		select {
+		case <-sub.done:
+			return
+		case <-sub.wake:
+		}
+
+		for {
+			sub.mutex.Lock()
+			if len(sub.queue) == 0 {
+				sub.mutex.Unlock()
+				break
+			}
+
+			chunk := sub.queue[0]
+			sub.queue[0] = nil
+			sub.queue = sub.queue[1:]
+			sub.queued -= len(chunk)
+			sub.mutex.Unlock()
+
+			select {
+			case <-sub.done:
+				return
+			default:
+			}
+
+			if _, err := sub.writer.Write(chunk); err != nil {
+				return
+			}
+		}
+
+		sub.mutex.Lock()
+		paint := sub.viewing && sub.dirty && !sub.paused
+		fresh, notices := sub.fresh, sub.notices
+		width, height := sub.width, sub.height
+		if paint {
+			sub.dirty, sub.fresh, sub.notices = false, false, nil
+		}
+		sub.mutex.Unlock()
+
+		if !paint {
+			continue
+		}
+
+		if v == nil || fresh || v.width != width || v.height != height {
+			v = newView(width, height)
+		}
+
+		// notices go over the frame, and the row they cover is painted again
+		// once it next changes.
+		frame := h.Screen.paintView(v)
+		for _, notice := range notices {
+			frame = append(frame, notice...)
+			v.forget(0)
+		}
+
+		if len(frame) > 0 {
+			if _, err := sub.writer.Write(frame); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package termproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// RecordedEvent is a single output ("o") or resize ("r") event of a recording.
+type RecordedEvent struct {
+	Time time.Duration
+	Type string
+	Data string
+}
+
+// Recording is a session read back from an asciicast v2 file.
+type Recording struct {
+	Width   int
+	Height  int
+	Command string
+	Events  []RecordedEvent
+}
+
+// LoadRecording reads the asciicast v2 file at filename.
+func LoadRecording(filename string) (*Recording, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadRecording(f)
+}
+
+// ReadRecording reads an asciicast v2 recording from r.
+func ReadRecording(r io.Reader) (*Recording, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("recording is empty")
+	}
+
+	var header asciicastHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return nil, fmt.Errorf("could not parse recording header: %v", err)
+	}
+
+	if header.Version != 2 {
+		return nil, fmt.Errorf("unsupported recording version %d", header.Version)
+	}
+
+	rec := &Recording{Width: header.Width, Height: header.Height, Command: header.Command}
+
+	for line := 2; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("could not parse event on line %d: %v", line, err)
+		}
+
+		if len(event) != 3 {
+			return nil, fmt.Errorf("malformed event on line %d", line)
+		}
+
+		t, ok1 := event[0].(float64)
+		kind, ok2 := event[1].(string)
+		data, ok3 := event[2].(string)
+		if !ok1 || !ok2 || !ok3 {
+			return nil, fmt.Errorf("malformed event on line %d", line)
+		}
+
+		rec.Events = append(rec.Events, RecordedEvent{
+			Time: time.Duration(t * float64(time.Second)),
+			Type: kind,
+			Data: data,
+		})
+	}
+
+	return rec, scanner.Err()
+}
+
+// Duration is the time of the last event in the recording.
+func (r *Recording) Duration() time.Duration {
+	if len(r.Events) == 0 {
+		return 0
+	}
+	return r.Events[len(r.Events)-1].Time
+}
+
+// CapIdle returns a copy of the recording in which no pause between events is
+// longer than limit.
+func (r *Recording) CapIdle(limit time.Duration) *Recording {
+	capped := *r
+	capped.Events = make([]RecordedEvent, len(r.Events))
+
+	var last, shift time.Duration
+	for i, event := range r.Events {
+		if gap := event.Time - last; gap > limit {
+			shift += gap - limit
+		}
+		last = event.Time
+
+		event.Time -= shift
+		capped.Events[i] = event
+	}
+
+	return &capped
+}
+
+// Player plays a recording back in real time. Output events are written to
+// Output and resize events are passed to ResizeHandler.
+type Player struct {
+	Recording     *Recording
+	Output        io.Writer
+	ResizeHandler func(width, height int)
+	// Speed multiplies the playback rate; 2 plays twice as fast.
+	Speed float64
+	// Hold keeps Play running at the end of the recording, so that it can still
+	// be seeked, until Quit is called.
+	Hold bool
+
+	position time.Duration
+	next     int
+	paused   bool
+	width    int
+	height   int
+
+	control chan func()
+	quit    chan struct{}
+	once    sync.Once
+}
+
+func NewPlayer(rec *Recording, output io.Writer) *Player {
+	return &Player{
+		Recording: rec,
+		Output:    output,
+		Speed:     1,
+		width:     rec.Width,
+		height:    rec.Height,
+		control:   make(chan func()),
+		quit:      make(chan struct{}),
+	}
+}
+
+// Play plays the recording until it ends or Quit is called.
+func (p *Player) Play() {
+	for {
+		var timer <-chan time.Time
+
+		if !p.paused && p.next < len(p.Recording.Events) {
+			wait := time.Duration(float64(p.Recording.Events[p.next].Time-p.position) / p.Speed)
+			timer = time.After(wait)
+		} else if !p.Hold && p.next >= len(p.Recording.Events) {
+			return
+		}
+
+		started := time.Now()
+
+		select {
+		case <-p.quit:
+			return
+		case f := <-p.control:
+			if !p.paused {
+				p.position += time.Duration(float64(time.Since(started)) * p.Speed)
+			}
+			f()
+		case <-timer:
+			event := p.Recording.Events[p.next]
+			p.position = event.Time
+			p.next++
+			p.apply(event, p.Output)
+		}
+	}
+}
+
+func (p *Player) apply(event RecordedEvent, output io.Writer) {
+	switch event.Type {
+	case "o":
+		io.WriteString(output, event.Data)
+	case "r":
+		var width, height int
+		if _, err := fmt.Sscanf(event.Data, "%dx%d", &width, &height); err != nil {
+			return
+		}
+
+		p.width, p.height = width, height
+		if output == p.Output && p.ResizeHandler != nil {
+			p.ResizeHandler(width, height)
+		}
+	}
+}
+
+// TogglePause pauses or resumes playback.
+func (p *Player) TogglePause() {
+	p.do(func() { p.paused = !p.paused })
+}
+
+// Seek moves playback by offset, which may be negative. The screen at the new
+// position is rebuilt and painted to Output.
+func (p *Player) Seek(offset time.Duration) {
+	p.do(func() {
+		target := p.position + offset
+		if target < 0 {
+			target = 0
+		}
+		if duration := p.Recording.Duration(); target > duration {
+			target = duration
+		}
+
+		p.width, p.height = p.Recording.Width, p.Recording.Height
+		screen := NewScreen(p.width, p.height)
+
+		p.next = 0
+		for p.next < len(p.Recording.Events) && p.Recording.Events[p.next].Time <= target {
+			event := p.Recording.Events[p.next]
+			p.apply(event, screen)
+			if event.Type == "r" {
+				screen.Resize(p.width, p.height)
+			}
+			p.next++
+		}
+
+		p.position = target
+
+		if p.ResizeHandler != nil {
+			p.ResizeHandler(p.width, p.height)
+		}
+		p.Output.Write(screen.Paint())
+	})
+}
+
+// Quit stops playback.
+func (p *Player) Quit() {
+	p.once.Do(func() { close(p.quit) })
+}
+
+func (p *Player) do(f func()) {
+	select {
+	case p.control <- f:
+	case <-p.quit:
+	}
+}
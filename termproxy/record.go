@@ -0,0 +1,161 @@
+package termproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// asciicastHeader is the first line of an asciicast v2 file.
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Recorder writes a session to an asciicast v2 file: a JSON header followed
+// by one JSON array per output or resize event.
+type Recorder struct {
+	writer io.Writer
+	start  time.Time
+	// partial holds the start of a UTF-8 sequence split across writes, as
+	// event data must be valid UTF-8.
+	partial       []byte
+	width, height int
+	err           error
+	mutex         sync.Mutex
+}
+
+// CreateRecording creates (or truncates) filename and starts a recording of a
+// terminal of the given size running command.
+func CreateRecording(filename string, ws Winch, command string) (*Recorder, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewRecorder(f, ws, command)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// NewRecorder writes the asciicast header to w and returns a Recorder for the
+// events which follow it.
+func NewRecorder(w io.Writer, ws Winch, command string) (*Recorder, error) {
+	start := time.Now()
+
+	header := asciicastHeader{
+		Version:   2,
+		Width:     int(ws.Width),
+		Height:    int(ws.Height),
+		Timestamp: start.Unix(),
+		Command:   command,
+		Env:       map[string]string{"TERM": os.Getenv("TERM"), "SHELL": os.Getenv("SHELL")},
+	}
+
+	content, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(append(content, '\n')); err != nil {
+		return nil, err
+	}
+
+	return &Recorder{writer: w, start: start, width: header.Width, height: header.Height}, nil
+}
+
+// Write records buf as output. It never fails, so that a recording cannot
+// interrupt the session it is attached to; see Err.
+func (r *Recorder) Write(buf []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.err != nil {
+		return len(buf), nil
+	}
+
+	data := append(r.partial, buf...)
+	end := completeUTF8(data)
+	r.partial = append([]byte{}, data[end:]...)
+
+	if end == 0 {
+		return len(buf), nil
+	}
+
+	r.err = r.event("o", string(data[:end]))
+	return len(buf), nil
+}
+
+// Err returns the error which stopped the recording, if any.
+func (r *Recorder) Err() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+// Resize records a change of the terminal's size. Sizes equal to the last one
+// recorded are ignored.
+func (r *Recorder) Resize(width, height int) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	if width == r.width && height == r.height {
+		return nil
+	}
+
+	r.width, r.height = width, height
+	r.err = r.event("r", fmt.Sprintf("%dx%d", width, height))
+	return r.err
+}
+
+// Close closes the underlying writer if it is an io.Closer.
+func (r *Recorder) Close() error {
+	if closer, ok := r.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (r *Recorder) event(kind, data string) error {
+	elapsed := float64(time.Since(r.start)/time.Microsecond) / 1e6
+
+	content, err := json.Marshal([]interface{}{elapsed, kind, data})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.writer.Write(append(content, '\n'))
+	return err
+}
+
+// completeUTF8 returns the length of buf without a trailing, incomplete UTF-8
+// sequence.
+func completeUTF8(buf []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(buf); i++ {
+		b := buf[len(buf)-i]
+		if utf8.RuneStart(b) {
+			if !utf8.FullRune(buf[len(buf)-i:]) {
+				return len(buf) - i
+			}
+			break
+		}
+	}
+
+	return len(buf)
+}
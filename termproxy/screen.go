@@ -0,0 +1,463 @@
+package termproxy
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ColorType says how the value of a Color is interpreted.
+type ColorType uint8
+
+const (
+	ColorDefault ColorType = iota
+	ColorIndexed
+	ColorRGB
+)
+
+// Color is a foreground or background color. Indexed colors cover both the 16
+// ANSI colors and the 256 color palette; RGB colors hold 0xRRGGBB.
+type Color struct {
+	Type  ColorType
+	Value uint32
+}
+
+// AttrFlags are the boolean rendition attributes of a cell.
+type AttrFlags uint16
+
+const (
+	AttrBold AttrFlags = 1 << iota
+	AttrDim
+	AttrItalic
+	AttrUnderline
+	AttrBlink
+	AttrReverse
+	AttrHidden
+	AttrStrike
+)
+
+// Attr is the graphic rendition of a cell.
+type Attr struct {
+	FG    Color
+	BG    Color
+	Flags AttrFlags
+}
+
+// Cell is a single character position on the screen. The second column of a
+// wide character holds a Cell with a zero Rune.
+type Cell struct {
+	Rune rune
+	Wide bool
+	Attr Attr
+}
+
+type cursor struct {
+	x, y     int
+	attr     Attr
+	wrapNext bool
+	origin   bool
+	charsets [2]byte
+	shift    int
+}
+
+type buffer struct {
+	lines [][]Cell
+	saved cursor
+}
+
+// Screen is a virtual terminal. Output from the program is written to it, and
+// at any point the screen can be painted onto a real terminal with Paint.
+type Screen struct {
+	width, height int
+
+	primary, alternate *buffer
+	active             *buffer
+
+	cursor       cursor
+	top, bottom  int
+	tabs         []bool
+	autowrap     bool
+	insert       bool
+	hidden       bool
+	appKeypad    bool
+	cursorStyle  int
+	privateModes map[int]bool
+	title        string
+
+	parser parser
+	mutex  sync.Mutex
+}
+
+// replayedModes are the DEC private modes which change how a client terminal
+// behaves and so must be restored when a screen is painted.
+var replayedModes = []int{1, 1000, 1002, 1003, 1004, 1005, 1006, 1015, 2004}
+
+func NewScreen(width, height int) *Screen {
+	if width < 1 {
+		width = 1
+	}
+
+	if height < 1 {
+		height = 1
+	}
+
+	s := &Screen{width: width, height: height}
+	s.reset()
+	return s
+}
+
+func (s *Screen) reset() {
+	s.primary = newBuffer(s.width, s.height)
+	s.alternate = newBuffer(s.width, s.height)
+	s.active = s.primary
+	s.cursor = cursor{charsets: [2]byte{'B', 'B'}}
+	s.top, s.bottom = 0, s.height-1
+	s.tabs = defaultTabs(s.width)
+	s.autowrap = true
+	s.insert = false
+	s.hidden = false
+	s.appKeypad = false
+	s.cursorStyle = 0
+	s.privateModes = map[int]bool{}
+	s.title = ""
+	s.parser = parser{}
+}
+
+func newBuffer(width, height int) *buffer {
+	b := &buffer{lines: make([][]Cell, height)}
+	for i := range b.lines {
+		b.lines[i] = blankLine(width, Attr{})
+	}
+	b.saved = cursor{charsets: [2]byte{'B', 'B'}}
+	return b
+}
+
+func blankLine(width int, attr Attr) []Cell {
+	line := make([]Cell, width)
+	for i := range line {
+		line[i] = blankCell(attr)
+	}
+	return line
+}
+
+func blankCell(attr Attr) Cell {
+	// erased cells keep only the background color of the pen.
+	return Cell{Rune: ' ', Attr: Attr{BG: attr.BG}}
+}
+
+func defaultTabs(width int) []bool {
+	tabs := make([]bool, width)
+	for i := 8; i < width; i += 8 {
+		tabs[i] = true
+	}
+	return tabs
+}
+
+// Write feeds program output to the screen.
+func (s *Screen) Write(buf []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, b := range buf {
+		s.parser.feed(s, b)
+	}
+
+	return len(buf), nil
+}
+
+// Size returns the width and height of the screen.
+func (s *Screen) Size() (int, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.width, s.height
+}
+
+// Cursor returns the zero-based column and row of the cursor.
+func (s *Screen) Cursor() (int, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cursor.x, s.cursor.y
+}
+
+// Cell returns the cell at the zero-based column and row.
+func (s *Screen) Cell(x, y int) Cell {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if x < 0 || y < 0 || x >= s.width || y >= s.height {
+		return Cell{}
+	}
+
+	return s.active.lines[y][x]
+}
+
+// Text returns the characters on the screen, one string per line, without
+// their attributes or trailing spaces.
+func (s *Screen) Text() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	lines := make([]string, len(s.active.lines))
+
+	for y, cells := range s.active.lines {
+		line := make([]rune, 0, len(cells))
+		for _, cell := range cells {
+			if cell.Rune != 0 {
+				line = append(line, cell.Rune)
+			}
+		}
+		lines[y] = strings.TrimRight(string(line), " ")
+	}
+
+	return lines
+}
+
+// Resize changes the dimensions of the screen, keeping the cursor's line in
+// view when the screen shrinks.
+func (s *Screen) Resize(width, height int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if width < 1 || height < 1 || (width == s.width && height == s.height) {
+		return
+	}
+
+	for _, b := range []*buffer{s.primary, s.alternate} {
+		shift := 0
+		if b == s.active && s.cursor.y >= height {
+			shift = s.cursor.y - height + 1
+		}
+
+		lines := make([][]Cell, height)
+		for y := range lines {
+			if y+shift < len(b.lines) {
+				lines[y] = resizeLine(b.lines[y+shift], width)
+			} else {
+				lines[y] = blankLine(width, Attr{})
+			}
+		}
+		b.lines = lines
+
+		if b == s.active {
+			s.cursor.y -= shift
+		}
+		b.saved.x, b.saved.y = clamp(b.saved.x, 0, width-1), clamp(b.saved.y, 0, height-1)
+	}
+
+	s.width, s.height = width, height
+	s.top, s.bottom = 0, height-1
+	s.cursor.x = clamp(s.cursor.x, 0, width-1)
+	s.cursor.y = clamp(s.cursor.y, 0, height-1)
+	s.cursor.wrapNext = false
+
+	tabs := defaultTabs(width)
+	copy(tabs, s.tabs)
+	s.tabs = tabs
+}
+
+func resizeLine(line []Cell, width int) []Cell {
+	if len(line) >= width {
+		line = line[:width]
+		if width > 0 && line[width-1].Wide {
+			line[width-1] = blankCell(line[width-1].Attr)
+		}
+		return line
+	}
+
+	return append(line, blankLine(width-len(line), Attr{})...)
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// Paint returns the bytes which reproduce the screen, including the cursor,
+// pen, scroll region and input modes, on a terminal of the same size.
+func (s *Screen) Paint() []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("\x1bc\x1b[H\x1b[2J")
+
+	if s.title != "" {
+		fmt.Fprintf(buf, "\x1b]2;%s\x07", s.title)
+	}
+
+	if s.active == s.alternate {
+		s.paintLines(buf, s.primary)
+		fmt.Fprintf(buf, "\x1b[0m%s\x1b[%d;%dH\x1b[?1049h", sgr(s.primary.saved.attr), s.primary.saved.y+1, s.primary.saved.x+1)
+	}
+
+	s.paintLines(buf, s.active)
+	buf.WriteString("\x1b[0m")
+
+	if s.top != 0 || s.bottom != s.height-1 {
+		fmt.Fprintf(buf, "\x1b[%d;%dr", s.top+1, s.bottom+1)
+	}
+
+	for _, mode := range replayedModes {
+		if s.privateModes[mode] {
+			fmt.Fprintf(buf, "\x1b[?%dh", mode)
+		}
+	}
+
+	if !s.autowrap {
+		buf.WriteString("\x1b[?7l")
+	}
+
+	if s.insert {
+		buf.WriteString("\x1b[4h")
+	}
+
+	if s.appKeypad {
+		buf.WriteString("\x1b=")
+	}
+
+	if s.cursorStyle != 0 {
+		fmt.Fprintf(buf, "\x1b[%d q", s.cursorStyle)
+	}
+
+	// DECOM makes cursor addressing relative to the scroll region.
+	x, y, row := s.cursor.x, s.cursor.y, s.cursor.y+1
+	if s.cursor.origin {
+		buf.WriteString("\x1b[?6h")
+		row -= s.top
+	}
+
+	// a pending wrap can only be reproduced by printing the last column again,
+	// or the wide character ending in it.
+	if s.cursor.wrapNext && x > 0 && s.active.lines[y][x].Rune == 0 {
+		x--
+	}
+	fmt.Fprintf(buf, "\x1b[%d;%dH", row, x+1)
+	if cell := s.active.lines[y][x]; s.cursor.wrapNext && cell.Rune != 0 {
+		buf.WriteString(sgr(cell.Attr))
+		buf.WriteString(string(cell.Rune))
+	}
+
+	fmt.Fprintf(buf, "\x1b[0m%s", sgr(s.cursor.attr))
+
+	for i, set := range s.cursor.charsets {
+		if set != 'B' {
+			fmt.Fprintf(buf, "\x1b%c%c", "()"[i], set)
+		}
+	}
+
+	if s.cursor.shift == 1 {
+		buf.WriteByte(0x0e)
+	}
+
+	if s.hidden {
+		buf.WriteString("\x1b[?25l")
+	}
+
+	return buf.Bytes()
+}
+
+func (s *Screen) paintLines(buf *bytes.Buffer, b *buffer) {
+	var pen Attr
+
+	buf.WriteString("\x1b[0m")
+
+	for y, line := range b.lines {
+		end := len(line)
+		for end > 0 && line[end-1].Rune == ' ' && line[end-1].Attr == (Attr{}) {
+			end--
+		}
+
+		if end == 0 {
+			continue
+		}
+
+		fmt.Fprintf(buf, "\x1b[%d;1H", y+1)
+
+		for x := 0; x < end; x++ {
+			cell := line[x]
+			if cell.Rune == 0 {
+				continue
+			}
+
+			if cell.Attr != pen {
+				buf.WriteString("\x1b[0m")
+				buf.WriteString(sgr(cell.Attr))
+				pen = cell.Attr
+			}
+
+			buf.WriteString(string(cell.Rune))
+		}
+	}
+
+	if pen != (Attr{}) {
+		buf.WriteString("\x1b[0m")
+	}
+}
+
+// sgr returns the sequence which applies attr on top of a reset pen.
+func sgr(attr Attr) string {
+	if attr == (Attr{}) {
+		return ""
+	}
+
+	params := []string{}
+
+	flags := []struct {
+		flag  AttrFlags
+		param string
+	}{
+		{AttrBold, "1"}, {AttrDim, "2"}, {AttrItalic, "3"}, {AttrUnderline, "4"},
+		{AttrBlink, "5"}, {AttrReverse, "7"}, {AttrHidden, "8"}, {AttrStrike, "9"},
+	}
+
+	for _, f := range flags {
+		if attr.Flags&f.flag != 0 {
+			params = append(params, f.param)
+		}
+	}
+
+	params = append(params, colorParams(attr.FG, 30)...)
+	params = append(params, colorParams(attr.BG, 40)...)
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("\x1b[")
+	for i, param := range params {
+		if i > 0 {
+			buf.WriteByte(';')
+		}
+		buf.WriteString(param)
+	}
+	buf.WriteByte('m')
+
+	return buf.String()
+}
+
+func colorParams(c Color, base int) []string {
+	switch c.Type {
+	case ColorIndexed:
+		switch {
+		case c.Value < 8:
+			return []string{strconv.Itoa(base + int(c.Value))}
+		case c.Value < 16:
+			return []string{strconv.Itoa(base + 60 + int(c.Value) - 8)}
+		default:
+			return []string{strconv.Itoa(base + 8), "5", strconv.Itoa(int(c.Value))}
+		}
+	case ColorRGB:
+		return []string{
+			strconv.Itoa(base + 8), "2",
+			strconv.Itoa(int(c.Value >> 16 & 0xff)),
+			strconv.Itoa(int(c.Value >> 8 & 0xff)),
+			strconv.Itoa(int(c.Value & 0xff)),
+		}
+	}
+
+	return nil
+}
@@ -67,27 +67,13 @@ func setwinsize(fd uintptr, winch Winch) error {
 }
 
 func writetop(w io.Writer, str string) error {
-	var err error
-
-	_, err = w.Write([]byte{27, '7'})
-	if err != nil {
-		return err
-	}
-
-	_, err = w.Write([]byte{27, '[', '7', 'm', 27, '[', '1', ';', '1', 'H', 27, '[', '2', 'K'})
-	if err != nil {
-		return err
-	}
-
-	_, err = w.Write([]byte(str))
-	if err != nil {
-		return err
-	}
-
-	_, err = w.Write([]byte{27, '[', '0', 'm', 27, '8'})
-	if err != nil {
-		return err
-	}
-
-	return nil
+	// the banner is written in one call so it cannot be split up by other
+	// output when w is shared.
+	buf := []byte{27, '7'}
+	buf = append(buf, 27, '[', '7', 'm', 27, '[', '1', ';', '1', 'H', 27, '[', '2', 'K')
+	buf = append(buf, str...)
+	buf = append(buf, 27, '[', '0', 'm', 27, '8')
+
+	_, err := w.Write(buf)
+	return err
 }
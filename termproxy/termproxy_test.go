@@ -2,7 +2,11 @@ package termproxy
 
 import (
 	"bytes"
+	"encoding/json"
 	"io"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -13,23 +17,28 @@ func TestCommand(t *testing.T) {
 		t.Fatal("Command string did not equal what was passed")
 	}
 
-	var closed, ptyd bool
+	var ptyd bool
+	closed := make(chan struct{})
 
 	cmd.PTYSetupHandler = func(c *Command) {
 		ptyd = true
 	}
 
 	cmd.CloseHandler = func(c *Command) {
-		closed = true
+		close(closed)
 	}
 
 	go func() {
 		if err := cmd.Run(); err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 	}()
 
-	time.Sleep(1 * time.Second)
+	select {
+	case <-cmd.Ready():
+	case <-time.After(1 * time.Second):
+		t.Fatal("Command was not ready after one second")
+	}
 
 	if cmd.PTY() == nil {
 		t.Fatal("PTY was nil after execution")
@@ -56,13 +65,63 @@ func TestCommand(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	time.Sleep(100 * time.Millisecond)
-
-	if !closed {
+	select {
+	case <-closed:
+	case <-time.After(100 * time.Millisecond):
 		t.Fatal("Command was not closed after run")
 	}
 }
 
+func TestCommandExitStatus(t *testing.T) {
+	cmd := NewCommand("exit 3")
+
+	if cmd.ExitStatus() != -1 {
+		t.Fatal("Command had an exit status before it ran")
+	}
+
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := cmd.ExitStatus(); status != 3 {
+		t.Fatalf("expected exit status 3, got %d", status)
+	}
+}
+
+func TestCommandResize(t *testing.T) {
+	cmd := NewCommand(`trap 'printf "%s %030d\n" "$(stty size)" 0' WINCH; echo ready; while :; do sleep 0.01; done`)
+	screen := NewScreen(10, 5)
+
+	cmd.PTYSetupHandler = func(c *Command) {
+		if err := SetWinsize(c.PTY().Fd(), Winch{Width: 10, Height: 5}); err != nil {
+			t.Error(err)
+		}
+		go io.Copy(screen, c.PTY())
+	}
+
+	cmd.ResizeHandler = func(c *Command, ws Winch) {
+		// the program has not been told yet.
+		if old, err := GetWinsize(c.PTY().Fd()); err != nil || old.Width != 10 {
+			t.Errorf("the PTY was resized before the handler ran: %dx%d, %v", old.Width, old.Height, err)
+		}
+		screen.Resize(int(ws.Width), int(ws.Height))
+	}
+
+	go cmd.Run()
+	defer cmd.Quit()
+	<-cmd.Ready()
+
+	waitFor(t, "the program to start", func() bool { return screen.Text()[0] == "ready" })
+
+	if err := cmd.Resize(Winch{Width: 40, Height: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the program's answer fits on one line of the resized screen.
+	expected := "5 40 " + strings.Repeat("0", 30)
+	waitFor(t, "the program to repaint", func() bool { return screen.Text()[1] == expected })
+}
+
 func TestCopier(t *testing.T) {
 	c := NewCopier()
 	buf1, buf2, buf3 := new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer)
@@ -81,16 +140,855 @@ func TestCopier(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	go c.Copy(buf3, buf2)
-	go c.Copy(buf3, buf1)
-
-	time.Sleep(10 * time.Millisecond)
+	for _, buf := range []*bytes.Buffer{buf2, buf1} {
+		done := make(chan struct{})
+		go func(r io.Reader) {
+			c.Copy(buf3, r)
+			close(done)
+		}(buf)
+		<-done
+	}
 
 	if string(buf3.Bytes()) != "poopfart" {
-		t.Fatal("String was malformed after copy: %q", string(buf3.Bytes()))
+		t.Fatalf("String was malformed after copy: %q", string(buf3.Bytes()))
 	}
 
 	if !handled {
 		t.Fatal("Handler was not triggered during copy")
 	}
 }
+
+type syncBuffer struct {
+	buf   bytes.Buffer
+	mutex sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+type blockingWriter chan struct{}
+
+func (b blockingWriter) Write(p []byte) (int, error) {
+	<-b
+	return len(p), nil
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestHub(t *testing.T) {
+	hub := NewHub()
+	out1, out2 := new(syncBuffer), new(syncBuffer)
+
+	hub.Subscribe(out1)
+	sub2 := hub.Subscribe(out2)
+
+	if _, err := hub.ReadFrom(strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "first broadcast", func() bool {
+		return out1.String() == "hello" && out2.String() == "hello"
+	})
+
+	hub.Unsubscribe(sub2)
+
+	if _, err := hub.Write([]byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "second broadcast", func() bool { return out1.String() == "hello world" })
+
+	if out2.String() != "hello" {
+		t.Fatalf("unsubscribed writer received output: %q", out2.String())
+	}
+}
+
+type closingWriter struct {
+	blockingWriter
+	closed chan struct{}
+}
+
+func (c closingWriter) Write(p []byte) (int, error) {
+	select {
+	case <-c.blockingWriter:
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	}
+	return len(p), nil
+}
+
+func (c closingWriter) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestHubResync(t *testing.T) {
+	hub := NewHub()
+	hub.HighWater = 16
+	hub.Screen = NewScreen(80, 24)
+
+	block := make(blockingWriter)
+	slow := hub.Subscribe(block)
+
+	painted := len(hub.Screen.Paint())
+	fast := new(syncBuffer)
+	hub.Subscribe(fast)
+	waitFor(t, "initial paint", func() bool { return len(fast.String()) == painted })
+
+	for i := 1; i <= 8; i++ {
+		hub.Broadcast([]byte("0123456789"))
+		waitFor(t, "fast subscriber", func() bool { return len(fast.String()) == painted+i*10 })
+	}
+
+	if stats := slow.Stats(); stats.Resyncs == 0 || stats.Disconnects != 0 {
+		t.Fatalf("slow subscriber was not resynced: %+v", stats)
+	}
+
+	if stats := hub.Stats(); stats.Overflows != slow.Stats().Overflows || stats.DroppedBytes == 0 {
+		t.Fatalf("hub stats did not match subscriber stats: %+v", stats)
+	}
+
+	close(block)
+}
+
+func TestHubPause(t *testing.T) {
+	hub := NewHub()
+	hub.Screen = NewScreen(20, 2)
+
+	out := new(syncBuffer)
+	sub := hub.Subscribe(out)
+	waitFor(t, "initial paint", func() bool { return strings.Contains(out.String(), "\x1b[2J") })
+
+	hub.Pause(sub)
+	hub.Broadcast([]byte("secret"))
+	sub.Push([]byte("menu"))
+	waitFor(t, "pushed output", func() bool { return strings.HasSuffix(out.String(), "menu") })
+
+	if strings.Contains(out.String(), "secret") {
+		t.Fatal("a paused subscriber was sent a broadcast")
+	}
+
+	hub.Resume(sub)
+	waitFor(t, "repaint on resume", func() bool { return strings.Contains(out.String(), "secret") })
+
+	hub.Broadcast([]byte("!"))
+	waitFor(t, "broadcast after resume", func() bool { return strings.HasSuffix(out.String(), "!") })
+}
+
+func TestHubOverlay(t *testing.T) {
+	hub := NewHub()
+	hub.Screen = NewScreen(20, 2)
+
+	out := new(syncBuffer)
+	hub.Subscribe(out)
+
+	hub.Broadcast([]byte("program"))
+	io.WriteString(hub.Overlay(), "\rnotice")
+	waitFor(t, "overlay", func() bool { return strings.HasSuffix(out.String(), "notice") })
+
+	if text := hub.Screen.Text(); text[0] != "program" || text[1] != "" {
+		t.Fatalf("the overlay reached the screen: %q", text)
+	}
+}
+
+func TestHubDisconnect(t *testing.T) {
+	disconnectTimeout = 100 * time.Millisecond
+
+	hub := NewHub()
+	hub.HighWater = 16
+	hub.Policy = OverflowDisconnect
+
+	handled := make(chan OverflowPolicy, 1)
+	hub.OverflowHandler = func(sub *Subscriber, policy OverflowPolicy) {
+		handled <- policy
+	}
+
+	w := closingWriter{make(blockingWriter), make(chan struct{})}
+	sub := hub.Subscribe(w)
+
+	for i := 0; i < 4; i++ {
+		hub.Broadcast([]byte("0123456789"))
+	}
+
+	select {
+	case <-w.closed:
+	case <-time.After(disconnectTimeout + time.Second):
+		t.Fatal("lagging subscriber was not closed")
+	}
+
+	select {
+	case <-sub.Done():
+	case <-time.After(time.Second):
+		t.Fatal("lagging subscriber was not unsubscribed")
+	}
+
+	if policy := <-handled; policy != OverflowDisconnect {
+		t.Fatalf("overflow handler received %v", policy)
+	}
+
+	if stats := hub.Stats(); stats.Disconnects != 1 {
+		t.Fatalf("disconnect was not counted: %+v", stats)
+	}
+}
+
+func screenText(s *Screen) []string {
+	width, height := s.Size()
+	lines := []string{}
+
+	for y := 0; y < height; y++ {
+		line := []rune{}
+		for x := 0; x < width; x++ {
+			if r := s.Cell(x, y).Rune; r != 0 {
+				line = append(line, r)
+			}
+		}
+		lines = append(lines, strings.TrimRight(string(line), " "))
+	}
+
+	return lines
+}
+
+func TestScreen(t *testing.T) {
+	s := NewScreen(10, 4)
+	s.Write([]byte("hello\r\nworld\x1b[1;3H\x1b[1;31mX\x1b[0m\x1b[2;2H\x1b[K"))
+
+	expected := []string{"heXlo", "w", "", ""}
+	for i, line := range screenText(s) {
+		if line != expected[i] {
+			t.Fatalf("line %d was %q, not %q", i, line, expected[i])
+		}
+	}
+
+	if attr := s.Cell(2, 0).Attr; attr.Flags != AttrBold || attr.FG != (Color{ColorIndexed, 1}) {
+		t.Fatalf("attributes were not applied: %+v", attr)
+	}
+
+	if x, y := s.Cursor(); x != 1 || y != 1 {
+		t.Fatalf("cursor was at %d,%d", x, y)
+	}
+
+	// wrapping at the last column and scrolling off the bottom.
+	s.Write([]byte("\x1b[4;1H0123456789ab"))
+	if lines := screenText(s); lines[2] != "0123456789" || lines[3] != "ab" || lines[0] != "w" {
+		t.Fatalf("screen did not wrap and scroll: %q", lines)
+	}
+
+	// the alternate screen leaves the primary screen untouched.
+	s.Write([]byte("\x1b[?1049h\x1b[Halt\x1b[?1049l"))
+	if lines := screenText(s); lines[0] != "w" {
+		t.Fatalf("alternate screen leaked into the primary screen: %q", lines)
+	}
+
+	s.Resize(5, 2)
+	if lines := screenText(s); len(lines) != 2 || lines[0] != "01234" || lines[1] != "ab" {
+		t.Fatalf("resize did not keep the cursor line: %q", lines)
+	}
+}
+
+func TestScreenPaint(t *testing.T) {
+	output := []byte("\x1b]2;title\x07plain \x1b[38;5;200;48;2;1;2;3mcolor\x1b[0m\r\n" +
+		"\x1b(0lqqk\x1b(B \u4e16\u754c\r\n\x1b[3;4r\x1b[?1h\x1b[?2004h" +
+		"\x1b[?1049h\x1b[2;1H\x1b[7mfull screen\x1b[4;5H\x1b[1m")
+
+	orig := NewScreen(20, 5)
+	orig.Write(output)
+
+	copied := NewScreen(20, 5)
+	copied.Write(orig.Paint())
+
+	if o, c := screenText(orig), screenText(copied); strings.Join(o, "\n") != strings.Join(c, "\n") {
+		t.Fatalf("painted screen differed:\n%q\n%q", o, c)
+	}
+
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 20; x++ {
+			if o, c := orig.Cell(x, y), copied.Cell(x, y); o != c {
+				t.Fatalf("cell %d,%d differed: %+v %+v", x, y, o, c)
+			}
+		}
+	}
+
+	ox, oy := orig.Cursor()
+	if cx, cy := copied.Cursor(); ox != cx || oy != cy {
+		t.Fatalf("cursor differed: %d,%d %d,%d", ox, oy, cx, cy)
+	}
+
+	if !bytes.Equal(orig.Paint(), copied.Paint()) {
+		t.Fatal("painting the copy did not reproduce the same screen")
+	}
+
+	orig.Write([]byte("\x1b[?1049l"))
+	copied.Write([]byte("\x1b[?1049l"))
+	if o, c := screenText(orig), screenText(copied); strings.Join(o, "\n") != strings.Join(c, "\n") {
+		t.Fatalf("primary screen differed after leaving the alternate screen:\n%q\n%q", o, c)
+	}
+}
+
+func TestScreenPaintCursor(t *testing.T) {
+	table := []string{
+		"abcdef",                              // a pending wrap
+		"\u4e16\u754c\u4e16",                  // a pending wrap after a wide character
+		"ab\r\x1b[1;6Hx\r",                    // a carriage return from the last column
+		"abcdef\x1b[1;3H",                     // a CUP from it
+		"abcdef\x1b[2D",                       // a CUB
+		"abcde\x1b[1;5H\x1b[C",                // a CUF to it
+		"\x1b[2dxyz\x1b[4hxyz\x1b[2J\x1b[M",   // a DL from it
+		"\x1b[3;1Habcdef\x1b[L",               // an IL
+		"\x1b[4h\u4e16\x1b[Habc\u4e16\x1b[4l", // wide characters inserted
+	}
+
+	for _, output := range table {
+		orig := NewScreen(6, 3)
+		orig.Write([]byte(output))
+		ox, oy := orig.Cursor()
+
+		copied := NewScreen(6, 3)
+		copied.Write(orig.Paint())
+		if cx, cy := copied.Cursor(); ox != cx || oy != cy {
+			t.Fatalf("%q: painted cursor at %d,%d, not %d,%d", output, cx, cy, ox, oy)
+		}
+
+		// the next character goes where it would on the original.
+		orig.Write([]byte("Zq"))
+		copied.Write([]byte("Zq"))
+		if o, c := orig.Text(), copied.Text(); !reflect.DeepEqual(o, c) {
+			t.Fatalf("%q: painted screen continued differently:\n%q\n%q", output, o, c)
+		}
+
+		orig = NewScreen(6, 3)
+		orig.Write([]byte(output))
+		viewed := NewScreen(8, 5)
+		viewed.Write(orig.paintView(newView(8, 5)))
+		if vx, vy := viewed.Cursor(); vx != ox+1 || vy != oy+1 {
+			t.Fatalf("%q: viewed cursor at %d,%d, not %d,%d", output, vx, vy, ox+1, oy+1)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	table := []struct {
+		s        string
+		width    int
+		expected string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 3, "hel"},
+		{"h\u00e9llo", 2, "h\u00e9"},
+		{"\u4e16\u754c", 3, "\u4e16"},
+		{"\u4e16\u754c", 4, "\u4e16\u754c"},
+		{"e\u0301x", 1, "e\u0301"},
+		{"abc", 0, ""},
+	}
+
+	for _, row := range table {
+		if result := Truncate(row.s, row.width); result != row.expected {
+			t.Errorf("%q in %d columns: expected %q, got %q", row.s, row.width, row.expected, result)
+		}
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	out := new(bytes.Buffer)
+
+	r, err := NewRecorder(out, Winch{Width: 80, Height: 24}, "/bin/sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Write([]byte("hi \xe4\xb8"))
+	r.Write([]byte("\x96"))
+	r.Resize(80, 24)
+	r.Resize(100, 30)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected a header and three events, got %q", lines)
+	}
+
+	var header asciicastHeader
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatal(err)
+	}
+
+	if header.Version != 2 || header.Width != 80 || header.Height != 24 || header.Command != "/bin/sh" {
+		t.Fatalf("header was incorrect: %+v", header)
+	}
+
+	expected := [][2]string{{"o", "hi "}, {"o", "\u4e16"}, {"r", "100x30"}}
+	for i, line := range lines[1:] {
+		var event []interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := event[0].(float64); !ok || event[1] != expected[i][0] || event[2] != expected[i][1] {
+			t.Fatalf("event %d was incorrect: %v", i, event)
+		}
+	}
+}
+
+func TestPlayer(t *testing.T) {
+	cast := `{"version": 2, "width": 20, "height": 5}
+[0.1, "o", "hello"]
+[0.2, "r", "30x6"]
+[10.2, "o", " world"]
+`
+
+	rec, err := ReadRecording(strings.NewReader(cast))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Width != 20 || rec.Height != 5 || len(rec.Events) != 3 {
+		t.Fatalf("recording was not read correctly: %+v", rec)
+	}
+
+	rec = rec.CapIdle(time.Second)
+	if rec.Duration() != 1200*time.Millisecond {
+		t.Fatalf("idle time was not capped: %v", rec.Duration())
+	}
+
+	out := new(syncBuffer)
+	var width, height int
+
+	player := NewPlayer(rec, out)
+	player.Speed = 10
+	player.ResizeHandler = func(w, h int) { width, height = w, h }
+
+	started := time.Now()
+	player.Play()
+
+	if elapsed := time.Since(started); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("playback took %v", elapsed)
+	}
+
+	if out.String() != "hello world" || width != 30 || height != 6 {
+		t.Fatalf("playback was incorrect: %q %dx%d", out.String(), width, height)
+	}
+}
+
+func TestControl(t *testing.T) {
+	control := NewControl("host")
+
+	if !control.IsDriver("host") {
+		t.Fatal("host did not start with control")
+	}
+
+	if !control.Request("alice") || !control.Request("bob") {
+		t.Fatal("requests were refused")
+	}
+
+	if control.Request("alice") || control.Request("host") {
+		t.Fatal("a duplicate request or one from the driver was accepted")
+	}
+
+	if driver, ok := control.Grant(); !ok || driver != "alice" {
+		t.Fatalf("control was granted to %v, not the oldest request", driver)
+	}
+
+	if control.IsDriver("host") || !control.IsDriver("alice") {
+		t.Fatal("alice was not the only driver after the grant")
+	}
+
+	if control.Release("bob") {
+		t.Fatal("bob released control he did not have")
+	}
+
+	if !control.Remove("alice") || control.Driver() != "host" {
+		t.Fatal("control did not return to the host when the driver went away")
+	}
+
+	control.Give("bob")
+	if control.Driver() != "bob" || len(control.Requests()) != 0 {
+		t.Fatalf("after Give: driver %v, requests %v", control.Driver(), control.Requests())
+	}
+
+	if !control.Release("bob") || control.Driver() != "host" {
+		t.Fatal("control did not return to the host on release")
+	}
+
+	if control.Release("host") {
+		t.Fatal("the host released control to itself")
+	}
+}
+
+func TestEscaper(t *testing.T) {
+	var commands []string
+
+	escaper := NewEscaper(0x1d, func(owner interface{}, command byte) {
+		commands = append(commands, owner.(string)+":"+string(command))
+	})
+
+	out := string(escaper.Filter("a", []byte("ab\x1dcd\x1d\x1de\x1d")))
+	out += string(escaper.Filter("b", []byte("f\x1d")))
+	out += string(escaper.Filter("a", []byte("rg")))
+
+	if out != "abd\x1defg" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	if strings.Join(commands, " ") != "a:c a:r" {
+		t.Fatalf("unexpected commands %v", commands)
+	}
+
+	escaper.Forget("b")
+	if out := string(escaper.Filter("b", []byte("x"))); out != "x" {
+		t.Fatalf("a forgotten command was still pending: %q", out)
+	}
+}
+
+func TestTermColors(t *testing.T) {
+	table := []struct {
+		term, colorterm string
+		colors          ColorSupport
+	}{
+		{"xterm-256color", "truecolor", ColorsTrue},
+		{"xterm-direct", "", ColorsTrue},
+		{"screen-256color", "", Colors256},
+		{"xterm", "", Colors16},
+		{"linux", "", Colors16},
+		{"vt100", "", ColorsNone},
+		{"dumb", "", ColorsNone},
+		{"", "", ColorsNone},
+	}
+
+	for _, row := range table {
+		if colors := TermColors(row.term, row.colorterm); colors != row.colors {
+			t.Errorf("%q/%q: expected %v, got %v", row.term, row.colorterm, row.colors, colors)
+		}
+	}
+}
+
+func TestColorFilter(t *testing.T) {
+	table := []struct {
+		colors ColorSupport
+		in     string
+		out    string
+	}{
+		{Colors256, "\x1b[1;38;2;255;0;0mred\x1b[0m", "\x1b[1;38;5;196mred\x1b[0m"},
+		{Colors256, "\x1b[48:2::0:0:255m", "\x1b[48;5;21m"},
+		{Colors256, "\x1b[38;5;100m", "\x1b[38;5;100m"},
+		{Colors16, "\x1b[38;5;9;48;2;0;0;0m", "\x1b[91;40m"},
+		{Colors16, "\x1b[38;5;231m\x1b[2J", "\x1b[97m\x1b[2J"},
+		{Colors16, "\x1b[4;58;5;1m", "\x1b[4m"},
+		{ColorsNone, "\x1b[1;31;44mx\x1b[m", "\x1b[1mx\x1b[m"},
+		{ColorsNone, "\x1b[31m", ""},
+		{Colors16, "\x1b[?25l\x1b[H", "\x1b[?25l\x1b[H"},
+	}
+
+	for _, row := range table {
+		out := new(bytes.Buffer)
+		f := NewColorFilter(out, row.colors)
+
+		// bytes are written one at a time to cover sequences split across
+		// writes.
+		for i := 0; i < len(row.in); i++ {
+			f.Write([]byte{row.in[i]})
+		}
+
+		if out.String() != row.out {
+			t.Errorf("%v %q: expected %q, got %q", row.colors, row.in, row.out, out.String())
+		}
+	}
+}
+
+func TestFrames(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	WriteFrame(buf, FrameHello, HelloPayload("xterm-256color", "truecolor"))
+	WriteFrame(buf, FrameWinch, WinchPayload(Winch{Width: 132, Height: 43}))
+	WriteFrame(buf, FrameInput, []byte("ls\r"))
+
+	kind, payload, err := ReadFrame(buf)
+	if err != nil || kind != FrameHello {
+		t.Fatalf("expected a hello frame, got %d (%v)", kind, err)
+	}
+	if term, colorterm := ParseHello(payload); term != "xterm-256color" || colorterm != "truecolor" {
+		t.Fatalf("unexpected hello %q/%q", term, colorterm)
+	}
+
+	kind, payload, err = ReadFrame(buf)
+	if err != nil || kind != FrameWinch {
+		t.Fatalf("expected a winch frame, got %d (%v)", kind, err)
+	}
+	if ws, err := ParseWinch(payload); err != nil || ws.Width != 132 || ws.Height != 43 {
+		t.Fatalf("unexpected window size %v (%v)", ws, err)
+	}
+
+	kind, payload, err = ReadFrame(buf)
+	if err != nil || kind != FrameInput || string(payload) != "ls\r" {
+		t.Fatalf("unexpected input frame %d %q (%v)", kind, payload, err)
+	}
+
+	if _, _, err := ReadFrame(buf); err != io.EOF {
+		t.Fatalf("expected EOF after the last frame, got %v", err)
+	}
+
+	if err := WriteFrame(buf, FrameInput, make([]byte, maxFrame)); err == nil {
+		t.Fatal("oversized frame was written")
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+# settings
+listen = "0.0.0.0:2222" # trailing comment
+password = 'C:\no\escapes'
+term = "tab\there"
+notifications = false
+high-water = 4096
+hook = [
+  "logger termproxy", # one
+  'true',
+]
+session = []
+
+[profile.demo]
+read-only = true
+listen = "127.0.0.1:2222"
+
+[ profile.quiet ]
+notifications = true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := map[string]ConfigValue{
+		"listen":        {Values: []string{"0.0.0.0:2222"}},
+		"password":      {Values: []string{`C:\no\escapes`}},
+		"term":          {Values: []string{"tab\there"}},
+		"notifications": {Values: []string{"false"}},
+		"high-water":    {Values: []string{"4096"}},
+		"hook":          {Values: []string{"logger termproxy", "true"}, List: true},
+		"session":       {Values: []string{}, List: true},
+	}
+
+	if !reflect.DeepEqual(config.Settings, table) {
+		t.Fatalf("unexpected settings %v", config.Settings)
+	}
+
+	demo, err := config.Profile("demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if demo["listen"].Values[0] != "127.0.0.1:2222" || demo["read-only"].Values[0] != "true" || demo["high-water"].Values[0] != "4096" {
+		t.Fatalf("unexpected profile %v", demo)
+	}
+	if config.Settings["listen"].Values[0] != "0.0.0.0:2222" {
+		t.Fatal("profile changed the settings")
+	}
+
+	if _, err := config.Profile("quiet"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Profile("loud"); err == nil {
+		t.Fatal("missing profile was found")
+	}
+
+	for _, bad := range []string{
+		`listen`,
+		`listen = `,
+		`listen = 0.0.0.0`,
+		`listen = "open`,
+		`listen = "a" "b"`,
+		`listen = "a"` + "\n" + `listen = "b"`,
+		`hook = ["a" "b"]`,
+		`hook = ["a",`,
+		`[demo]`,
+		`[profile.demo`,
+		"[profile.demo]\n[profile.demo]",
+		`= "a"`,
+	} {
+		if _, err := ParseConfig([]byte(bad)); err == nil {
+			t.Errorf("%q was parsed", bad)
+		}
+	}
+
+	if _, err := ParseConfig([]byte("\n\nlisten = yes")); err == nil || !strings.HasPrefix(err.Error(), "line 3:") {
+		t.Fatalf("expected an error on line 3, got %v", err)
+	}
+}
+
+func TestResizePolicy(t *testing.T) {
+	sizes := map[string]Winch{
+		"localhost":       {Width: 120, Height: 40},
+		"127.0.0.1:40000": {Width: 80, Height: 50},
+		"127.0.0.1:40001": {Width: 200, Height: 24},
+		"127.0.0.1:40002": {}, // a client which has not said yet
+	}
+
+	table := []struct {
+		policy   ResizePolicy
+		followed string
+		size     Winch
+	}{
+		{ResizeSmallest, "", Winch{Width: 80, Height: 24}},
+		{ResizeLargest, "", Winch{Width: 200, Height: 50}},
+		{ResizeHost, "localhost", Winch{Width: 120, Height: 40}},
+		{ResizeDriver, "127.0.0.1:40000", Winch{Width: 80, Height: 50}},
+		{ResizeActive, "127.0.0.1:40001", Winch{Width: 200, Height: 24}},
+		// following someone who is gone, or has no size, gives the smallest.
+		{ResizeHost, "", Winch{Width: 80, Height: 24}},
+		{ResizeActive, "127.0.0.1:40002", Winch{Width: 80, Height: 24}},
+	}
+
+	for _, row := range table {
+		if size := row.policy.Size(sizes, row.followed); size != row.size {
+			t.Errorf("%s following %q: expected %dx%d, got %dx%d", row.policy, row.followed, row.size.Width, row.size.Height, size.Width, size.Height)
+		}
+	}
+
+	// a terminal joining or resizing does not impose its own size on the
+	// others unless the policy picks it.
+	joined := map[string]Winch{"localhost": {Width: 80, Height: 24}}
+	for _, ws := range []Winch{{Width: 200, Height: 60}, {Width: 100, Height: 20}} {
+		joined["127.0.0.1:40003"] = ws
+		if size := ResizeSmallest.Size(joined, ""); size == ws {
+			t.Fatalf("%dx%d joining gave the session its size under %s", ws.Width, ws.Height, ResizeSmallest)
+		}
+	}
+	if size := ResizeSmallest.Size(joined, ""); size != (Winch{Width: 80, Height: 20}) {
+		t.Fatalf("expected 80x20, got %dx%d", size.Width, size.Height)
+	}
+	if size := ResizeHost.Size(joined, "localhost"); size != (Winch{Width: 80, Height: 24}) {
+		t.Fatalf("expected the host's 80x24, got %dx%d", size.Width, size.Height)
+	}
+
+	if size := ResizeLargest.Size(map[string]Winch{}, ""); size.Width != 0 || size.Height != 0 {
+		t.Fatalf("expected no size without terminals, got %dx%d", size.Width, size.Height)
+	}
+
+	for _, p := range ResizePolicies {
+		if parsed, err := ParseResizePolicy(p.String()); err != nil || parsed != p {
+			t.Fatalf("%s did not parse back: %v", p, err)
+		}
+	}
+	if _, err := ParseResizePolicy("biggest"); err == nil {
+		t.Fatal("unknown policy was parsed")
+	}
+}
+
+func TestView(t *testing.T) {
+	screen := NewScreen(6, 3)
+	screen.Write([]byte("abcdef\r\nghijkl\r\nmno"))
+
+	// a larger terminal sees the screen framed in its middle.
+	larger := NewScreen(10, 6)
+	v := newView(10, 6)
+	larger.Write(screen.paintView(v))
+
+	expected := []string{
+		" ┌──────┐",
+		" │abcdef│",
+		" │ghijkl│",
+		" │mno   │",
+		" └──────┘",
+		"",
+	}
+	if text := larger.Text(); !reflect.DeepEqual(text, expected) {
+		t.Fatalf("expected %q, got %q", expected, text)
+	}
+	if x, y := larger.Cursor(); x != 5 || y != 3 {
+		t.Fatalf("expected the cursor at 5,3, got %d,%d", x, y)
+	}
+
+	if frame := screen.paintView(v); len(frame) != 0 {
+		t.Fatalf("unchanged screen painted %q", frame)
+	}
+
+	// only what changed is painted again.
+	screen.Write([]byte("p"))
+	frame := screen.paintView(v)
+	if bytes.Contains(frame, []byte("abcdef")) || !bytes.Contains(frame, []byte("mnop")) {
+		t.Fatalf("unexpected frame %q", frame)
+	}
+
+	// a smaller terminal follows the cursor.
+	smaller := NewScreen(3, 2)
+	v = newView(3, 2)
+	smaller.Write(screen.paintView(v))
+
+	expected = []string{"ijk", "op"}
+	if text := smaller.Text(); !reflect.DeepEqual(text, expected) {
+		t.Fatalf("expected %q, got %q", expected, text)
+	}
+
+	screen.Write([]byte("\x1b[H"))
+	smaller.Write(screen.paintView(v))
+
+	expected = []string{"abc", "ghi"}
+	if text := smaller.Text(); !reflect.DeepEqual(text, expected) {
+		t.Fatalf("expected %q, got %q", expected, text)
+	}
+	if x, y := smaller.Cursor(); x != 0 || y != 0 {
+		t.Fatalf("expected the cursor at 0,0, got %d,%d", x, y)
+	}
+}
+
+func TestHubViews(t *testing.T) {
+	hub := NewHub()
+	hub.Screen = NewScreen(6, 2)
+
+	out := new(syncBuffer)
+	sub := hub.Subscribe(out)
+	hub.SetSize(sub, 8, 4)
+
+	hub.Write([]byte("hello"))
+
+	waitFor(t, "a framed view", func() bool {
+		client := NewScreen(8, 4)
+		client.Write([]byte(out.String()))
+		return client.Text()[1] == "│hello │"
+	})
+
+	// once the terminal fits the screen, it is sent the output as it is.
+	hub.Screen.Resize(8, 4)
+	hub.Refit()
+	hub.Write([]byte(" world"))
+
+	waitFor(t, "the output itself", func() bool {
+		client := NewScreen(8, 4)
+		client.Write([]byte(out.String()))
+		return client.Text()[0] == "hello wo" && client.Text()[1] == "rld"
+	})
+
+	// a terminal of unknown size is painted afresh, in its queue, when the
+	// screen is resized.
+	unknown := new(syncBuffer)
+	hub.Subscribe(unknown)
+	hub.Screen.Resize(4, 4)
+	hub.Refit()
+	hub.Write([]byte("!"))
+
+	waitFor(t, "a fresh paint", func() bool {
+		output := unknown.String()
+		last := strings.LastIndex(output, "\x1bc")
+		return last > 0 && strings.HasSuffix(output[last:], "!")
+	})
+
+	// what paints a subscriber afresh fits its terminal.
+	client := NewScreen(8, 4)
+	client.Write(hub.PaintFor(sub))
+	if text := client.Text(); text[0] != " │hell│" {
+		t.Fatalf("expected a framed view, got %q", text)
+	}
+}
@@ -0,0 +1,204 @@
+package termproxy
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// view paints a Screen onto a terminal of a different size. A terminal larger
+// than the screen sees it in the middle, framed by a border; a smaller one sees
+// the part of it around the cursor, scrolling to keep the cursor in view. Only
+// the rows which changed since the last frame are painted again.
+type view struct {
+	width, height    int
+	scrollX, scrollY int
+
+	// rows are the rows painted last, nil until the first frame; modes and
+	// cursor are likewise what the terminal was last given.
+	rows   []string
+	modes  string
+	cursor string
+}
+
+// viewBorder is the rendition of the border around a screen smaller than the
+// terminal showing it.
+var viewBorder = Attr{Flags: AttrDim}
+
+// resetModes turns off every mode viewModes may turn on.
+var resetModes = func() string {
+	buf := new(bytes.Buffer)
+	for _, mode := range replayedModes {
+		fmt.Fprintf(buf, "\x1b[?%dl", mode)
+	}
+	buf.WriteString("\x1b>\x1b[0 q")
+	return buf.String()
+}()
+
+func newView(width, height int) *view {
+	return &view{width: width, height: height}
+}
+
+// forget makes the view paint row y again in the next frame, as something
+// else has been drawn over it.
+func (v *view) forget(y int) {
+	if y < len(v.rows) {
+		v.rows[y] = ""
+	}
+}
+
+// follow returns what to add to a terminal's coordinate along one axis to get
+// the screen's, for a terminal of the given size. A smaller terminal scrolls
+// just far enough to show the cursor.
+func follow(size, screen, cursor int, scroll *int) int {
+	if size >= screen {
+		return -(size - screen) / 2
+	}
+
+	if cursor < *scroll {
+		*scroll = cursor
+	}
+	if cursor >= *scroll+size {
+		*scroll = cursor - size + 1
+	}
+	*scroll = clamp(*scroll, 0, screen-size)
+
+	return *scroll
+}
+
+// paintView returns the bytes which bring a terminal showing v up to date with
+// the screen, or nothing if it already is.
+func (s *Screen) paintView(v *view) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	buf := new(bytes.Buffer)
+
+	if v.rows == nil {
+		v.rows = make([]string, v.height)
+		v.modes, v.cursor = resetModes, ""
+
+		// lines are cropped by the view, so the terminal must not wrap them.
+		buf.WriteString("\x1bc\x1b[H\x1b[2J\x1b[?7l")
+		if s.title != "" {
+			fmt.Fprintf(buf, "\x1b]2;%s\x07", s.title)
+		}
+	}
+
+	dx := follow(v.width, s.width, s.cursor.x, &v.scrollX)
+	dy := follow(v.height, s.height, s.cursor.y, &v.scrollY)
+
+	for y := range v.rows {
+		if row := s.viewRow(y+dy, dx, v.width); row != v.rows[y] {
+			fmt.Fprintf(buf, "\x1b[%d;1H%s", y+1, row)
+			v.rows[y] = row
+		}
+	}
+
+	if modes := s.viewModes(); modes != v.modes {
+		buf.WriteString(resetModes)
+		buf.WriteString(modes)
+		v.modes = modes
+	}
+
+	cursor := fmt.Sprintf("\x1b[%d;%dH", s.cursor.y-dy+1, s.cursor.x-dx+1)
+	if buf.Len() > 0 || cursor != v.cursor {
+		buf.WriteString(cursor)
+		v.cursor = cursor
+	}
+
+	return buf.Bytes()
+}
+
+// viewRow paints the width columns of the terminal's row showing the screen's
+// row y, starting from the screen's column x, which may be outside the screen.
+func (s *Screen) viewRow(y, x, width int) string {
+	buf := new(bytes.Buffer)
+	var pen Attr
+
+	for col := 0; col < width; col++ {
+		cell := s.viewCell(x+col, y)
+
+		switch {
+		case cell.Rune == 0 && col == 0, cell.Wide && col == width-1:
+			// half of a wide character cannot be shown.
+			cell = blankCell(cell.Attr)
+		case cell.Rune == 0:
+			continue
+		}
+
+		if cell.Attr != pen {
+			buf.WriteString("\x1b[0m")
+			buf.WriteString(sgr(cell.Attr))
+			pen = cell.Attr
+		}
+
+		buf.WriteString(string(cell.Rune))
+	}
+
+	if pen != (Attr{}) {
+		buf.WriteString("\x1b[0m")
+	}
+
+	return buf.String()
+}
+
+// viewCell returns the cell at the screen's column x and row y, or the border
+// drawn around the screen if they are outside it.
+func (s *Screen) viewCell(x, y int) Cell {
+	if x >= 0 && x < s.width && y >= 0 && y < s.height {
+		return s.active.lines[y][x]
+	}
+
+	left, right := x == -1, x == s.width
+	top, bottom := y == -1, y == s.height
+	across := x >= -1 && x <= s.width
+	down := y >= -1 && y <= s.height
+
+	r := ' '
+	switch {
+	case top && left:
+		r = '┌'
+	case top && right:
+		r = '┐'
+	case bottom && left:
+		r = '└'
+	case bottom && right:
+		r = '┘'
+	case (top || bottom) && across:
+		r = '─'
+	case (left || right) && down:
+		r = '│'
+	default:
+		return blankCell(Attr{})
+	}
+
+	return Cell{Rune: r, Attr: viewBorder}
+}
+
+// viewModes returns the sequences which give a terminal the screen's input
+// modes and cursor.
+func (s *Screen) viewModes() string {
+	buf := new(bytes.Buffer)
+
+	for _, mode := range replayedModes {
+		if s.privateModes[mode] {
+			fmt.Fprintf(buf, "\x1b[?%dh", mode)
+		}
+	}
+
+	if s.appKeypad {
+		buf.WriteString("\x1b=")
+	}
+
+	if s.cursorStyle != 0 {
+		fmt.Fprintf(buf, "\x1b[%d q", s.cursorStyle)
+	}
+
+	if s.hidden {
+		buf.WriteString("\x1b[?25l")
+	} else {
+		buf.WriteString("\x1b[?25h")
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,870 @@
+package termproxy
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// parser states, loosely following the DEC ANSI parser state machine.
+const (
+	stateGround = iota
+	stateEscape
+	stateCSI
+	stateOSC
+	stateString
+	stateStringEscape
+)
+
+// maxStringLength caps the OSC and DCS payloads held while parsing.
+const maxStringLength = 4096
+
+type parser struct {
+	state        int
+	intermediate []byte
+	params       []byte
+	osc          []byte
+	oscString    bool
+	utf8         []byte
+}
+
+// decGraphics maps the DEC special graphics character set onto unicode.
+var decGraphics = map[byte]rune{
+	'`': '◆', 'a': '▒', 'b': '␉', 'c': '␌', 'd': '␍', 'e': '␊', 'f': '°', 'g': '±',
+	'h': '␤', 'i': '␋', 'j': '┘', 'k': '┐', 'l': '┌', 'm': '└', 'n': '┼', 'o': '⎺',
+	'p': '⎻', 'q': '─', 'r': '⎼', 's': '⎽', 't': '├', 'u': '┤', 'v': '┴', 'w': '┬',
+	'x': '│', 'y': '≤', 'z': '≥', '{': 'π', '|': '≠', '}': '£', '~': '·',
+}
+
+func (p *parser) feed(s *Screen, b byte) {
+	switch p.state {
+	case stateOSC, stateString:
+		switch b {
+		case 0x07:
+			p.endString(s)
+		case 0x1b:
+			p.state = stateStringEscape
+		default:
+			if len(p.osc) < maxStringLength {
+				p.osc = append(p.osc, b)
+			}
+		}
+		return
+	case stateStringEscape:
+		// anything other than ST aborts the string and starts a new sequence.
+		p.endString(s)
+		if b != '\\' {
+			p.escape()
+			p.feed(s, b)
+		}
+		return
+	}
+
+	if b < 0x20 || b == 0x7f {
+		p.utf8 = p.utf8[:0]
+		if b == 0x1b {
+			p.escape()
+			return
+		}
+		if b == 0x18 || b == 0x1a {
+			p.state = stateGround
+			return
+		}
+		s.control(b)
+		return
+	}
+
+	switch p.state {
+	case stateEscape:
+		p.escapeByte(s, b)
+	case stateCSI:
+		switch {
+		case b >= 0x30 && b <= 0x3f:
+			p.params = append(p.params, b)
+		case b >= 0x20 && b <= 0x2f:
+			p.intermediate = append(p.intermediate, b)
+		case b >= 0x40 && b <= 0x7e:
+			p.state = stateGround
+			s.csi(p.params, p.intermediate, b)
+		default:
+			p.state = stateGround
+		}
+	default:
+		p.print(s, b)
+	}
+}
+
+func (p *parser) escape() {
+	p.state = stateEscape
+	p.intermediate = p.intermediate[:0]
+	p.params = p.params[:0]
+}
+
+func (p *parser) escapeByte(s *Screen, b byte) {
+	if b >= 0x20 && b <= 0x2f {
+		p.intermediate = append(p.intermediate, b)
+		return
+	}
+
+	p.state = stateGround
+
+	if b > 0x7e {
+		return
+	}
+
+	if len(p.intermediate) > 0 {
+		s.escapeIntermediate(p.intermediate[0], b)
+		return
+	}
+
+	switch b {
+	case '[':
+		p.state = stateCSI
+	case ']':
+		p.state = stateOSC
+		p.oscString = true
+		p.osc = p.osc[:0]
+	case 'P', 'X', '^', '_':
+		p.state = stateString
+		p.oscString = false
+		p.osc = p.osc[:0]
+	default:
+		s.escapeFinal(b)
+	}
+}
+
+func (p *parser) endString(s *Screen) {
+	p.state = stateGround
+	if p.oscString {
+		s.osc(string(p.osc))
+	}
+}
+
+func (p *parser) print(s *Screen, b byte) {
+	if b < 0x80 && len(p.utf8) == 0 {
+		s.print(rune(b))
+		return
+	}
+
+	p.utf8 = append(p.utf8, b)
+	if !utf8.FullRune(p.utf8) {
+		return
+	}
+
+	// an invalid sequence only consumes its first byte; the rest are printed
+	// on their own.
+	r, size := utf8.DecodeRune(p.utf8)
+	rest := append([]byte{}, p.utf8[size:]...)
+	p.utf8 = p.utf8[:0]
+	s.print(r)
+
+	for _, b := range rest {
+		p.print(s, b)
+	}
+}
+
+func (s *Screen) control(b byte) {
+	switch b {
+	case 0x08:
+		s.cursor.wrapNext = false
+		if s.cursor.x > 0 {
+			s.cursor.x--
+		}
+	case 0x09:
+		s.tab(1)
+	case 0x0a, 0x0b, 0x0c:
+		s.linefeed()
+	case 0x0d:
+		s.cursor.x = 0
+		s.cursor.wrapNext = false
+	case 0x0e:
+		s.cursor.shift = 1
+	case 0x0f:
+		s.cursor.shift = 0
+	}
+}
+
+func (s *Screen) print(r rune) {
+	if s.cursor.charsets[s.cursor.shift] == '0' && r < 0x80 {
+		if g, ok := decGraphics[byte(r)]; ok {
+			r = g
+		}
+	}
+
+	width := runeWidth(r)
+	if width == 0 {
+		return
+	}
+
+	if s.cursor.wrapNext && s.autowrap {
+		s.cursor.x = 0
+		s.linefeed()
+	}
+	s.cursor.wrapNext = false
+
+	if width == 2 && s.cursor.x == s.width-1 {
+		if !s.autowrap || s.width < 2 {
+			return
+		}
+		s.setCell(s.cursor.x, s.cursor.y, blankCell(s.cursor.attr))
+		s.cursor.x = 0
+		s.linefeed()
+	}
+
+	line := s.active.lines[s.cursor.y]
+	if s.insert {
+		s.splitWide(s.cursor.x)
+		copy(line[s.cursor.x+width:], line[s.cursor.x:])
+		s.fixWideEdge(s.width - 1)
+		s.eraseCells(s.cursor.y, s.cursor.x, s.cursor.x+width)
+	}
+
+	s.setCell(s.cursor.x, s.cursor.y, Cell{Rune: r, Wide: width == 2, Attr: s.cursor.attr})
+	if width == 2 {
+		s.setCell(s.cursor.x+1, s.cursor.y, Cell{Attr: s.cursor.attr})
+	}
+
+	if s.cursor.x+width >= s.width {
+		s.cursor.x = s.width - 1
+		s.cursor.wrapNext = true
+	} else {
+		s.cursor.x += width
+	}
+}
+
+// setCell stores cell, blanking the other half of any wide character it
+// overwrites.
+func (s *Screen) setCell(x, y int, cell Cell) {
+	line := s.active.lines[y]
+	old := line[x]
+
+	if old.Wide && x+1 < len(line) {
+		line[x+1] = blankCell(old.Attr)
+	}
+
+	if old.Rune == 0 && cell.Rune != 0 && x > 0 {
+		line[x-1] = blankCell(line[x-1].Attr)
+	}
+
+	line[x] = cell
+}
+
+// fixWideEdge blanks a wide character cut in half at column x.
+func (s *Screen) fixWideEdge(x int) {
+	line := s.active.lines[s.cursor.y]
+	if line[x].Wide {
+		line[x] = blankCell(line[x].Attr)
+	}
+}
+
+// splitWide blanks the wide character whose right half is at column x, as
+// cells are about to be inserted between its halves.
+func (s *Screen) splitWide(x int) {
+	line := s.active.lines[s.cursor.y]
+	if x > 0 && line[x].Rune == 0 {
+		line[x-1] = blankCell(line[x-1].Attr)
+		line[x] = blankCell(line[x].Attr)
+	}
+}
+
+func (s *Screen) linefeed() {
+	switch {
+	case s.cursor.y == s.bottom:
+		s.scrollUp(s.top, s.bottom, 1)
+	case s.cursor.y < s.height-1:
+		s.cursor.y++
+	}
+}
+
+func (s *Screen) reverseIndex() {
+	switch {
+	case s.cursor.y == s.top:
+		s.scrollDown(s.top, s.bottom, 1)
+	case s.cursor.y > 0:
+		s.cursor.y--
+	}
+}
+
+func (s *Screen) scrollUp(top, bottom, n int) {
+	lines := s.active.lines
+	n = clamp(n, 0, bottom-top+1)
+	copy(lines[top:bottom+1], lines[top+n:bottom+1])
+	for y := bottom - n + 1; y <= bottom; y++ {
+		lines[y] = blankLine(s.width, s.cursor.attr)
+	}
+}
+
+func (s *Screen) scrollDown(top, bottom, n int) {
+	lines := s.active.lines
+	n = clamp(n, 0, bottom-top+1)
+	copy(lines[top+n:bottom+1], lines[top:bottom+1-n])
+	for y := top; y < top+n; y++ {
+		lines[y] = blankLine(s.width, s.cursor.attr)
+	}
+}
+
+func (s *Screen) tab(n int) {
+	s.cursor.wrapNext = false
+	for ; n > 0 && s.cursor.x < s.width-1; n-- {
+		s.cursor.x++
+		for s.cursor.x < s.width-1 && !s.tabs[s.cursor.x] {
+			s.cursor.x++
+		}
+	}
+}
+
+func (s *Screen) backTab(n int) {
+	s.cursor.wrapNext = false
+	for ; n > 0 && s.cursor.x > 0; n-- {
+		s.cursor.x--
+		for s.cursor.x > 0 && !s.tabs[s.cursor.x] {
+			s.cursor.x--
+		}
+	}
+}
+
+func (s *Screen) moveTo(x, y int) {
+	top, bottom := 0, s.height-1
+	if s.cursor.origin {
+		top, bottom = s.top, s.bottom
+		y += s.top
+	}
+
+	s.cursor.x = clamp(x, 0, s.width-1)
+	s.cursor.y = clamp(y, top, bottom)
+	s.cursor.wrapNext = false
+}
+
+// moveVertical moves the cursor by n rows, stopping at the scroll region
+// margins when starting inside them.
+func (s *Screen) moveVertical(n int) {
+	top, bottom := 0, s.height-1
+	if s.cursor.y >= s.top && s.cursor.y <= s.bottom {
+		top, bottom = s.top, s.bottom
+	}
+
+	s.cursor.y = clamp(s.cursor.y+n, top, bottom)
+	s.cursor.wrapNext = false
+}
+
+func (s *Screen) eraseCells(y, from, to int) {
+	line := s.active.lines[y]
+	from, to = clamp(from, 0, s.width), clamp(to, 0, s.width)
+
+	if from > 0 && line[from-1].Wide && from < to {
+		line[from-1] = blankCell(line[from-1].Attr)
+	}
+	if to < s.width && line[to].Rune == 0 && from < to {
+		line[to] = blankCell(line[to].Attr)
+	}
+
+	for x := from; x < to; x++ {
+		line[x] = blankCell(s.cursor.attr)
+	}
+}
+
+func (s *Screen) saveCursor() {
+	s.active.saved = s.cursor
+}
+
+func (s *Screen) restoreCursor() {
+	s.cursor = s.active.saved
+	s.cursor.x = clamp(s.cursor.x, 0, s.width-1)
+	s.cursor.y = clamp(s.cursor.y, 0, s.height-1)
+}
+
+func (s *Screen) setAlternate(on, clear bool) {
+	if on == (s.active == s.alternate) {
+		return
+	}
+
+	if on {
+		s.active = s.alternate
+		if clear {
+			s.alternate.lines = newBuffer(s.width, s.height).lines
+		}
+	} else {
+		s.active = s.primary
+	}
+}
+
+func (s *Screen) escapeFinal(b byte) {
+	switch b {
+	case '7':
+		s.saveCursor()
+	case '8':
+		s.restoreCursor()
+	case 'D':
+		s.cursor.wrapNext = false
+		s.linefeed()
+	case 'E':
+		s.cursor.x = 0
+		s.cursor.wrapNext = false
+		s.linefeed()
+	case 'M':
+		s.cursor.wrapNext = false
+		s.reverseIndex()
+	case 'H':
+		s.tabs[s.cursor.x] = true
+	case 'c':
+		s.reset()
+	case '=':
+		s.appKeypad = true
+	case '>':
+		s.appKeypad = false
+	}
+}
+
+func (s *Screen) escapeIntermediate(intermediate, b byte) {
+	switch intermediate {
+	case '(':
+		s.cursor.charsets[0] = b
+	case ')':
+		s.cursor.charsets[1] = b
+	case '#':
+		if b == '8' {
+			for y := range s.active.lines {
+				for x := range s.active.lines[y] {
+					s.active.lines[y][x] = Cell{Rune: 'E'}
+				}
+			}
+		}
+	}
+}
+
+func (s *Screen) osc(payload string) {
+	parts := strings.SplitN(payload, ";", 2)
+	if len(parts) == 2 && (parts[0] == "0" || parts[0] == "2") {
+		s.title = parts[1]
+	}
+}
+
+// csiParams splits the parameters of a control sequence. Sub-parameters
+// separated by colons are kept together in the same group.
+func csiParams(raw []byte) (byte, [][]int) {
+	var private byte
+	if len(raw) > 0 && raw[0] >= '<' && raw[0] <= '?' {
+		private = raw[0]
+		raw = raw[1:]
+	}
+
+	params := [][]int{}
+	if len(raw) == 0 {
+		return private, params
+	}
+
+	for _, group := range strings.Split(string(raw), ";") {
+		sub := []int{}
+		for _, field := range strings.Split(group, ":") {
+			n, err := strconv.Atoi(field)
+			if err != nil {
+				n = -1
+			}
+			sub = append(sub, n)
+		}
+		params = append(params, sub)
+	}
+
+	return private, params
+}
+
+// param returns the i'th parameter, or def when it is missing or zero.
+func param(params [][]int, i, def int) int {
+	if i >= len(params) || params[i][0] <= 0 {
+		return def
+	}
+	return params[i][0]
+}
+
+func (s *Screen) csi(raw, intermediate []byte, final byte) {
+	private, params := csiParams(raw)
+
+	if len(intermediate) > 0 {
+		switch {
+		case intermediate[0] == ' ' && final == 'q':
+			s.cursorStyle = param(params, 0, 0)
+		case intermediate[0] == '!' && final == 'p':
+			s.softReset()
+		}
+		return
+	}
+
+	if private == '?' {
+		switch final {
+		case 'h':
+			s.setPrivateModes(params, true)
+		case 'l':
+			s.setPrivateModes(params, false)
+		}
+		return
+	}
+
+	if private != 0 {
+		return
+	}
+
+	n := param(params, 0, 1)
+
+	switch final {
+	case '@':
+		line := s.active.lines[s.cursor.y]
+		n = clamp(n, 0, s.width-s.cursor.x)
+		s.splitWide(s.cursor.x)
+		copy(line[s.cursor.x+n:], line[s.cursor.x:])
+		s.eraseCells(s.cursor.y, s.cursor.x, s.cursor.x+n)
+		s.fixWideEdge(s.width - 1)
+	case 'A':
+		s.moveVertical(-n)
+	case 'B', 'e':
+		s.moveVertical(n)
+	case 'C', 'a':
+		s.cursor.x = clamp(s.cursor.x+n, 0, s.width-1)
+		s.cursor.wrapNext = false
+	case 'D':
+		s.cursor.x = clamp(s.cursor.x-n, 0, s.width-1)
+		s.cursor.wrapNext = false
+	case 'E':
+		s.cursor.x = 0
+		s.moveVertical(n)
+	case 'F':
+		s.cursor.x = 0
+		s.moveVertical(-n)
+	case 'G', '`':
+		s.cursor.x = clamp(n-1, 0, s.width-1)
+		s.cursor.wrapNext = false
+	case 'H', 'f':
+		s.moveTo(param(params, 1, 1)-1, n-1)
+	case 'I':
+		s.tab(n)
+	case 'J':
+		s.eraseDisplay(param(params, 0, 0))
+	case 'K':
+		switch param(params, 0, 0) {
+		case 0:
+			s.eraseCells(s.cursor.y, s.cursor.x, s.width)
+		case 1:
+			s.eraseCells(s.cursor.y, 0, s.cursor.x+1)
+		case 2:
+			s.eraseCells(s.cursor.y, 0, s.width)
+		}
+	case 'L':
+		if s.cursor.y >= s.top && s.cursor.y <= s.bottom {
+			s.scrollDown(s.cursor.y, s.bottom, n)
+			s.cursor.x = 0
+			s.cursor.wrapNext = false
+		}
+	case 'M':
+		if s.cursor.y >= s.top && s.cursor.y <= s.bottom {
+			s.scrollUp(s.cursor.y, s.bottom, n)
+			s.cursor.x = 0
+			s.cursor.wrapNext = false
+		}
+	case 'P':
+		line := s.active.lines[s.cursor.y]
+		n = clamp(n, 0, s.width-s.cursor.x)
+		if line[s.cursor.x].Rune == 0 && s.cursor.x > 0 {
+			line[s.cursor.x-1] = blankCell(line[s.cursor.x-1].Attr)
+		}
+		copy(line[s.cursor.x:], line[s.cursor.x+n:])
+		s.eraseCells(s.cursor.y, s.width-n, s.width)
+		if line[s.cursor.x].Rune == 0 {
+			line[s.cursor.x] = blankCell(line[s.cursor.x].Attr)
+		}
+	case 'S':
+		s.scrollUp(s.top, s.bottom, n)
+	case 'T':
+		s.scrollDown(s.top, s.bottom, n)
+	case 'X':
+		s.eraseCells(s.cursor.y, s.cursor.x, s.cursor.x+n)
+	case 'Z':
+		s.backTab(n)
+	case 'b':
+		if s.cursor.x > 0 {
+			if prev := s.active.lines[s.cursor.y][s.cursor.x-1]; prev.Rune > ' ' {
+				for i := 0; i < clamp(n, 0, s.width*s.height); i++ {
+					s.print(prev.Rune)
+				}
+			}
+		}
+	case 'd':
+		s.moveTo(s.cursor.x, n-1)
+	case 'g':
+		switch param(params, 0, 0) {
+		case 0:
+			s.tabs[s.cursor.x] = false
+		case 3:
+			s.tabs = make([]bool, s.width)
+		}
+	case 'h', 'l':
+		for _, p := range params {
+			if p[0] == 4 {
+				s.insert = final == 'h'
+			}
+		}
+	case 'm':
+		s.sgr(params)
+	case 'r':
+		top, bottom := param(params, 0, 1)-1, param(params, 1, s.height)-1
+		bottom = clamp(bottom, 0, s.height-1)
+		if top < bottom {
+			s.top, s.bottom = top, bottom
+			s.moveTo(0, 0)
+		}
+	case 's':
+		s.saveCursor()
+	case 'u':
+		s.restoreCursor()
+	}
+}
+
+func (s *Screen) eraseDisplay(mode int) {
+	switch mode {
+	case 0:
+		s.eraseCells(s.cursor.y, s.cursor.x, s.width)
+		for y := s.cursor.y + 1; y < s.height; y++ {
+			s.eraseCells(y, 0, s.width)
+		}
+	case 1:
+		for y := 0; y < s.cursor.y; y++ {
+			s.eraseCells(y, 0, s.width)
+		}
+		s.eraseCells(s.cursor.y, 0, s.cursor.x+1)
+	case 2, 3:
+		for y := 0; y < s.height; y++ {
+			s.eraseCells(y, 0, s.width)
+		}
+	}
+}
+
+func (s *Screen) softReset() {
+	s.cursor.attr = Attr{}
+	s.cursor.origin = false
+	s.cursor.wrapNext = false
+	s.cursor.charsets = [2]byte{'B', 'B'}
+	s.cursor.shift = 0
+	s.top, s.bottom = 0, s.height-1
+	s.autowrap = true
+	s.insert = false
+	s.hidden = false
+	s.appKeypad = false
+	s.privateModes[1] = false
+}
+
+func (s *Screen) setPrivateModes(params [][]int, on bool) {
+	for _, p := range params {
+		switch mode := p[0]; mode {
+		case 6:
+			s.cursor.origin = on
+			s.moveTo(0, 0)
+		case 7:
+			s.autowrap = on
+			if !on {
+				s.cursor.wrapNext = false
+			}
+		case 25:
+			s.hidden = !on
+		case 47, 1047:
+			s.setAlternate(on, mode == 1047)
+		case 1048:
+			if on {
+				s.saveCursor()
+			} else {
+				s.restoreCursor()
+			}
+		case 1049:
+			if on {
+				s.saveCursor()
+				s.setAlternate(true, true)
+			} else {
+				s.setAlternate(false, false)
+				s.restoreCursor()
+			}
+		default:
+			s.privateModes[mode] = on
+		}
+	}
+}
+
+func (s *Screen) sgr(params [][]int) {
+	if len(params) == 0 {
+		s.cursor.attr = Attr{}
+		return
+	}
+
+	attr := &s.cursor.attr
+
+	for i := 0; i < len(params); i++ {
+		p := params[i]
+
+		switch n := p[0]; {
+		case n <= 0:
+			*attr = Attr{}
+		case n == 1:
+			attr.Flags |= AttrBold
+		case n == 2:
+			attr.Flags |= AttrDim
+		case n == 3:
+			attr.Flags |= AttrItalic
+		case n == 4:
+			if len(p) > 1 && p[1] == 0 {
+				attr.Flags &^= AttrUnderline
+			} else {
+				attr.Flags |= AttrUnderline
+			}
+		case n == 5 || n == 6:
+			attr.Flags |= AttrBlink
+		case n == 7:
+			attr.Flags |= AttrReverse
+		case n == 8:
+			attr.Flags |= AttrHidden
+		case n == 9:
+			attr.Flags |= AttrStrike
+		case n == 21:
+			attr.Flags |= AttrUnderline
+		case n == 22:
+			attr.Flags &^= AttrBold | AttrDim
+		case n == 23:
+			attr.Flags &^= AttrItalic
+		case n == 24:
+			attr.Flags &^= AttrUnderline
+		case n == 25:
+			attr.Flags &^= AttrBlink
+		case n == 27:
+			attr.Flags &^= AttrReverse
+		case n == 28:
+			attr.Flags &^= AttrHidden
+		case n == 29:
+			attr.Flags &^= AttrStrike
+		case n >= 30 && n <= 37:
+			attr.FG = Color{ColorIndexed, uint32(n - 30)}
+		case n == 38 || n == 48:
+			var color Color
+			var ok bool
+			if len(p) > 1 {
+				color, ok = extendedColor(p[1:])
+			} else {
+				var used int
+				color, used, ok = extendedColorParams(params[i+1:])
+				i += used
+			}
+			if ok {
+				if n == 38 {
+					attr.FG = color
+				} else {
+					attr.BG = color
+				}
+			}
+		case n == 39:
+			attr.FG = Color{}
+		case n >= 40 && n <= 47:
+			attr.BG = Color{ColorIndexed, uint32(n - 40)}
+		case n == 49:
+			attr.BG = Color{}
+		case n >= 90 && n <= 97:
+			attr.FG = Color{ColorIndexed, uint32(n - 90 + 8)}
+		case n >= 100 && n <= 107:
+			attr.BG = Color{ColorIndexed, uint32(n - 100 + 8)}
+		}
+	}
+}
+
+// extendedColor reads the colon separated form of SGR 38 and 48.
+func extendedColor(sub []int) (Color, bool) {
+	switch {
+	case sub[0] == 5 && len(sub) >= 2:
+		return indexedColor(sub[1])
+	case sub[0] == 2 && len(sub) >= 5:
+		// 38:2:colorspace:r:g:b
+		return rgbColor(sub[len(sub)-3:])
+	case sub[0] == 2 && len(sub) == 4:
+		return rgbColor(sub[1:])
+	}
+	return Color{}, false
+}
+
+// extendedColorParams reads the semicolon separated form of SGR 38 and 48 and
+// returns how many extra parameters it consumed.
+func extendedColorParams(params [][]int) (Color, int, bool) {
+	if len(params) == 0 {
+		return Color{}, 0, false
+	}
+
+	switch params[0][0] {
+	case 5:
+		if len(params) < 2 {
+			return Color{}, len(params), false
+		}
+		c, ok := indexedColor(params[1][0])
+		return c, 2, ok
+	case 2:
+		if len(params) < 4 {
+			return Color{}, len(params), false
+		}
+		c, ok := rgbColor([]int{params[1][0], params[2][0], params[3][0]})
+		return c, 4, ok
+	}
+
+	return Color{}, 1, false
+}
+
+func indexedColor(n int) (Color, bool) {
+	if n < 0 || n > 255 {
+		return Color{}, false
+	}
+	return Color{ColorIndexed, uint32(n)}, true
+}
+
+func rgbColor(rgb []int) (Color, bool) {
+	var value uint32
+	for _, c := range rgb {
+		if c < 0 || c > 255 {
+			return Color{}, false
+		}
+		value = value<<8 | uint32(c)
+	}
+	return Color{ColorRGB, value}, true
+}
+
+// wideRanges are the (approximate) east asian wide and fullwidth ranges.
+var wideRanges = [][2]rune{
+	{0x1100, 0x115f}, {0x231a, 0x231b}, {0x2329, 0x232a}, {0x23e9, 0x23ec},
+	{0x2630, 0x2637}, {0x2648, 0x2653}, {0x26aa, 0x26ab}, {0x26bd, 0x26be},
+	{0x26c4, 0x26c5}, {0x26f2, 0x26f5}, {0x2705, 0x2705}, {0x270a, 0x270b},
+	{0x2728, 0x2728}, {0x274c, 0x274c}, {0x2753, 0x2755}, {0x2795, 0x2797},
+	{0x2b1b, 0x2b1c}, {0x2e80, 0x303e}, {0x3041, 0x33ff}, {0x3400, 0x4dbf},
+	{0x4e00, 0x9fff}, {0xa000, 0xa4cf}, {0xa960, 0xa97f}, {0xac00, 0xd7a3},
+	{0xf900, 0xfaff}, {0xfe10, 0xfe19}, {0xfe30, 0xfe6f}, {0xff00, 0xff60},
+	{0xffe0, 0xffe6}, {0x1f300, 0x1f64f}, {0x1f680, 0x1f6ff}, {0x1f900, 0x1f9ff},
+	{0x1fa70, 0x1faff}, {0x20000, 0x3fffd},
+}
+
+// Truncate returns as much of s as fits in width columns of a terminal,
+// without splitting a character.
+func Truncate(s string, width int) string {
+	for i, r := range s {
+		if width -= runeWidth(r); width < 0 {
+			return s[:i]
+		}
+	}
+
+	return s
+}
+
+// runeWidth returns the number of columns r occupies on a terminal.
+func runeWidth(r rune) int {
+	if r == 0 || unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) {
+		return 0
+	}
+
+	for _, rng := range wideRanges {
+		if r < rng[0] {
+			break
+		}
+		if r <= rng[1] {
+			return 2
+		}
+	}
+
+	return 1
+}
@@ -1,6 +1,7 @@
 package termproxy
 
 import (
+	"fmt"
 	"net"
 
 	term "github.com/erikh/termproxy/dockerterm"
@@ -16,3 +17,90 @@ func (w Winch) ToWinsize() *term.Winsize {
 	// the precision loss shouldn't matter
 	return &term.Winsize{Height: uint16(w.Height), Width: uint16(w.Width)}
 }
+
+// ResizePolicy decides the size of a PTY shared by terminals of different
+// sizes.
+type ResizePolicy int
+
+const (
+	// ResizeSmallest fits the PTY into every terminal.
+	ResizeSmallest ResizePolicy = iota
+	// ResizeLargest fills the largest terminal, in each direction; smaller
+	// terminals see only part of it.
+	ResizeLargest
+	// ResizeHost follows the host's terminal.
+	ResizeHost
+	// ResizeDriver follows the terminal of whoever has control.
+	ResizeDriver
+	// ResizeActive follows the terminal of whoever typed last.
+	ResizeActive
+)
+
+// ResizePolicies lists every policy, in the order a host cycles through them.
+var ResizePolicies = []ResizePolicy{ResizeSmallest, ResizeLargest, ResizeHost, ResizeDriver, ResizeActive}
+
+func (p ResizePolicy) String() string {
+	switch p {
+	case ResizeSmallest:
+		return "smallest"
+	case ResizeLargest:
+		return "largest"
+	case ResizeHost:
+		return "host"
+	case ResizeDriver:
+		return "driver"
+	case ResizeActive:
+		return "active"
+	}
+
+	return fmt.Sprintf("ResizePolicy(%d)", int(p))
+}
+
+// ParseResizePolicy converts the name of a policy into a ResizePolicy.
+func ParseResizePolicy(name string) (ResizePolicy, error) {
+	for _, p := range ResizePolicies {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+
+	return ResizeSmallest, fmt.Errorf("unknown resize policy %q; expected smallest, largest, host, driver or active", name)
+}
+
+// Size picks the size of a PTY shared by terminals of sizes, keyed by
+// whatever names them. The host, driver and active policies follow the
+// terminal named by followed, falling back to the smallest size when it is not
+// among sizes. Without any sizes the result is zero.
+func (p ResizePolicy) Size(sizes map[string]Winch, followed string) Winch {
+	switch p {
+	case ResizeHost, ResizeDriver, ResizeActive:
+		if ws, ok := sizes[followed]; ok && ws.Width != 0 && ws.Height != 0 {
+			return Winch{Width: ws.Width, Height: ws.Height}
+		}
+	}
+
+	var size Winch
+
+	// better reports whether n should replace the size picked so far, m.
+	better := func(n, m uint) bool {
+		if p == ResizeLargest {
+			return n > m
+		}
+		return m == 0 || n < m
+	}
+
+	for _, ws := range sizes {
+		if ws.Width == 0 || ws.Height == 0 {
+			continue
+		}
+
+		if better(ws.Width, size.Width) {
+			size.Width = ws.Width
+		}
+		if better(ws.Height, size.Height) {
+			size.Height = ws.Height
+		}
+	}
+
+	return size
+}
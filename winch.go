@@ -2,63 +2,167 @@ package main
 
 import (
 	"net"
-	"os"
-	"sync"
 
-	"github.com/erikh/termproxy/server"
 	"github.com/erikh/termproxy/termproxy"
 )
 
-var (
-	connectionWinsizeMap = map[string]termproxy.Winch{}
-	winsizeMutex         = new(sync.Mutex)
-)
+// winsizeKey names the terminal of owner, one of the session's writers, in
+// its winsizes: the host's terminal is "localhost", and clients go by their
+// address.
+func winsizeKey(owner interface{}) string {
+	if conn, ok := owner.(net.Conn); ok {
+		return conn.RemoteAddr().String()
+	}
 
-func compareAndSetWinsize(host string, ws termproxy.Winch, command *termproxy.Command, s *server.SSHServer) {
-	winsizeMutex.Lock()
-	connectionWinsizeMap[host] = ws
+	return "localhost"
+}
 
-	var height, width uint
+// setWinsize records the size of one of the session's terminals, keyed by
+// host, and resizes the program as the session's resize policy says.
+func (sess *session) setWinsize(host string, ws termproxy.Winch) {
+	sess.winsizeMutex.Lock()
+	defer sess.winsizeMutex.Unlock()
 
-	for _, wm := range connectionWinsizeMap {
-		if height == 0 || width == 0 {
-			height = wm.Height
-			width = wm.Width
-		}
-		if wm.Height <= height {
-			height = wm.Height
+	sess.winsizes[host] = ws
+	sess.resize()
+}
+
+// forgetWinsize drops the size of a terminal which has left the session, and
+// resizes the program for those left.
+func (sess *session) forgetWinsize(host string) {
+	sess.winsizeMutex.Lock()
+	defer sess.winsizeMutex.Unlock()
+
+	delete(sess.winsizes, host)
+	if sess.active == host {
+		sess.active = ""
+	}
+	sess.resize()
+}
+
+// setResizePolicy changes how the session's size is picked, and resizes the
+// program to suit.
+func (sess *session) setResizePolicy(policy termproxy.ResizePolicy) {
+	sess.winsizeMutex.Lock()
+	changed := sess.resizePolicy != policy
+	sess.resizePolicy = policy
+	if changed {
+		sess.resize()
+	}
+	sess.winsizeMutex.Unlock()
+
+	if changed {
+		termproxy.WriteTop(sess.hub.Overlay(), "The host made the session's size follow the "+policyDescription(policy)+"\n")
+		events.emit(event{Type: "resize-policy", Session: sess.name, Policy: policy.String()})
+	}
+}
+
+// getResizePolicy returns how the session's size is picked.
+func (sess *session) getResizePolicy() termproxy.ResizePolicy {
+	sess.winsizeMutex.Lock()
+	defer sess.winsizeMutex.Unlock()
+	return sess.resizePolicy
+}
+
+// typed notes that owner typed into the session, which the active policy
+// follows.
+func (sess *session) typed(owner interface{}) {
+	key := winsizeKey(owner)
+
+	sess.winsizeMutex.Lock()
+	defer sess.winsizeMutex.Unlock()
+
+	if sess.active != key {
+		sess.active = key
+		if sess.resizePolicy == termproxy.ResizeActive {
+			sess.resize()
 		}
+	}
+}
 
-		if wm.Width <= width {
-			width = wm.Width
+// controlChanged resizes the session for a new driver, which the driver
+// policy follows.
+func (sess *session) controlChanged() {
+	sess.winsizeMutex.Lock()
+	defer sess.winsizeMutex.Unlock()
+
+	if sess.resizePolicy == termproxy.ResizeDriver {
+		sess.resize()
+	}
+}
+
+// setSize resizes the program to ws, whatever the policy says, until a
+// terminal's size next changes.
+func (sess *session) setSize(ws termproxy.Winch) error {
+	sess.winsizeMutex.Lock()
+	defer sess.winsizeMutex.Unlock()
+
+	return sess.resizeTo(ws)
+}
+
+// resize sizes the program by the session's policy. The caller holds
+// winsizeMutex.
+func (sess *session) resize() {
+	followed := ""
+	switch sess.resizePolicy {
+	case termproxy.ResizeHost:
+		followed = "localhost"
+	case termproxy.ResizeDriver:
+		followed = "localhost"
+		if sess.control != nil {
+			followed = winsizeKey(sess.control.Driver())
 		}
+	case termproxy.ResizeActive:
+		followed = sess.active
 	}
 
-	// send the clear only in the height case, it will resolve itself with width.
-	myws, _ := termproxy.GetWinsize(0)
+	size := sess.resizePolicy.Size(sess.winsizes, followed)
+	if size.Width == 0 || size.Height == 0 {
+		// nobody is watching; the program keeps its size.
+		return
+	}
 
-	if myws.Height != height {
-		s.Iterate(func(s *server.SSHServer, c net.Conn, index int) error {
-			termproxy.WriteClear(c)
-			return nil
-		})
+	sess.resizeTo(size)
+}
 
-		termproxy.WriteClear(os.Stdout)
+// resizeTo resizes the program to size. Terminals of a different size,
+// the host's included, are painted their own view of the screen: framed in
+// the middle of a larger terminal, or following the cursor on a smaller one.
+// Those of unknown size are painted afresh. The caller holds winsizeMutex.
+func (sess *session) resizeTo(size termproxy.Winch) error {
+	if err := sess.command.Resize(size); err != nil {
+		return err
 	}
 
-	termproxy.SetWinsize(command.PTY().Fd(), termproxy.Winch{Height: height, Width: width})
+	sess.clients.fit(sess.winsizes, size)
+	sess.fitHost()
+
+	return nil
+}
 
-	s.Iterate(func(s *server.SSHServer, c net.Conn, index int) error {
-		payload := []byte{
-			0, 0, byte(ws.Width >> 8 & 0xFF), byte(ws.Width & 0xFF),
-			0, 0, byte(ws.Height >> 8 & 0xFF), byte(ws.Height & 0xFF),
-			0, 0, 0, 0,
-			0, 0, 0, 0,
+// fitHost gives the hub the size of the host's terminal, if it is watching the
+// session. The caller holds winsizeMutex.
+func (sess *session) fitHost() {
+	if ws, ok := sess.winsizes["localhost"]; ok {
+		if out := hostTerm.watching(sess); out != nil {
+			sess.hub.SetSize(out, int(ws.Width), int(ws.Height))
 		}
+	}
+}
 
-		c.(*server.Conn).SendRequest("window-change", false, payload)
-		return nil
-	})
+// policyDescription describes whom a resize policy makes the session's size
+// follow.
+func policyDescription(policy termproxy.ResizePolicy) string {
+	switch policy {
+	case termproxy.ResizeLargest:
+		return "largest terminal"
+	case termproxy.ResizeHost:
+		return "host's terminal"
+	case termproxy.ResizeDriver:
+		return "terminal of whoever has control"
+	case termproxy.ResizeActive:
+		return "terminal of whoever typed last"
+	}
 
-	winsizeMutex.Unlock()
+	return "smallest terminal"
 }